@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fholzer/go-socks5/pkg/socks5"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+var commandNames = map[uint8]string{
+	socks5.ConnectCommand:    "CONNECT",
+	socks5.BindCommand:       "BIND",
+	socks5.AssociateCommand:  "ASSOCIATE",
+	socks5.ResolveCommand:    "RESOLVE",
+	socks5.ResolvePTRCommand: "RESOLVE_PTR",
+}
+
+// accessRecord holds the fields of a single access log line. Rule and Reply
+// are -1 if no rule matched, or no reply was sent, e.g. as authentication
+// failed.
+type accessRecord struct {
+	Time            time.Time
+	Duration        time.Duration
+	ResolveDuration time.Duration
+	ConnectDuration time.Duration
+	Listener        string
+	Client          string
+	User            string
+	Auth            string
+	Command         string
+	Destination     string
+	RealDestination string
+	Resolver        string
+	Rule            int
+	ProxyType       string
+	ProxyAddress    string
+	Reply           int
+	RequestBytes    int64
+	ResponseBytes   int64
+	Error           string
+}
+
+func newAccessRecord(listener string, request *socks5.Request, conn net.Conn, ctx context.Context) *accessRecord {
+	finish := request.FinishTime
+	if finish.IsZero() {
+		finish = time.Now()
+	}
+	r := &accessRecord{
+		Time:          finish,
+		Duration:      finish.Sub(request.StartTime),
+		Listener:      listener,
+		Auth:          request.AuthOutcome.String(),
+		Command:       commandNames[request.Command],
+		Rule:          -1,
+		Reply:         -1,
+		RequestBytes:  request.ReqByte,
+		ResponseBytes: request.RespByte,
+	}
+	// Requests failing before the command was read have none
+	if r.Command == "" && request.Command != 0 {
+		r.Command = strconv.Itoa(int(request.Command))
+	}
+	if request.Replied {
+		r.Reply = int(request.Reply)
+	}
+	if !request.ResolveTime.IsZero() {
+		r.ResolveDuration = request.ResolveTime.Sub(request.StartTime)
+	}
+	if !request.ConnTime.IsZero() {
+		r.ConnectDuration = request.ConnTime.Sub(request.StartTime)
+	}
+
+	if request.ClientAddr != nil {
+		r.Client = request.ClientAddr.String()
+	} else if conn != nil {
+		r.Client = conn.RemoteAddr().String()
+	}
+	if request.AuthContext != nil {
+		r.User = request.AuthContext.Payload["Username"]
+	}
+	if request.DestAddr != nil {
+		r.Destination = request.DestAddr.Address()
+		if request.DestAddr.FQDN != "" {
+			r.Destination = net.JoinHostPort(request.DestAddr.FQDN, strconv.Itoa(request.DestAddr.Port))
+		}
+	}
+	if real := request.RealDestAddr(); real != nil {
+		r.RealDestination = real.Address()
+	}
+	r.Resolver, _ = socks5.ResolverNameFromContext(ctx)
+	if rule, ok := ctx.Value("matchingRuleId").(int); ok {
+		r.Rule = rule
+	}
+	r.ProxyType, _ = ctx.Value("proxyType").(string)
+	r.ProxyAddress, _ = ctx.Value("proxyAddress").(string)
+	if request.Err != nil {
+		r.Error = request.Err.Error()
+	}
+	return r
+}
+
+// fields returns the record as ordered key/value pairs
+func (r *accessRecord) fields() [][2]interface{} {
+	return [][2]interface{}{
+		{"time", r.Time.Format(time.RFC3339Nano)},
+		{"duration_ms", r.Duration.Milliseconds()},
+		{"resolve_ms", r.ResolveDuration.Milliseconds()},
+		{"connect_ms", r.ConnectDuration.Milliseconds()},
+		{"listener", r.Listener},
+		{"client", r.Client},
+		{"user", r.User},
+		{"auth", r.Auth},
+		{"command", r.Command},
+		{"destination", r.Destination},
+		{"real_destination", r.RealDestination},
+		{"resolver", r.Resolver},
+		{"rule", r.Rule},
+		{"proxy_type", r.ProxyType},
+		{"proxy_address", r.ProxyAddress},
+		{"reply", r.Reply},
+		{"request_bytes", r.RequestBytes},
+		{"response_bytes", r.ResponseBytes},
+		{"error", r.Error},
+	}
+}
+
+type accessFormatter func(buf *bytes.Buffer, r *accessRecord) error
+
+// formatJSON writes one JSON object per line
+func formatJSON(buf *bytes.Buffer, r *accessRecord) error {
+	buf.WriteByte('{')
+	for i, field := range r.fields() {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(field[0])
+		value, err := json.Marshal(field[1])
+		if err != nil {
+			return err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteString("}\n")
+	return nil
+}
+
+// formatLogfmt writes key=value pairs, quoting values where needed
+func formatLogfmt(buf *bytes.Buffer, r *accessRecord) error {
+	for i, field := range r.fields() {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		value := fmt.Sprint(field[1])
+		buf.WriteString(field[0].(string))
+		buf.WriteByte('=')
+		if value == "" || strings.ContainsAny(value, " =\"\t\n") {
+			value = strconv.Quote(value)
+		}
+		buf.WriteString(value)
+	}
+	buf.WriteByte('\n')
+	return nil
+}
+
+// formatSquid writes lines resembling Squid's native access.log format:
+// time elapsed client result/reply bytes command destination user
+// hierarchy/peer type. Failed logins are logged as TCP_DENIED, and
+// requests without reply with reply code 000, like Squid does.
+func formatSquid(buf *bytes.Buffer, r *accessRecord) error {
+	result := "TCP_TUNNEL"
+	switch {
+	case r.Reply == int(socks5.ReplyRuleFailure):
+		result = "TCP_DENIED"
+	case r.Auth == socks5.AuthOutcomeInvalidCredentials.String(), r.Auth == socks5.AuthOutcomeNoAcceptableMethod.String():
+		result = "TCP_DENIED"
+	case r.Reply != int(socks5.ReplySucceeded) || r.Error != "":
+		result = "TCP_ERROR"
+	}
+	reply := r.Reply
+	if reply < 0 {
+		reply = 0
+	}
+
+	client := r.Client
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	hierarchy := strings.ToUpper(r.ProxyType)
+	peer := r.ProxyAddress
+	if hierarchy == "" {
+		hierarchy = "DIRECT"
+	}
+	if peer == "" {
+		peer = r.RealDestination
+	}
+
+	fmt.Fprintf(buf, "%d.%03d %6d %s %s/%03d %d %s %s %s %s/%s -\n",
+		r.Time.Unix(), r.Time.Nanosecond()/int(time.Millisecond),
+		r.Duration.Milliseconds(),
+		dashIfEmpty(client),
+		result, reply,
+		r.RequestBytes+r.ResponseBytes,
+		dashIfEmpty(r.Command),
+		dashIfEmpty(r.Destination),
+		dashIfEmpty(r.User),
+		hierarchy, dashIfEmpty(peer))
+	return nil
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+var accessFormatters = map[string]accessFormatter{
+	"json":   formatJSON,
+	"logfmt": formatLogfmt,
+	"squid":  formatSquid,
+}
+
+// AccessLog writes a line per request, independent of the log level
+type AccessLog struct {
+	format accessFormatter
+	out    io.Writer
+
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	stop   chan struct{}
+	closed bool
+	// next is the access log which took over after a reload
+	next *AccessLog
+}
+
+func NewAccessLog(cfg *accessLogConfig) (*AccessLog, error) {
+	format := cfg.Format
+	if format == "" {
+		format = "json"
+	}
+	formatter, ok := accessFormatters[format]
+	if !ok {
+		return nil, fmt.Errorf("Unknown format: %s", cfg.Format)
+	}
+
+	a := &AccessLog{format: formatter}
+	if cfg.File == "" || cfg.File == "-" {
+		a.out = os.Stdout
+		return a, nil
+	}
+
+	logger := &lumberjack.Logger{
+		Filename:   cfg.File,
+		MaxSize:    cfg.MaxSize,
+		MaxBackups: cfg.MaxBackups,
+		Compress:   cfg.Compress,
+		LocalTime:  true,
+	}
+	if cfg.MaxAge > 0 {
+		// Retention is configured in days, rounded up
+		logger.MaxAge = int((cfg.MaxAge + 24*time.Hour - 1) / (24 * time.Hour))
+	}
+	a.out = logger
+
+	if cfg.RotateEvery > 0 {
+		a.stop = make(chan struct{})
+		go a.rotateEvery(logger, cfg.RotateEvery)
+	}
+	return a, nil
+}
+
+func (a *AccessLog) rotateEvery(logger *lumberjack.Logger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.mu.Lock()
+			// Rotating a closed file would reopen it
+			if !a.closed {
+				if err := logger.Rotate(); err != nil {
+					log.Errorf("Unable to rotate access log: %v", err)
+				}
+			}
+			a.mu.Unlock()
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// Log writes the access log line of a finished request
+func (a *AccessLog) Log(listener string, request *socks5.Request, conn net.Conn, ctx context.Context) {
+	a.mu.Lock()
+	if next := a.next; next != nil {
+		a.mu.Unlock()
+		next.Log(listener, request, conn, ctx)
+		return
+	}
+	defer a.mu.Unlock()
+	record := newAccessRecord(listener, request, conn, ctx)
+	a.buf.Reset()
+	if err := a.format(&a.buf, record); err != nil {
+		log.Errorf("Unable to format access log line: %v", err)
+		return
+	}
+	if _, err := a.out.Write(a.buf.Bytes()); err != nil {
+		log.Errorf("Unable to write access log: %v", err)
+	}
+}
+
+// handOver closes the log file and passes the lines of requests still
+// running to next, which replaces the access log on reload. This way a file
+// is only ever written and rotated by a single logger.
+func (a *AccessLog) handOver(next *AccessLog) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.next = next
+	return a.close()
+}
+
+// Close stops rotation and closes the log file
+func (a *AccessLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.close()
+}
+
+func (a *AccessLog) close() error {
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	if a.stop != nil {
+		close(a.stop)
+	}
+	if closer, ok := a.out.(io.Closer); ok && a.out != os.Stdout {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fholzer/go-socks5/pkg/socks5"
+)
+
+func testAccessRecord() *accessRecord {
+	return &accessRecord{
+		Time:            time.Date(2026, 1, 2, 3, 4, 5, 678000000, time.UTC),
+		Duration:        1500 * time.Millisecond,
+		ResolveDuration: 20 * time.Millisecond,
+		ConnectDuration: 50 * time.Millisecond,
+		Listener:        "public",
+		Client:          "192.0.2.1:40000",
+		User:            "foo",
+		Auth:            "success",
+		Command:         "CONNECT",
+		Destination:     "example.com:443",
+		RealDestination: "198.51.100.1:443",
+		Resolver:        "default",
+		Rule:            2,
+		ProxyType:       "socks5",
+		ProxyAddress:    "10.0.0.1:1080",
+		Reply:           0,
+		RequestBytes:    100,
+		ResponseBytes:   2000,
+	}
+}
+
+// failedLoginRecord is the record of a client sending a wrong password
+func failedLoginRecord() *accessRecord {
+	request := &socks5.Request{
+		ClientAddr:  &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000},
+		StartTime:   time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		FinishTime:  time.Date(2026, 1, 2, 3, 4, 5, 678000000, time.UTC),
+		AuthOutcome: socks5.AuthOutcomeInvalidCredentials,
+		Err:         errors.New("Failed to authenticate: User authentication failed"),
+	}
+	return newAccessRecord("public", request, nil, context.Background())
+}
+
+func TestFormatJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := formatJSON(&buf, testAccessRecord()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := `{"time":"2026-01-02T03:04:05.678Z","duration_ms":1500,"resolve_ms":20,"connect_ms":50,` +
+		`"listener":"public","client":"192.0.2.1:40000","user":"foo","auth":"success","command":"CONNECT",` +
+		`"destination":"example.com:443","real_destination":"198.51.100.1:443","resolver":"default","rule":2,` +
+		`"proxy_type":"socks5","proxy_address":"10.0.0.1:1080","reply":0,"request_bytes":100,"response_bytes":2000,` +
+		`"error":""}` + "\n"
+	if buf.String() != expected {
+		t.Fatalf("bad:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+
+	buf.Reset()
+	if err := formatJSON(&buf, failedLoginRecord()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if fields["auth"] != "invalid_credentials" || fields["reply"] != float64(-1) || fields["command"] != "" {
+		t.Fatalf("bad: %s", buf.String())
+	}
+	if fields["error"] != "Failed to authenticate: User authentication failed" || fields["duration_ms"] != float64(678) {
+		t.Fatalf("bad: %s", buf.String())
+	}
+}
+
+func TestFormatLogfmt(t *testing.T) {
+	record := testAccessRecord()
+	record.Error = `dial tcp: "refused"`
+	var buf bytes.Buffer
+	if err := formatLogfmt(&buf, record); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := `time=2026-01-02T03:04:05.678Z duration_ms=1500 resolve_ms=20 connect_ms=50 ` +
+		`listener=public client=192.0.2.1:40000 user=foo auth=success command=CONNECT ` +
+		`destination=example.com:443 real_destination=198.51.100.1:443 resolver=default rule=2 ` +
+		`proxy_type=socks5 proxy_address=10.0.0.1:1080 reply=0 request_bytes=100 response_bytes=2000 ` +
+		`error="dial tcp: \"refused\""` + "\n"
+	if buf.String() != expected {
+		t.Fatalf("bad:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+
+	buf.Reset()
+	if err := formatLogfmt(&buf, failedLoginRecord()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, field := range []string{` user="" `, ` auth=invalid_credentials `, ` command="" `, ` rule=-1 `, ` reply=-1 `} {
+		if !bytes.Contains(buf.Bytes(), []byte(field)) {
+			t.Fatalf("missing %q: %s", field, buf.String())
+		}
+	}
+}
+
+func TestFormatSquid(t *testing.T) {
+	cases := []struct {
+		record   func(*accessRecord)
+		expected string
+	}{
+		{
+			func(r *accessRecord) {},
+			"1767323045.678   1500 192.0.2.1 TCP_TUNNEL/000 2100 CONNECT example.com:443 foo SOCKS5/10.0.0.1:1080 -\n",
+		},
+		{
+			func(r *accessRecord) {
+				r.ProxyType, r.ProxyAddress, r.Reply = "", "", int(socks5.ReplyRuleFailure)
+				r.RequestBytes, r.ResponseBytes = 0, 0
+			},
+			"1767323045.678   1500 192.0.2.1 TCP_DENIED/002 0 CONNECT example.com:443 foo DIRECT/198.51.100.1:443 -\n",
+		},
+		{
+			func(r *accessRecord) {
+				r.Reply, r.Error = int(socks5.ReplyConnectionRefused), "connection refused"
+			},
+			"1767323045.678   1500 192.0.2.1 TCP_ERROR/005 2100 CONNECT example.com:443 foo SOCKS5/10.0.0.1:1080 -\n",
+		},
+	}
+	for _, c := range cases {
+		record := testAccessRecord()
+		c.record(record)
+		var buf bytes.Buffer
+		if err := formatSquid(&buf, record); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if buf.String() != c.expected {
+			t.Fatalf("bad:\n%s\nexpected:\n%s", buf.String(), c.expected)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := formatSquid(&buf, failedLoginRecord()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := "1767323045.678    678 192.0.2.1 TCP_DENIED/000 0 - - - DIRECT/- -\n"
+	if buf.String() != expected {
+		t.Fatalf("bad:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestAccessLog_HandOver(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "access.log")
+	previous, err := NewAccessLog(&accessLogConfig{File: file, Format: "json", RotateEvery: time.Hour})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	next, err := NewAccessLog(&accessLogConfig{File: file, Format: "logfmt", RotateEvery: time.Hour})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer next.Close()
+
+	request := &socks5.Request{
+		ClientAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000},
+		StartTime:  time.Now(),
+	}
+	previous.Log("public", request, nil, context.Background())
+	if err := previous.handOver(next); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := previous.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	// Requests still running on the previous access log are written by next
+	previous.Log("public", request, nil, context.Background())
+	next.Log("private", request, nil, context.Background())
+
+	out, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "{") ||
+		!strings.Contains(lines[1], "listener=public") || !strings.Contains(lines[2], "listener=private") {
+		t.Fatalf("bad: %s", out)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("expected a single log file, got %d", len(files))
+	}
+}
@@ -1,51 +1,225 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"time"
 
 	ucfg "github.com/elastic/go-ucfg"
 	"github.com/elastic/go-ucfg/yaml"
+	"github.com/fholzer/go-socks5/pkg/socks5"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 const configFileName = "config.yml"
 
+type forwarderProxyProtocolConfig struct {
+	Version     int
+	UsernameTLV int `config:"username_tlv"`
+}
+
 type forwarderConfig struct {
-	Type    string
-	Address string
+	Type          string
+	Network       string
+	Address       string
+	ProxyProtocol *forwarderProxyProtocolConfig `config:"proxy_protocol"`
 }
 
 type ruleConfig struct {
+	Domains   []string
 	Subnets   []string
 	Forwarder forwarderConfig
 }
 
+type rewriteConfig struct {
+	Domains []string
+	Subnets []string
+	Ports   []string
+	To      string
+}
+
+type tlsConfig struct {
+	CA   string
+	Cert string
+	Key  string
+}
+
+type webhookConfig struct {
+	URL              string
+	Timeout          time.Duration
+	CacheTTL         time.Duration `config:"cache_ttl"`
+	NegativeCacheTTL time.Duration `config:"negative_cache_ttl"`
+	TLS              *tlsConfig
+}
+
+type ldapConfig struct {
+	URL            string
+	StartTLS       bool     `config:"start_tls"`
+	BindDN         string   `config:"bind_dn"`
+	BindPassword   string   `config:"bind_password"`
+	BaseDN         string   `config:"base_dn"`
+	UserFilter     string   `config:"user_filter"`
+	GroupAttribute string   `config:"group_attribute"`
+	RequiredGroups []string `config:"required_groups"`
+	PoolSize       int      `config:"pool_size"`
+	Timeout        time.Duration
+	TLS            *tlsConfig
+}
+
+type bruteForceConfig struct {
+	MaxFailures     int `config:"max_failures"`
+	Window          time.Duration
+	Lockout         time.Duration
+	BaseDelay       time.Duration `config:"base_delay"`
+	MaxDelay        time.Duration `config:"max_delay"`
+	TrustedNetworks []string      `config:"trusted_networks"`
+}
+
+type authConfig struct {
+	UsersFile  string `config:"users_file"`
+	Webhook    *webhookConfig
+	LDAP       *ldapConfig
+	BruteForce *bruteForceConfig `config:"brute_force"`
+}
+
+type dnsCacheConfig struct {
+	MaxEntries  int           `config:"max_entries"`
+	DefaultTTL  time.Duration `config:"default_ttl"`
+	MinTTL      time.Duration `config:"min_ttl"`
+	MaxTTL      time.Duration `config:"max_ttl"`
+	NegativeTTL time.Duration `config:"negative_ttl"`
+}
+
+type dnsHostConfig struct {
+	Name      string
+	Addresses []string
+}
+
+type dnsRouteConfig struct {
+	Name     string
+	Suffixes []string
+	Servers  []string
+	Timeout  time.Duration
+	Retries  int
+	TLS      *tlsConfig
+}
+
+type dnsConfig struct {
+	Servers       []string
+	Timeout       time.Duration
+	Retries       int
+	TLS           *tlsConfig
+	Cache         *dnsCacheConfig
+	AddressFamily string `config:"address_family"`
+	Hosts         []dnsHostConfig
+	HostsFile     string `config:"hosts_file"`
+	Routes        []dnsRouteConfig
+}
+
+type accessLogConfig struct {
+	File        string
+	Format      string
+	MaxSize     int           `config:"max_size"`
+	MaxAge      time.Duration `config:"max_age"`
+	MaxBackups  int           `config:"max_backups"`
+	Compress    bool
+	RotateEvery time.Duration `config:"rotate_every"`
+}
+
+type tracingHeaderConfig struct {
+	Name  string
+	Value string
+}
+
+type tracingConfig struct {
+	Endpoint    string
+	Insecure    bool
+	TLS         *tlsConfig
+	Headers     []tracingHeaderConfig
+	Timeout     time.Duration
+	ServiceName string  `config:"service_name"`
+	SampleRatio float64 `config:"sample_ratio"`
+}
+
+type proxyProtocolConfig struct {
+	Trusted []string
+	Timeout time.Duration
+}
+
+type listenerConfig struct {
+	Name             string
+	Network          string
+	Bind             string
+	Auth             *authConfig
+	AllowedClients   []string `config:"allowed_clients"`
+	TLS              *tlsConfig
+	ProxyProtocol    *proxyProtocolConfig `config:"proxy_protocol"`
+	Rules            []ruleConfig
+	DefaultForwarder *forwarderConfig `config:"defaultForwarder"`
+}
+
 type rawConfiguration struct {
 	Loglevel         string
 	Logformat        string
+	AccessLog        *accessLogConfig `config:"access_log"`
+	Tracing          *tracingConfig
+	ShutdownTimeout  time.Duration `config:"shutdown_timeout"`
+	BufferSize       int           `config:"buffer_size"`
+	RelayLinger      time.Duration `config:"relay_linger"`
 	Bind             string
+	ProxyProtocol    *proxyProtocolConfig `config:"proxy_protocol"`
+	Listeners        []listenerConfig
+	Auth             authConfig
+	DNS              dnsConfig
+	Rewrites         []rewriteConfig
 	Rules            []ruleConfig
 	DefaultForwarder *forwarderConfig `config:"defaultForwarder"`
 }
 
 type Configuration struct {
-	Loglevel         logrus.Level
-	Bind             string
-	Rules            []Rule
-	DefaultForwarder *Forwarder
+	Loglevel        logrus.Level
+	LogFormatter    logrus.Formatter
+	ShutdownTimeout time.Duration
+	BufferSize      int
+	RelayLinger     time.Duration
+	Listeners       []Listener
+	AccessLog       *AccessLog
+	Tracing         *socks5.TracingObserver
+	TracerProvider  *sdktrace.TracerProvider
+	Resolver        socks5.NameResolver
+	AddressFamily   socks5.AddressFamily
+	Rewriter        socks5.AddressRewriter
+
+	// Credential stores opened for the listeners
+	credentials []socks5.CredentialStore
+
+	// Connections served with the configuration, and whether it was
+	// replaced by another. Guarded by servicesMu.
+	conns    int
+	replaced bool
 }
 
 var (
 	defaultConfig = rawConfiguration{
 		Loglevel:         "info",
 		Logformat:        "text",
+		ShutdownTimeout:  30 * time.Second,
 		Bind:             "127.0.0.1:5757",
 		Rules:            nil,
 		DefaultForwarder: nil,
 	}
 )
 
-func ParseConfig(filename string) (*Configuration, error) {
+// ParseConfig reads the configuration file. Nothing is changed until the
+// configuration is applied, so an invalid file leaves the running
+// configuration as is.
+func ParseConfig(filename string) (_ *Configuration, err error) {
 	config, err := yaml.NewConfigWithFile(filename, ucfg.PathSep("."))
 	if err != nil {
 		return nil, fmt.Errorf("Fatal error reading config file: %w", err)
@@ -56,40 +230,331 @@ func ParseConfig(filename string) (*Configuration, error) {
 		return nil, fmt.Errorf("Unable to parse config file: %v", err)
 	}
 
-	loglevel, err := logrus.ParseLevel(appConfig.Loglevel)
-	if err != nil {
+	parsed := &Configuration{
+		ShutdownTimeout: appConfig.ShutdownTimeout,
+		BufferSize:      appConfig.BufferSize,
+		RelayLinger:     appConfig.RelayLinger,
+	}
+	// Close what was opened before a later setting turned out invalid
+	defer func() {
+		if err != nil {
+			parsed.Close()
+		}
+	}()
+
+	if parsed.Loglevel, err = logrus.ParseLevel(appConfig.Loglevel); err != nil {
 		return nil, fmt.Errorf("Unable to parse loglevel. %v", err)
 	}
-	log.SetLevel(loglevel)
+	if parsed.LogFormatter, err = parseLogFormat(appConfig.Logformat); err != nil {
+		return nil, err
+	}
 
-	switch appConfig.Logformat {
-	case "text": // nothing to do here. Text is the default anyway
-	case "json":
-		log.SetFormatter(&logrus.JSONFormatter{})
-	default:
-		log.Fatalf("Unknown log format: %s", appConfig.Logformat)
+	// Without listeners, a single one is configured by bind and the
+	// top level settings
+	listenerConfigs := appConfig.Listeners
+	if len(listenerConfigs) == 0 {
+		listenerConfigs = []listenerConfig{{
+			Bind:          appConfig.Bind,
+			ProxyProtocol: appConfig.ProxyProtocol,
+		}}
 	}
+	resolver, err := NewResolver(&appConfig.DNS)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse dns: %v", err)
+	}
+	parsed.Resolver = resolver
+	family, err := socks5.ParseAddressFamily(appConfig.DNS.AddressFamily)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse dns.address_family: %v", err)
+	}
+	parsed.AddressFamily = family
 
-	if appConfig.DefaultForwarder == nil {
-		return nil, fmt.Errorf("defaultForwarder must be specified in configuration file.")
+	defaults := &listenerDefaults{
+		BruteForce: appConfig.Auth.BruteForce,
+		Dialer:     &socks5.HappyEyeballsDialer{Family: family, Resolver: resolver},
 	}
-	defaultForwarder, err := NewForwarder(appConfig.DefaultForwarder)
+	defaults.Credentials, defaults.BruteForceGuard, err = NewAuth(&appConfig.Auth)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to parse defaultForwarder: %v", err)
+		return nil, err
+	}
+	if defaults.Credentials != nil {
+		parsed.credentials = append(parsed.credentials, defaults.Credentials)
+	}
+	if defaults.Rules, err = NewRules(appConfig.Rules, defaults.Dialer); err != nil {
+		return nil, err
+	}
+	if appConfig.DefaultForwarder != nil {
+		defaultForwarder, err := NewForwarder(appConfig.DefaultForwarder, defaults.Dialer)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse defaultForwarder: %v", err)
+		}
+		defaults.DefaultForwarder = &defaultForwarder
+	}
+	names := make(map[string]bool, len(listenerConfigs))
+	for i, lcfg := range listenerConfigs {
+		listener, err := NewListener(&lcfg, defaults)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse listener #%d: %v", i, err)
+		}
+		if listener.Credentials != nil && listener.Credentials != defaults.Credentials {
+			parsed.credentials = append(parsed.credentials, listener.Credentials)
+		}
+		if names[listener.Name] {
+			return nil, fmt.Errorf("Duplicate listener name: %s", listener.Name)
+		}
+		names[listener.Name] = true
+		parsed.Listeners = append(parsed.Listeners, *listener)
 	}
 
-	rules := make([]Rule, len(appConfig.Rules))
-	for i, rcfg := range appConfig.Rules {
-		rule, err := NewRule(&rcfg)
+	if len(appConfig.Rewrites) > 0 {
+		if parsed.Rewriter, err = NewRewriter(appConfig.Rewrites); err != nil {
+			return nil, err
+		}
+	}
+
+	if appConfig.AccessLog != nil {
+		if parsed.AccessLog, err = NewAccessLog(appConfig.AccessLog); err != nil {
+			return nil, fmt.Errorf("Unable to parse access_log: %v", err)
+		}
+	}
+
+	if appConfig.Tracing != nil {
+		if parsed.Tracing, parsed.TracerProvider, err = NewTracing(appConfig.Tracing); err != nil {
+			return nil, fmt.Errorf("Unable to parse tracing: %v", err)
+		}
+	}
+
+	return parsed, nil
+}
+
+// apply makes the process wide settings of the configuration effective
+func (c *Configuration) apply() {
+	log.SetLevel(c.Loglevel)
+	log.SetFormatter(c.LogFormatter)
+	if c.TracerProvider != nil {
+		otel.SetTracerProvider(c.TracerProvider)
+	}
+}
+
+// inherit carries state over from the configuration c replaces. Failures
+// tracked by brute-force guards are kept for listeners whose brute_force
+// settings didn't change. The previous access log hands over to the new
+// one, so connections still served with the previous configuration don't
+// keep a second writer on the same file.
+func (c *Configuration) inherit(previous *Configuration) {
+	if previous.AccessLog != nil && c.AccessLog != nil {
+		previous.AccessLog.handOver(c.AccessLog)
+	}
+	listeners := make(map[string]*Listener, len(previous.Listeners))
+	for i := range previous.Listeners {
+		listeners[previous.Listeners[i].Name] = &previous.Listeners[i]
+	}
+	inherited := make(map[*socks5.BruteForceGuard]bool)
+	for i := range c.Listeners {
+		l := &c.Listeners[i]
+		p, ok := listeners[l.Name]
+		if !ok || l.BruteForceGuard == nil || p.BruteForceGuard == nil || inherited[l.BruteForceGuard] {
+			continue
+		}
+		if reflect.DeepEqual(l.bruteForce, p.bruteForce) {
+			l.BruteForceGuard.Inherit(p.BruteForceGuard)
+			inherited[l.BruteForceGuard] = true
+		}
+	}
+}
+
+// Close releases the connections and files opened for the configuration
+func (c *Configuration) Close() {
+	for _, store := range c.credentials {
+		closeCredentials(store)
+	}
+	if c.AccessLog != nil {
+		c.AccessLog.Close()
+	}
+	shutdownTracing(c.TracerProvider)
+}
+
+// NewAuth sets up the credential store and brute-force protection
+func NewAuth(cfg *authConfig) (socks5.CredentialStore, *socks5.BruteForceGuard, error) {
+	credentials, err := NewCredentialStore(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var guard *socks5.BruteForceGuard
+	if credentials != nil && cfg.BruteForce != nil {
+		guard, err = NewBruteForceGuard(credentials, cfg.BruteForce)
+		if err != nil {
+			closeCredentials(credentials)
+			return nil, nil, fmt.Errorf("Unable to parse auth.brute_force: %v", err)
+		}
+	}
+	return credentials, guard, nil
+}
+
+// closeCredentials closes the connections of credential stores holding any
+func closeCredentials(store socks5.CredentialStore) {
+	if closer, ok := store.(interface{ Close() }); ok {
+		closer.Close()
+	}
+}
+
+func NewRules(cfgs []ruleConfig, dialer *socks5.HappyEyeballsDialer) ([]Rule, error) {
+	rules := make([]Rule, len(cfgs))
+	for i, rcfg := range cfgs {
+		rule, err := NewRule(&rcfg, dialer)
 		if err != nil {
 			return nil, fmt.Errorf("Unable to parse rule #%d: %v", i, err)
 		}
 		rules[i] = *rule
 	}
+	return rules, nil
+}
 
-	return &Configuration{
-		Bind:             appConfig.Bind,
-		Rules:            rules,
-		DefaultForwarder: &defaultForwarder,
-	}, nil
+func NewCredentialStore(cfg *authConfig) (socks5.CredentialStore, error) {
+	configured := 0
+	if cfg.UsersFile != "" {
+		configured++
+	}
+	if cfg.Webhook != nil {
+		configured++
+	}
+	if cfg.LDAP != nil {
+		configured++
+	}
+	if configured > 1 {
+		return nil, fmt.Errorf("Only one of auth.users_file, auth.webhook and auth.ldap may be specified.")
+	}
+
+	if cfg.UsersFile != "" {
+		store, err := socks5.NewFileCredentials(cfg.UsersFile, log)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load auth.users_file: %v", err)
+		}
+		return store, nil
+	}
+
+	if cfg.Webhook != nil {
+		var tlsConf *tls.Config
+		if cfg.Webhook.TLS != nil {
+			var err error
+			tlsConf, err = NewTLSClientConfig(cfg.Webhook.TLS)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to parse auth.webhook.tls: %v", err)
+			}
+		}
+		store, err := socks5.NewHTTPCredentials(&socks5.HTTPCredentialsConfig{
+			URL:              cfg.Webhook.URL,
+			Timeout:          cfg.Webhook.Timeout,
+			TLSConfig:        tlsConf,
+			CacheTTL:         cfg.Webhook.CacheTTL,
+			NegativeCacheTTL: cfg.Webhook.NegativeCacheTTL,
+			Logger:           log,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse auth.webhook: %v", err)
+		}
+		return store, nil
+	}
+
+	if cfg.LDAP != nil {
+		var tlsConf *tls.Config
+		if cfg.LDAP.TLS != nil {
+			var err error
+			tlsConf, err = NewTLSClientConfig(cfg.LDAP.TLS)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to parse auth.ldap.tls: %v", err)
+			}
+		}
+		store, err := socks5.NewLDAPCredentials(&socks5.LDAPCredentialsConfig{
+			URL:            cfg.LDAP.URL,
+			StartTLS:       cfg.LDAP.StartTLS,
+			TLSConfig:      tlsConf,
+			BindDN:         cfg.LDAP.BindDN,
+			BindPassword:   cfg.LDAP.BindPassword,
+			BaseDN:         cfg.LDAP.BaseDN,
+			UserFilter:     cfg.LDAP.UserFilter,
+			GroupAttribute: cfg.LDAP.GroupAttribute,
+			RequiredGroups: cfg.LDAP.RequiredGroups,
+			PoolSize:       cfg.LDAP.PoolSize,
+			Timeout:        cfg.LDAP.Timeout,
+			Logger:         log,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse auth.ldap: %v", err)
+		}
+		return store, nil
+	}
+
+	return nil, nil
+}
+
+func NewBruteForceGuard(credentials socks5.CredentialStore, cfg *bruteForceConfig) (*socks5.BruteForceGuard, error) {
+	trusted := make([]net.IPNet, len(cfg.TrustedNetworks))
+	for i, v := range cfg.TrustedNetworks {
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		trusted[i] = *ipNet
+	}
+
+	verifier, ok := credentials.(socks5.CredentialVerifier)
+	if !ok {
+		verifier = socks5.CredentialStoreVerifier{Store: credentials}
+	}
+
+	return socks5.NewBruteForceGuard(verifier, &socks5.BruteForceConfig{
+		MaxFailures:     cfg.MaxFailures,
+		Window:          cfg.Window,
+		Lockout:         cfg.Lockout,
+		BaseDelay:       cfg.BaseDelay,
+		MaxDelay:        cfg.MaxDelay,
+		TrustedNetworks: trusted,
+		Logger:          log,
+	}), nil
+}
+
+// ProxyProtocol holds the settings of PROXY protocol support
+type ProxyProtocol struct {
+	Trusted []net.IPNet
+	Timeout time.Duration
+}
+
+func NewProxyProtocol(cfg *proxyProtocolConfig) (*ProxyProtocol, error) {
+	if len(cfg.Trusted) == 0 {
+		return nil, fmt.Errorf("No trusted networks given")
+	}
+	trusted := make([]net.IPNet, len(cfg.Trusted))
+	for i, v := range cfg.Trusted {
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		trusted[i] = *ipNet
+	}
+	return &ProxyProtocol{Trusted: trusted, Timeout: cfg.Timeout}, nil
+}
+
+func NewTLSClientConfig(cfg *tlsConfig) (*tls.Config, error) {
+	tlsConf := &tls.Config{}
+	if cfg.CA != "" {
+		pem, err := ioutil.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", cfg.CA)
+		}
+		tlsConf.RootCAs = pool
+	}
+	if cfg.Cert != "" || cfg.Key != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConf, nil
 }
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fholzer/go-socks5/pkg/socks5"
+	"github.com/sirupsen/logrus"
+)
+
+// writeConfig writes a configuration file for ParseConfig
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return path
+}
+
+// testLogger replaces the logger for the duration of a test
+func testLogger(t *testing.T) {
+	previous := log
+	log = logrus.New()
+	log.Out = ioutil.Discard
+	t.Cleanup(func() { log = previous })
+}
+
+func TestParseConfig_Apply(t *testing.T) {
+	testLogger(t)
+	path := writeConfig(t, "loglevel: debug\nlogformat: json\ndefaultForwarder:\n  type: direct\n")
+
+	appConfig, err := ParseConfig(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer appConfig.Close()
+	if log.Level != logrus.InfoLevel {
+		t.Fatalf("expected parsing to leave the log level as is")
+	}
+	if _, ok := log.Formatter.(*logrus.JSONFormatter); ok {
+		t.Fatalf("expected parsing to leave the log format as is")
+	}
+
+	appConfig.apply()
+	if log.Level != logrus.DebugLevel {
+		t.Fatalf("expected log level to be applied")
+	}
+	if _, ok := log.Formatter.(*logrus.JSONFormatter); !ok {
+		t.Fatalf("expected log format to be applied")
+	}
+}
+
+func TestParseConfig_Invalid(t *testing.T) {
+	testLogger(t)
+	cases := []struct {
+		config string
+		err    string
+	}{
+		{"logformat: xml\ndefaultForwarder:\n  type: direct\n", "Unknown log format: xml"},
+		{"loglevel: loud\ndefaultForwarder:\n  type: direct\n", "Unable to parse loglevel"},
+		{"loglevel: debug\n", "defaultForwarder must be specified"},
+		// The access log opened before tracing turns out invalid is closed
+		{"loglevel: debug\naccess_log:\n  file: " + filepath.Join(t.TempDir(), "access.log") + "\n  rotate_every: 1h\n" +
+			"tracing:\n  insecure: true\ndefaultForwarder:\n  type: direct\n", "Unable to parse tracing"},
+	}
+	goroutines := runtime.NumGoroutine()
+	for _, c := range cases {
+		if _, err := ParseConfig(writeConfig(t, c.config)); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("expected %q, got %v", c.err, err)
+		}
+		if log.Level != logrus.InfoLevel {
+			t.Fatalf("expected log level to be left as is")
+		}
+	}
+	// Give the access log rotation a moment to stop
+	for i := 0; i < 100 && runtime.NumGoroutine() > goroutines; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Fatalf("expected opened resources to be closed, %d goroutines left over", n-goroutines)
+	}
+}
+
+func TestConfiguration_Inherit(t *testing.T) {
+	testLogger(t)
+	users := filepath.Join(t.TempDir(), "users.yml")
+	if err := ioutil.WriteFile(users, []byte("users: []\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	config := func(maxFailures string) string {
+		return "auth:\n  users_file: " + users + "\n  brute_force:\n    max_failures: " + maxFailures + "\n" +
+			"    base_delay: 1ms\n    max_delay: 1ms\n" +
+			"listeners:\n  - name: public\n    bind: 127.0.0.1:1080\n  - name: private\n    bind: 127.0.0.1:1081\n" +
+			"    auth:\n      users_file: " + users + "\n      brute_force:\n        max_failures: 2\n" +
+			"defaultForwarder:\n  type: direct\n"
+	}
+	parse := func(maxFailures string) *Configuration {
+		appConfig, err := ParseConfig(writeConfig(t, config(maxFailures)))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		t.Cleanup(appConfig.Close)
+		return appConfig
+	}
+	previous := parse("3")
+	ctx := socks5.WithClientAddr(context.Background(), &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000})
+	for _, l := range previous.Listeners {
+		for i := 0; i < 3; i++ {
+			l.BruteForceGuard.Verify(ctx, "foo", "wrong")
+		}
+	}
+
+	// Lockouts are kept as long as the settings are the same
+	next := parse("3")
+	next.inherit(previous)
+	for _, l := range next.Listeners {
+		if len(l.BruteForceGuard.Lockouts()) != 2 {
+			t.Fatalf("%s: expected lockouts to be kept", l.Name)
+		}
+	}
+
+	changed := parse("5")
+	changed.inherit(next)
+	if len(changed.Listeners[0].BruteForceGuard.Lockouts()) != 0 {
+		t.Fatalf("expected lockouts to be dropped with changed settings")
+	}
+	if len(changed.Listeners[1].BruteForceGuard.Lockouts()) != 2 {
+		t.Fatalf("expected lockouts of unchanged listener to be kept")
+	}
+}
@@ -9,18 +9,36 @@ import (
 )
 
 type LogFinalizer struct {
-	log *logrus.Logger
+	log       *logrus.Logger
+	accessLog *AccessLog
+	listener  string
 }
 
 func (l *LogFinalizer) Finalize(request *socks5.Request, conn net.Conn, ctx context.Context) error {
-	log.WithFields(logrus.Fields{
-		"client":         request.RemoteAddr,
-		"destination":    request.DestAddr,
+	resolver, _ := socks5.ResolverNameFromContext(ctx)
+	fields := logrus.Fields{
+		"listener":       l.listener,
+		"client":         request.ClientAddr,
+		"resolver":       resolver,
 		"matchingRuleId": ctx.Value("matchingRuleId"),
 		"proxyType":      ctx.Value("proxyType"),
 		"proxyAddress":   ctx.Value("proxyAddress"),
 		"requestBytes":   request.ReqByte,
 		"responseBytes":  request.RespByte,
-	}).Debug("Connection closed.")
+	}
+	// Failed logins and malformed requests have no destination
+	if request.DestAddr != nil {
+		fields["destination"] = request.DestAddr
+	}
+	if real := request.RealDestAddr(); real != nil && real != request.DestAddr {
+		fields["rewrittenDestination"] = real
+	}
+	if request.Err != nil {
+		fields["error"] = request.Err
+	}
+	log.WithFields(fields).Debug("Connection closed.")
+	if l.accessLog != nil {
+		l.accessLog.Log(l.listener, request, conn, ctx)
+	}
 	return nil
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fholzer/go-socks5/pkg/socks5"
+	"github.com/sirupsen/logrus"
+)
+
+func TestLogFinalizer(t *testing.T) {
+	var debug, access bytes.Buffer
+	defer func(l *logrus.Logger) { log = l }(log)
+	log = logrus.New()
+	log.Out = &debug
+	log.Level = logrus.DebugLevel
+	finalizer := &LogFinalizer{
+		log:       log,
+		accessLog: &AccessLog{format: formatLogfmt, out: &access},
+		listener:  "public",
+	}
+
+	// Failed logins have no destination
+	request := &socks5.Request{
+		ClientAddr:  &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000},
+		StartTime:   time.Now(),
+		AuthOutcome: socks5.AuthOutcomeInvalidCredentials,
+		Err:         errors.New("Failed to authenticate: User authentication failed"),
+	}
+	if err := finalizer.Finalize(request, nil, context.Background()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if strings.Contains(debug.String(), "destination=") || !strings.Contains(debug.String(), "User authentication failed") {
+		t.Fatalf("bad: %s", debug.String())
+	}
+	if !strings.Contains(access.String(), "auth=invalid_credentials") {
+		t.Fatalf("bad: %s", access.String())
+	}
+
+	debug.Reset()
+	request = &socks5.Request{
+		ClientAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000},
+		DestAddr:   &socks5.AddrSpec{FQDN: "example.com", Port: 443},
+		StartTime:  time.Now(),
+	}
+	if err := finalizer.Finalize(request, nil, context.Background()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !strings.Contains(debug.String(), "destination=\"example.com:443\"") || strings.Contains(debug.String(), "error=") {
+		t.Fatalf("bad: %s", debug.String())
+	}
+}
@@ -2,11 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 
+	"github.com/fholzer/go-socks5/pkg/socks5"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/net/proxy"
 )
 
 type Forwarder interface {
@@ -14,28 +15,88 @@ type Forwarder interface {
 	EnrichContext(ctx context.Context) context.Context
 }
 
-func NewForwarder(cfg *forwarderConfig) (Forwarder, error) {
+// NewForwarder creates the forwarder configured by cfg. Direct forwarders
+// connect using dialer.
+func NewForwarder(cfg *forwarderConfig, dialer *socks5.HappyEyeballsDialer) (Forwarder, error) {
+	var forwarder Forwarder
+	var err error
 	if cfg.Type == "direct" {
 		if cfg.Address != "" {
 			return nil, fmt.Errorf("TEST direct forwarder can't have address!")
 		}
-		return NewDirectForwarder()
+		forwarder, err = NewDirectForwarder(dialer)
 	} else if cfg.Type == "socks5" {
-		return NewSocks5Forwarder(cfg)
+		forwarder, err = NewSocks5Forwarder(cfg)
+	} else if cfg.Type == "unix" {
+		forwarder, err = NewUnixForwarder(cfg)
+	} else {
+		return nil, fmt.Errorf("Unknown forwarder type specified: %s", cfg.Type)
 	}
-	return nil, fmt.Errorf("Unknown forwarder type specified: %s", cfg.Type)
+	if err != nil || cfg.ProxyProtocol == nil {
+		return forwarder, err
+	}
+	return NewProxyProtocolForwarder(forwarder, cfg.ProxyProtocol)
+}
+
+// ProxyProtocolForwarder sends a PROXY protocol header on each connection
+// of another forwarder, conveying the client address to the destination
+type ProxyProtocolForwarder struct {
+	Forwarder
+	dialer *socks5.ProxyHeaderDialer
+}
+
+func NewProxyProtocolForwarder(forwarder Forwarder, cfg *forwarderProxyProtocolConfig) (*ProxyProtocolForwarder, error) {
+	version := cfg.Version
+	if version == 0 {
+		version = 1
+	}
+	if version != 1 && version != 2 {
+		return nil, fmt.Errorf("Unsupported proxy_protocol.version: %d", cfg.Version)
+	}
+	if cfg.UsernameTLV < 0 || cfg.UsernameTLV > 0xFF {
+		return nil, fmt.Errorf("Invalid proxy_protocol.username_tlv: %d", cfg.UsernameTLV)
+	}
+	if cfg.UsernameTLV != 0 && version != 2 {
+		return nil, fmt.Errorf("proxy_protocol.username_tlv requires version 2")
+	}
+	return &ProxyProtocolForwarder{
+		Forwarder: forwarder,
+		dialer: &socks5.ProxyHeaderDialer{
+			Dial:        forwarder.Forward,
+			Version:     version,
+			UsernameTLV: uint8(cfg.UsernameTLV),
+		},
+	}, nil
+}
+
+func (f *ProxyProtocolForwarder) Forward(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f.dialer.DialContext(ctx, network, addr)
 }
 
 type Socks5Forwarder struct {
 	address string
-	dialer  proxy.Dialer
+	client  *socks5.Client
 	log     *logrus.Entry
 }
 
 func NewSocks5Forwarder(cfg *forwarderConfig) (*Socks5Forwarder, error) {
-	dialer, err := proxy.SOCKS5("tcp", cfg.Address, nil, nil)
-	if err != nil {
-		return nil, err
+	client := &socks5.Client{Address: cfg.Address}
+	switch cfg.Network {
+	case "", "tcp":
+		if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+			return nil, err
+		}
+	case "unix":
+		// The proxy listens on the unix socket at address
+		if cfg.Address == "" {
+			return nil, fmt.Errorf("socks5 forwarder must have address!")
+		}
+		var dialer net.Dialer
+		client.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", addr)
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported network: %s", cfg.Network)
 	}
 
 	log := log.WithFields(logrus.Fields{
@@ -45,7 +106,7 @@ func NewSocks5Forwarder(cfg *forwarderConfig) (*Socks5Forwarder, error) {
 
 	return &Socks5Forwarder{
 		address: cfg.Address,
-		dialer:  dialer,
+		client:  client,
 		log:     log,
 	}, nil
 }
@@ -53,6 +114,8 @@ func NewSocks5Forwarder(cfg *forwarderConfig) (*Socks5Forwarder, error) {
 func (f *Socks5Forwarder) EnrichContext(ctx context.Context) context.Context {
 	ctx = context.WithValue(ctx, "proxyType", "socks5")
 	ctx = context.WithValue(ctx, "proxyAddress", f.address)
+	// Let the upstream proxy resolve names
+	ctx = socks5.WithRemoteResolution(ctx)
 	return ctx
 }
 
@@ -65,20 +128,32 @@ func (f *Socks5Forwarder) Forward(ctx context.Context, network, addr string) (ne
 		}).Debug("Forwarding connection via socks5 proxy")
 	}
 
-	return f.dialer.Dial(network, addr)
+	conn, err := f.client.DialContext(ctx, network, addr)
+	if err != nil {
+		// Pass on the upstream proxy's reply. Failing to talk to the
+		// proxy at all says nothing about the destination.
+		var replyErr *socks5.ReplyError
+		if !errors.As(err, &replyErr) {
+			err = &socks5.DialError{Reply: socks5.ReplyServerFailure, Err: err}
+		}
+		return nil, err
+	}
+	return conn, nil
 }
 
 type DirectForwarder struct {
-	log *logrus.Entry
+	dialer *socks5.HappyEyeballsDialer
+	log    *logrus.Entry
 }
 
-func NewDirectForwarder() (*DirectForwarder, error) {
+func NewDirectForwarder(dialer *socks5.HappyEyeballsDialer) (*DirectForwarder, error) {
 	log := log.WithFields(logrus.Fields{
 		"proxyType": "direct",
 	})
 
 	return &DirectForwarder{
-		log: log,
+		dialer: dialer,
+		log:    log,
 	}, nil
 }
 
@@ -96,5 +171,53 @@ func (f *DirectForwarder) Forward(ctx context.Context, network, addr string) (ne
 		}).Debug("Forwarding connection directly")
 	}
 
-	return net.Dial(network, addr)
+	return f.dialer.DialContext(ctx, network, addr)
+}
+
+// UnixForwarder connects all requests to the unix socket at address,
+// regardless of their destination
+type UnixForwarder struct {
+	address string
+	dialer  net.Dialer
+	log     *logrus.Entry
+}
+
+func NewUnixForwarder(cfg *forwarderConfig) (*UnixForwarder, error) {
+	if cfg.Address == "" {
+		return nil, fmt.Errorf("unix forwarder must have address!")
+	}
+
+	log := log.WithFields(logrus.Fields{
+		"proxyType":    "unix",
+		"proxyAddress": cfg.Address,
+	})
+
+	return &UnixForwarder{
+		address: cfg.Address,
+		log:     log,
+	}, nil
+}
+
+func (f *UnixForwarder) EnrichContext(ctx context.Context) context.Context {
+	ctx = context.WithValue(ctx, "proxyType", "unix")
+	ctx = context.WithValue(ctx, "proxyAddress", f.address)
+	// The destination isn't dialed, so don't bother resolving it
+	ctx = socks5.WithRemoteResolution(ctx)
+	return ctx
+}
+
+func (f *UnixForwarder) Forward(ctx context.Context, network, addr string) (net.Conn, error) {
+	if log.IsLevelEnabled(logrus.DebugLevel) {
+		f.log.WithFields(logrus.Fields{
+			"client":         ctx.Value("clientAddr"),
+			"destination":    addr,
+			"matchingRuleId": ctx.Value("matchingRuleId"),
+		}).Debug("Forwarding connection to unix socket")
+	}
+
+	conn, err := f.dialer.DialContext(ctx, "unix", f.address)
+	if err != nil {
+		return nil, &socks5.DialError{Reply: socks5.ReplyHostUnreachable, Err: err}
+	}
+	return conn, nil
 }
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/fholzer/go-socks5/pkg/socks5"
+)
+
+// Listener holds the settings of an address the proxy listens on
+type Listener struct {
+	Name             string
+	Network          string
+	Address          string
+	ProxyProtocol    *ProxyProtocol
+	TLS              *tls.Config
+	AllowedClients   []net.IPNet
+	Credentials      socks5.CredentialStore
+	BruteForceGuard  *socks5.BruteForceGuard
+	Rules            []Rule
+	DefaultForwarder *Forwarder
+
+	// bruteForce are the settings BruteForceGuard was created with
+	bruteForce *bruteForceConfig
+}
+
+// listenerDefaults are the top level settings, used by listeners not
+// configuring their own
+type listenerDefaults struct {
+	Credentials      socks5.CredentialStore
+	BruteForceGuard  *socks5.BruteForceGuard
+	BruteForce       *bruteForceConfig
+	Rules            []Rule
+	DefaultForwarder *Forwarder
+	// Dialer is used by direct forwarders
+	Dialer *socks5.HappyEyeballsDialer
+}
+
+func NewListener(cfg *listenerConfig, defaults *listenerDefaults) (_ *Listener, err error) {
+	l := &Listener{
+		Name:    cfg.Name,
+		Network: cfg.Network,
+		Address: cfg.Bind,
+	}
+	if l.Network == "" {
+		l.Network = "tcp"
+	}
+	switch l.Network {
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		return nil, fmt.Errorf("Unsupported network: %s", l.Network)
+	}
+	if l.Address == "" {
+		return nil, fmt.Errorf("bind must be specified")
+	}
+	if l.Name == "" {
+		l.Name = l.Address
+	}
+
+	if len(cfg.AllowedClients) > 0 && l.Network == "unix" {
+		return nil, fmt.Errorf("allowed_clients can't be used with unix sockets")
+	}
+	for _, v := range cfg.AllowedClients {
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse allowed_clients: %v", err)
+		}
+		l.AllowedClients = append(l.AllowedClients, *ipNet)
+	}
+
+	if cfg.ProxyProtocol != nil {
+		if l.Network == "unix" {
+			return nil, fmt.Errorf("proxy_protocol can't be used with unix sockets")
+		}
+		proxyProtocol, err := NewProxyProtocol(cfg.ProxyProtocol)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse proxy_protocol: %v", err)
+		}
+		l.ProxyProtocol = proxyProtocol
+	}
+
+	if cfg.TLS != nil {
+		tlsConf, err := NewTLSServerConfig(cfg.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse tls: %v", err)
+		}
+		l.TLS = tlsConf
+	}
+
+	// An empty auth section disables authentication
+	l.Credentials, l.BruteForceGuard, l.bruteForce = defaults.Credentials, defaults.BruteForceGuard, defaults.BruteForce
+	if cfg.Auth != nil {
+		l.bruteForce = cfg.Auth.BruteForce
+		if l.Credentials, l.BruteForceGuard, err = NewAuth(cfg.Auth); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				closeCredentials(l.Credentials)
+			}
+		}()
+	}
+
+	l.Rules = defaults.Rules
+	if cfg.Rules != nil {
+		var err error
+		if l.Rules, err = NewRules(cfg.Rules, defaults.Dialer); err != nil {
+			return nil, err
+		}
+	}
+
+	l.DefaultForwarder = defaults.DefaultForwarder
+	if cfg.DefaultForwarder != nil {
+		forwarder, err := NewForwarder(cfg.DefaultForwarder, defaults.Dialer)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse defaultForwarder: %v", err)
+		}
+		l.DefaultForwarder = &forwarder
+	}
+	if l.DefaultForwarder == nil {
+		return nil, fmt.Errorf("defaultForwarder must be specified in configuration file.")
+	}
+
+	return l, nil
+}
+
+// Listen opens the listening socket. Use Wrap to add PROXY protocol and TLS
+// support.
+func (l *Listener) Listen() (net.Listener, error) {
+	if l.Network == "unix" {
+		// Remove a socket left over by a previous run
+		if fi, err := os.Stat(l.Address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(l.Address)
+		}
+	}
+	return net.Listen(l.Network, l.Address)
+}
+
+// Wrap stacks PROXY protocol and TLS support on an open listening socket as
+// configured
+func (l *Listener) Wrap(listener net.Listener) net.Listener {
+	if l.ProxyProtocol != nil {
+		listener = &socks5.ProxyProtocolListener{
+			Listener: listener,
+			Trusted:  l.ProxyProtocol.Trusted,
+			Timeout:  l.ProxyProtocol.Timeout,
+		}
+	}
+	if l.TLS != nil {
+		listener = tls.NewListener(listener, l.TLS)
+	}
+	return listener
+}
+
+func (l *Listener) allowed(addr net.Addr) bool {
+	if len(l.AllowedClients) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range l.AllowedClients {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewTLSServerConfig loads the server certificate. If a CA is given,
+// clients must present a certificate issued by it.
+func NewTLSServerConfig(cfg *tlsConfig) (*tls.Config, error) {
+	if cfg.Cert == "" || cfg.Key == "" {
+		return nil, fmt.Errorf("cert and key must be specified")
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+	if err != nil {
+		return nil, err
+	}
+	tlsConf := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if cfg.CA != "" {
+		pem, err := ioutil.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", cfg.CA)
+		}
+		tlsConf.ClientCAs = pool
+		tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConf, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/fholzer/go-socks5/pkg/socks5"
+)
+
+func TestNewListener(t *testing.T) {
+	testLogger(t)
+	users := filepath.Join(t.TempDir(), "users.yml")
+	if err := ioutil.WriteFile(users, []byte("users: []\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	dialer := &socks5.HappyEyeballsDialer{}
+	defaults := &listenerDefaults{
+		BruteForce: &bruteForceConfig{},
+		Dialer:     dialer,
+	}
+	var err error
+	defaults.Credentials, defaults.BruteForceGuard, err = NewAuth(&authConfig{UsersFile: users, BruteForce: defaults.BruteForce})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if defaults.Rules, err = NewRules([]ruleConfig{{Domains: []string{"corp.internal"}, Forwarder: forwarderConfig{Type: "direct"}}}, dialer); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	forwarder, err := NewForwarder(&forwarderConfig{Type: "direct"}, dialer)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defaults.DefaultForwarder = &forwarder
+
+	cases := []struct {
+		name   string
+		config listenerConfig
+		// credentials is one of default, own and none
+		credentials string
+		rules       int
+		forwarder   string
+		allowed     []string
+		denied      []string
+	}{
+		{
+			name:        "defaults",
+			config:      listenerConfig{Bind: "127.0.0.1:1080"},
+			credentials: "default",
+			rules:       1,
+			forwarder:   "",
+			allowed:     []string{"192.0.2.1", "2001:db8::1"},
+		},
+		{
+			name: "overrides",
+			config: listenerConfig{
+				Bind: "127.0.0.1:1080",
+				Auth: &authConfig{UsersFile: users},
+				Rules: []ruleConfig{
+					{Subnets: []string{"10.0.0.0/8"}, Forwarder: forwarderConfig{Type: "direct"}},
+					{Domains: []string{"example.com"}, Forwarder: forwarderConfig{Type: "direct"}},
+				},
+				DefaultForwarder: &forwarderConfig{Type: "socks5", Address: "127.0.0.1:5050"},
+			},
+			credentials: "own",
+			rules:       2,
+			forwarder:   "127.0.0.1:5050",
+		},
+		{
+			name:        "auth disabled",
+			config:      listenerConfig{Bind: "127.0.0.1:1080", Auth: &authConfig{}},
+			credentials: "none",
+			rules:       1,
+			forwarder:   "",
+		},
+		{
+			name:        "allowed clients",
+			config:      listenerConfig{Bind: "127.0.0.1:1080", AllowedClients: []string{"192.0.2.0/24", "2001:db8::/32"}},
+			credentials: "default",
+			rules:       1,
+			forwarder:   "",
+			allowed:     []string{"192.0.2.1", "2001:db8::1"},
+			denied:      []string{"198.51.100.1", "::1"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			l, err := NewListener(&c.config, defaults)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			switch c.credentials {
+			case "default":
+				if l.Credentials != defaults.Credentials || l.BruteForceGuard != defaults.BruteForceGuard {
+					t.Fatalf("expected top level auth to be used")
+				}
+			case "own":
+				if l.Credentials == nil || l.Credentials == defaults.Credentials || l.BruteForceGuard != nil {
+					t.Fatalf("expected listener auth to be used")
+				}
+			case "none":
+				if l.Credentials != nil || l.BruteForceGuard != nil {
+					t.Fatalf("expected authentication to be disabled")
+				}
+			}
+			if len(l.Rules) != c.rules {
+				t.Fatalf("expected %d rules, got %d", c.rules, len(l.Rules))
+			}
+			// Direct forwarders have no address
+			address := ""
+			if s, ok := (*l.DefaultForwarder).(*Socks5Forwarder); ok {
+				address = s.address
+			}
+			if address != c.forwarder {
+				t.Fatalf("expected forwarder %q, got %q", c.forwarder, address)
+			}
+			for _, ip := range c.allowed {
+				if !l.allowed(&net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}) {
+					t.Fatalf("expected %s to be allowed", ip)
+				}
+			}
+			for _, ip := range c.denied {
+				if l.allowed(&net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}) {
+					t.Fatalf("expected %s to be rejected", ip)
+				}
+			}
+		})
+	}
+}
+
+func TestParseConfig_ListenerAuthDisabled(t *testing.T) {
+	testLogger(t)
+	users := filepath.Join(t.TempDir(), "users.yml")
+	if err := ioutil.WriteFile(users, []byte("users: []\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	appConfig, err := ParseConfig(writeConfig(t, "auth:\n  users_file: "+users+"\n"+
+		"listeners:\n  - name: public\n    bind: 127.0.0.1:1080\n  - name: local\n    bind: 127.0.0.1:1081\n    auth: {}\n"+
+		"defaultForwarder:\n  type: direct\n"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer appConfig.Close()
+	if appConfig.Listeners[0].Credentials == nil {
+		t.Fatalf("expected top level auth to be used")
+	}
+	if appConfig.Listeners[1].Credentials != nil {
+		t.Fatalf("expected authentication to be disabled")
+	}
+}
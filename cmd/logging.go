@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	stdlog "log"
 	"os"
 
@@ -31,3 +32,17 @@ func setupLogging() {
 	//defer w.Close()
 	stdlog.SetOutput(w)
 }
+
+// parseLogFormat returns the formatter of a logformat setting
+func parseLogFormat(format string) (logrus.Formatter, error) {
+	switch format {
+	case "text":
+		return &logrus.TextFormatter{
+			ForceColors:   true,
+			FullTimestamp: true,
+		}, nil
+	case "json":
+		return &logrus.JSONFormatter{}, nil
+	}
+	return nil, fmt.Errorf("Unknown log format: %s", format)
+}
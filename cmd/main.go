@@ -1,7 +1,14 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/fholzer/go-socks5/pkg/socks5"
 )
@@ -13,44 +20,329 @@ func printVersionInfo() {
 	versionInfo.Print(w)
 }
 
-func createSocks5Server(appConfig *Configuration) (*socks5.Server, error) {
+func createSocks5Server(appConfig *Configuration, listener *Listener) (*socks5.Server, error) {
 	// Create a SOCKS5 server
 	conf := &socks5.Config{
 		Picker: &Picker{
-			rules:            appConfig.Rules,
-			defaultForwarder: *appConfig.DefaultForwarder,
+			rules:            listener.Rules,
+			defaultForwarder: *listener.DefaultForwarder,
 		},
-		Logger:    log,
-		Finalizer: &LogFinalizer{},
+		Credentials:   listener.Credentials,
+		Resolver:      appConfig.Resolver,
+		LazyResolve:   true,
+		AddressFamily: appConfig.AddressFamily,
+		Rewriter:      appConfig.Rewriter,
+		BufferSize:    appConfig.BufferSize,
+		RelayLinger:   appConfig.RelayLinger,
+		Logger:        log,
+		Finalizer:     &LogFinalizer{accessLog: appConfig.AccessLog, listener: listener.Name},
+	}
+	if appConfig.Tracing != nil {
+		conf.Observers = append(conf.Observers, appConfig.Tracing)
+	}
+	if listener.BruteForceGuard != nil {
+		conf.AuthMethods = []socks5.Authenticator{
+			socks5.UserPassAuthenticator{Verifier: listener.BruteForceGuard},
+		}
 	}
 	return socks5.New(conf)
 }
 
+// service is what a listener's connections are served with
+type service struct {
+	listener *Listener
+	server   *socks5.Server
+	// config holds the resources used by server
+	config *Configuration
+}
+
+var (
+	// services maps listener names to their *service. It is replaced as a
+	// whole when the configuration is reloaded.
+	services   map[string]*service
+	servicesMu sync.Mutex
+)
+
+// acquireService returns the current service of the listener called name,
+// counting a connection served with it until it's released
+func acquireService(name string) *service {
+	servicesMu.Lock()
+	defer servicesMu.Unlock()
+	svc := services[name]
+	svc.config.conns++
+	return svc
+}
+
+// release counts a connection served with svc as finished. The last
+// connection of a replaced configuration closes it.
+func (svc *service) release() {
+	servicesMu.Lock()
+	svc.config.conns--
+	done := svc.config.replaced && svc.config.conns == 0
+	servicesMu.Unlock()
+	if done {
+		svc.config.Close()
+	}
+}
+
+// replaceServices serves new connections using svcs. Configurations no
+// longer used by any service are closed once their connections finished.
+func replaceServices(svcs map[string]*service) {
+	used := make(map[*Configuration]bool)
+	for _, svc := range svcs {
+		used[svc.config] = true
+	}
+	var done []*Configuration
+	servicesMu.Lock()
+	for _, svc := range services {
+		if c := svc.config; !used[c] && !c.replaced {
+			c.replaced = true
+			if c.conns == 0 {
+				done = append(done, c)
+			}
+		}
+	}
+	services = svcs
+	servicesMu.Unlock()
+	for _, c := range done {
+		go c.Close()
+	}
+}
+
+// accepting tracks the accept loops, and active the connections being
+// served, to drain them on shutdown
+var accepting, active sync.WaitGroup
+
+func createServices(appConfig *Configuration) (map[string]*service, error) {
+	svcs := make(map[string]*service, len(appConfig.Listeners))
+	for i := range appConfig.Listeners {
+		listener := &appConfig.Listeners[i]
+		server, err := createSocks5Server(appConfig, listener)
+		if err != nil {
+			return nil, err
+		}
+		svcs[listener.Name] = &service{listener: listener, server: server, config: appConfig}
+	}
+	return svcs, nil
+}
+
+// serve accepts connections on l, and serves those of allowed clients
+// using the current settings of the listener called name. It returns nil
+// once l is closed.
+func serve(name string, l net.Listener) error {
+	log := log.WithField("listener", name)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		svc := acquireService(name)
+		active.Add(1)
+		go func() {
+			defer active.Done()
+			defer svc.release()
+			// The client address may only be known once a PROXY header
+			// was read, so it's checked here rather than in Accept
+			if !svc.listener.allowed(conn.RemoteAddr()) {
+				log.WithField("client", conn.RemoteAddr()).Warn("Connection from client not allowed.")
+				conn.Close()
+				return
+			}
+			svc.server.ServeConn(conn)
+		}()
+	}
+}
+
+// listen opens the sockets of listener, preferring those passed by systemd
+// or a previous process under its name
+func listen(listener *Listener, activated map[string][]net.Listener) ([]net.Listener, error) {
+	if inherited, ok := activated[listener.Name]; ok {
+		delete(activated, listener.Name)
+		return inherited, nil
+	}
+	l, err := listener.Listen()
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{l}, nil
+}
+
+// reload parses the configuration file again, and serves new connections
+// using its settings. Listeners can't be added, removed or rebound this
+// way, so the addresses, TLS and PROXY protocol settings of running
+// listeners are kept. The previous configuration is closed once the
+// connections served with it finished.
+func reload(appConfig *Configuration) (*Configuration, error) {
+	newConfig, err := ParseConfig(configFileName)
+	if err != nil {
+		return nil, err
+	}
+	svcs, err := createServices(newConfig)
+	if err != nil {
+		newConfig.Close()
+		return nil, err
+	}
+	// Only the main goroutine replaces services
+	current := services
+	for name := range svcs {
+		if _, ok := current[name]; !ok {
+			log.Warnf("Listener %s was added. Restart to start it.", name)
+			delete(svcs, name)
+		}
+	}
+	used := false
+	for name, svc := range current {
+		if _, ok := svcs[name]; !ok {
+			log.Warnf("Listener %s was removed. Restart to stop it.", name)
+			svcs[name] = svc
+		} else {
+			used = true
+		}
+	}
+	if !used {
+		newConfig.Close()
+		return nil, fmt.Errorf("None of the configured listeners is running. Restart to start them.")
+	}
+
+	newConfig.inherit(appConfig)
+	replaceServices(svcs)
+	newConfig.apply()
+	return newConfig, nil
+}
+
 func main() {
 	setupLogging()
 	printVersionInfo()
 
+	// Take over the sockets passed by systemd before opening any files
+	activated, err := ActivatedListeners()
+	if err != nil {
+		log.Fatalf("Error using sockets passed by systemd. %v", err)
+	}
+
+	notifier, err := NewNotifier()
+	if err != nil {
+		log.Warn(err)
+	}
+
 	appConfig, err := ParseConfig(configFileName)
 	if err != nil {
 		log.Fatalf("Error loading configuration file. %v", err)
 	}
-
-	server, err := createSocks5Server(appConfig)
+	appConfig.apply()
+	svcs, err := createServices(appConfig)
 	if err != nil {
 		log.Panic(err)
 	}
+	replaceServices(svcs)
+
+	// Serve all listeners, giving up on the first failing
+	var sockets []socket
+	errCh := make(chan error, len(appConfig.Listeners))
+	for i := range appConfig.Listeners {
+		listener := &appConfig.Listeners[i]
+		ls, err := listen(listener, activated)
+		if err != nil {
+			log.Fatalf("Error binding to %s. %v", listener.Address, err)
+		}
+		log.WithField("listener", listener.Name).Info("Server running and waiting for connections...")
+		for _, l := range ls {
+			sockets = append(sockets, socket{Listener: l, name: listener.Name})
+			accepting.Add(1)
+			go func(l net.Listener) {
+				defer accepting.Done()
+				if err := serve(listener.Name, l); err != nil {
+					errCh <- err
+				}
+			}(listener.Wrap(l))
+		}
+	}
+	for name, ls := range activated {
+		log.Warnf("No listener named %s configured, closing the socket passed by systemd.", name)
+		for _, l := range ls {
+			l.Close()
+		}
+	}
+
+	status := fmt.Sprintf("Serving %d listeners", len(appConfig.Listeners))
+	notifier.Ready(status)
+	go notifier.Watchdog(nil)
+	upgradeReady()
 
-	// Create SOCKS5 proxy on localhost port 8000
-	if err := ListenAndServe(server, "tcp", appConfig.Bind); err != nil {
-		log.Fatal(err)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	if upgradeSignal != nil {
+		signal.Notify(signals, upgradeSignal)
+	}
+	for {
+		select {
+		case err := <-errCh:
+			notifier.Stopping()
+			log.Fatal(err)
+		case sig := <-signals:
+			switch sig {
+			case syscall.SIGHUP:
+				log.Info("Reloading configuration.")
+				notifier.Reloading()
+				if newConfig, err := reload(appConfig); err != nil {
+					log.Errorf("Error reloading configuration file, keeping the previous one. %v", err)
+				} else {
+					appConfig = newConfig
+				}
+				notifier.Ready(status)
+				continue
+			case upgradeSignal:
+				log.Info("Upgrading, starting new process.")
+				notifier.Reloading()
+				process, err := Upgrade(sockets, notifier)
+				if err != nil {
+					log.Errorf("Error upgrading, continuing to serve. %v", err)
+					notifier.Ready(status)
+					continue
+				}
+				log.Infof("New process %d is serving.", process.Pid)
+				notifier.Notify(fmt.Sprintf("MAINPID=%d", process.Pid), "READY=1")
+				for _, s := range sockets {
+					keepSocketFile(s.Listener)
+				}
+			default:
+				log.Infof("Received %v, shutting down.", sig)
+				notifier.Stopping()
+			}
+			shutdown(sockets, appConfig)
+			os.Exit(0)
+		}
 	}
 }
 
-func ListenAndServe(s *socks5.Server, network, addr string) error {
-	l, err := net.Listen(network, addr)
-	if err != nil {
-		log.Fatalf("Error binding to %s. %v", addr, err)
+// shutdown stops accepting connections, and waits for those being served
+// to finish, for at most the configured shutdown timeout
+func shutdown(sockets []socket, appConfig *Configuration) {
+	for _, s := range sockets {
+		s.Close()
+	}
+	done := make(chan struct{})
+	go func() {
+		accepting.Wait()
+		active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(appConfig.ShutdownTimeout):
+		log.Warnf("Connections still active after %v, closing them.", appConfig.ShutdownTimeout)
+	}
+
+	configs := make(map[*Configuration]bool)
+	servicesMu.Lock()
+	for _, svc := range services {
+		configs[svc.config] = true
+	}
+	servicesMu.Unlock()
+	for c := range configs {
+		c.Close()
 	}
-	log.Info("Server running and waiting for connections...")
-	return s.Serve(l)
 }
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fholzer/go-socks5/pkg/socks5"
+)
+
+// closingStore counts how often it was closed
+type closingStore struct {
+	closed int32
+}
+
+func (s *closingStore) Valid(user, password string) bool { return false }
+func (s *closingStore) Close()                           { atomic.AddInt32(&s.closed, 1) }
+
+func TestReplaceServices(t *testing.T) {
+	testLogger(t)
+	t.Cleanup(func() { services = nil })
+	previousStore, nextStore := &closingStore{}, &closingStore{}
+	previous := &Configuration{credentials: []socks5.CredentialStore{previousStore}}
+	next := &Configuration{credentials: []socks5.CredentialStore{nextStore}}
+
+	replaceServices(map[string]*service{"public": {config: previous}, "private": {config: previous}})
+	svc := acquireService("public")
+
+	// The previous configuration is closed with its last connection
+	replaceServices(map[string]*service{"public": {config: next}, "private": {config: previous}})
+	replaceServices(map[string]*service{"public": {config: next}})
+	if current := acquireService("public"); current.config != next {
+		t.Fatalf("expected new connections to be served with the new configuration")
+	} else {
+		current.release()
+	}
+	if atomic.LoadInt32(&previousStore.closed) != 0 {
+		t.Fatalf("expected configuration to be kept while serving connections")
+	}
+	svc.release()
+	if atomic.LoadInt32(&previousStore.closed) != 1 {
+		t.Fatalf("expected configuration to be closed once")
+	}
+
+	// Without connections, it's closed right away
+	replaceServices(map[string]*service{"public": {config: &Configuration{}}})
+	for i := 0; i < 100 && atomic.LoadInt32(&nextStore.closed) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if atomic.LoadInt32(&nextStore.closed) != 1 {
+		t.Fatalf("expected configuration to be closed")
+	}
+}
@@ -17,16 +17,17 @@ func (p *Picker) Pick(req *socks5.Request, ctx context.Context) (context.Context
 	var logentry *logrus.Entry
 	if log.IsLevelEnabled(logrus.TraceLevel) {
 		logentry = log.WithFields(logrus.Fields{
-			"client":      req.RemoteAddr,
+			"client":      req.ClientAddr,
 			"destination": req.DestAddr,
 		})
 		logentry.Trace("Starting rule processing.")
 	}
 
-	ctx = context.WithValue(ctx, "clientAddr", req.RemoteAddr)
+	ctx = context.WithValue(ctx, "clientAddr", req.ClientAddr)
 
 	for i, rule := range p.rules {
-		if rule.Match(req.DestAddr.IP) {
+		var matches bool
+		if ctx, matches = rule.Match(ctx, req); matches {
 			if logentry != nil {
 				logentry.WithField("matchingRuleId", i).Tracef("Rule %d matches.", i)
 			}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fholzer/go-socks5/pkg/socks5"
+)
+
+func NewResolver(cfg *dnsConfig) (socks5.NameResolver, error) {
+	resolver, err := newUpstreamResolver(cfg.Servers, cfg.Timeout, cfg.Retries, cfg.TLS, cfg.Cache)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Hosts) == 0 && cfg.HostsFile == "" && len(cfg.Routes) == 0 {
+		return resolver, nil
+	}
+
+	hosts, err := newHosts(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := make([]socks5.ResolverRoute, len(cfg.Routes))
+	for i, rcfg := range cfg.Routes {
+		if len(rcfg.Servers) == 0 {
+			return nil, fmt.Errorf("Unable to parse route #%d: no servers given", i)
+		}
+		// Routes are cached just like the default resolver
+		upstream, err := newUpstreamResolver(rcfg.Servers, rcfg.Timeout, rcfg.Retries, rcfg.TLS, cfg.Cache)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse route #%d: %v", i, err)
+		}
+		routes[i] = socks5.ResolverRoute{
+			Name:     rcfg.Name,
+			Suffixes: rcfg.Suffixes,
+			Resolver: upstream,
+		}
+	}
+
+	return socks5.NewRoutingResolver(&socks5.RoutingResolverConfig{
+		Hosts:   hosts,
+		Routes:  routes,
+		Default: resolver,
+	})
+}
+
+// newUpstreamResolver returns the system resolver if no servers are given,
+// optionally wrapped in a cache
+func newUpstreamResolver(servers []string, timeout time.Duration, retries int, tlsCfg *tlsConfig, cache *dnsCacheConfig) (socks5.NameResolver, error) {
+	var resolver socks5.NameResolver = socks5.DNSResolver{}
+
+	if len(servers) > 0 {
+		var tlsConf *tls.Config
+		if tlsCfg != nil {
+			var err error
+			tlsConf, err = NewTLSClientConfig(tlsCfg)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to parse tls: %v", err)
+			}
+		}
+		upstream, err := socks5.NewUpstreamResolver(&socks5.UpstreamResolverConfig{
+			Servers:   servers,
+			Timeout:   timeout,
+			Retries:   retries,
+			TLSConfig: tlsConf,
+		})
+		if err != nil {
+			return nil, err
+		}
+		resolver = upstream
+	}
+
+	if cache != nil {
+		resolver = socks5.NewCachingResolver(&socks5.CachingResolverConfig{
+			Resolver:    resolver,
+			DefaultTTL:  cache.DefaultTTL,
+			MinTTL:      cache.MinTTL,
+			MaxTTL:      cache.MaxTTL,
+			NegativeTTL: cache.NegativeTTL,
+			MaxEntries:  cache.MaxEntries,
+		})
+	}
+
+	return resolver, nil
+}
+
+// newHosts merges the hosts file and the inline hosts. Inline hosts replace
+// entries of the same name read from the file.
+func newHosts(cfg *dnsConfig) (map[string][]net.IP, error) {
+	hosts := make(map[string][]net.IP)
+	if cfg.HostsFile != "" {
+		f, err := os.Open(cfg.HostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read hosts_file: %v", err)
+		}
+		defer f.Close()
+		hosts, err = socks5.ParseHosts(f)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse hosts_file: %v", err)
+		}
+	}
+
+	for i, hcfg := range cfg.Hosts {
+		if hcfg.Name == "" {
+			return nil, fmt.Errorf("Unable to parse host #%d: no name given", i)
+		}
+		ips := make([]net.IP, len(hcfg.Addresses))
+		for j, addr := range hcfg.Addresses {
+			ips[j] = net.ParseIP(addr)
+			if ips[j] == nil {
+				return nil, fmt.Errorf("Unable to parse host #%d: invalid address %s", i, addr)
+			}
+		}
+		hosts[strings.ToLower(strings.TrimSuffix(hcfg.Name, "."))] = ips
+	}
+	return hosts, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/fholzer/go-socks5/pkg/socks5"
+)
+
+func NewRewriter(cfgs []rewriteConfig) (*socks5.RuleRewriter, error) {
+	rules := make([]socks5.RewriteRule, len(cfgs))
+	for i, cfg := range cfgs {
+		rule, err := newRewriteRule(&cfg)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse rewrite #%d: %v", i, err)
+		}
+		rules[i] = *rule
+	}
+	return socks5.NewRuleRewriter(rules)
+}
+
+func newRewriteRule(cfg *rewriteConfig) (*socks5.RewriteRule, error) {
+	rule := &socks5.RewriteRule{
+		Domains:  cfg.Domains,
+		Networks: make([]net.IPNet, len(cfg.Subnets)),
+		Ports:    make([]socks5.PortRange, len(cfg.Ports)),
+	}
+
+	for i, v := range cfg.Subnets {
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		rule.Networks[i] = *ipNet
+	}
+
+	for i, v := range cfg.Ports {
+		ports, err := socks5.ParsePortRange(v)
+		if err != nil {
+			return nil, err
+		}
+		rule.Ports[i] = ports
+	}
+
+	// to is given as host, host:port, :port, or with a port range
+	// instead of a single port
+	if cfg.To == "" {
+		return nil, fmt.Errorf("No target given")
+	}
+	host, port := cfg.To, ""
+	if net.ParseIP(cfg.To) == nil && strings.Contains(cfg.To, ":") {
+		var err error
+		host, port, err = net.SplitHostPort(cfg.To)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rule.Host = host
+	if port != "" {
+		ports, err := socks5.ParsePortRange(port)
+		if err != nil {
+			return nil, err
+		}
+		rule.Port = ports
+	}
+	return rule, nil
+}
@@ -3,14 +3,18 @@ package main
 import (
 	"context"
 	"net"
+	"strings"
+
+	"github.com/fholzer/go-socks5/pkg/socks5"
 )
 
 type Rule struct {
+	domains   []string
 	subnets   []net.IPNet
 	forwarder Forwarder
 }
 
-func NewRule(rcfg *ruleConfig) (*Rule, error) {
+func NewRule(rcfg *ruleConfig, dialer *socks5.HappyEyeballsDialer) (*Rule, error) {
 	// create CIDR array
 	subnets := make([]net.IPNet, len(rcfg.Subnets))
 
@@ -23,19 +27,48 @@ func NewRule(rcfg *ruleConfig) (*Rule, error) {
 		subnets[i] = *ipNet
 	}
 
-	forwarder, err := NewForwarder(&rcfg.Forwarder)
+	forwarder, err := NewForwarder(&rcfg.Forwarder, dialer)
 	if err != nil {
 		return nil, err
 	}
 
+	domains := make([]string, len(rcfg.Domains))
+	for i, v := range rcfg.Domains {
+		domains[i] = strings.ToLower(strings.TrimSuffix(v, "."))
+	}
+
 	rule := &Rule{
+		domains:   domains,
 		subnets:   subnets,
 		forwarder: forwarder,
 	}
 	return rule, nil
 }
 
-func (r *Rule) Match(ip net.IP) bool {
+// Match checks the destination's name against the rule's domains first.
+// The destination is only resolved if that doesn't match and the rule has
+// subnets.
+func (r *Rule) Match(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if name := req.DestAddr.FQDN; name != "" {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		for _, domain := range r.domains {
+			if name == domain || strings.HasSuffix(name, "."+domain) {
+				return ctx, true
+			}
+		}
+	}
+
+	if len(r.subnets) == 0 {
+		return ctx, false
+	}
+	ctx, err := req.ResolveDestination(ctx)
+	if err != nil {
+		return ctx, false
+	}
+	return ctx, r.matchIP(req.DestAddr.IP)
+}
+
+func (r *Rule) matchIP(ip net.IP) bool {
 	for _, subnet := range r.subnets {
 		if subnet.Contains(ip) {
 			return true
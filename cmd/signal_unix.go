@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignal starts a binary upgrade, see Upgrade
+var upgradeSignal os.Signal = syscall.SIGUSR2
@@ -0,0 +1,8 @@
+package main
+
+import (
+	"os"
+)
+
+// upgradeSignal is nil, as binary upgrades aren't supported on Windows
+var upgradeSignal os.Signal
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd
+const listenFDsStart = 3
+
+// ActivatedListeners returns the listening sockets passed by systemd socket
+// activation (LISTEN_FDS), keyed by their name as set by FileDescriptorName=
+// in the socket unit. Sockets without a name are keyed by "unknown", like
+// systemd does. The environment variables are cleared, so they aren't
+// inherited by child processes.
+func ActivatedListeners() (map[string][]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	// LISTEN_PID may be left out by processes handing over their sockets
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count := os.Getenv("LISTEN_FDS")
+	if count == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("Invalid LISTEN_FDS: %s", count)
+	}
+	var names []string
+	if fdnames := os.Getenv("LISTEN_FDNAMES"); fdnames != "" {
+		names = strings.Split(fdnames, ":")
+	}
+
+	listeners := make(map[string][]net.Listener)
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		// FileListener duplicates the descriptor, marking it close-on-exec
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to use socket %s (fd %d): %v", name, listenFDsStart+i, err)
+		}
+		listeners[name] = append(listeners[name], l)
+	}
+	return listeners, nil
+}
+
+// Notifier sends state changes to the service manager using the
+// sd_notify protocol. A nil Notifier, returned if the service isn't run by
+// systemd with Type=notify, ignores all notifications.
+type Notifier struct {
+	conn     net.Conn
+	watchdog time.Duration
+	// Environment passing the notification socket on to a new process
+	env []string
+}
+
+// NewNotifier connects to the socket given by NOTIFY_SOCKET. The watchdog
+// interval is taken from WATCHDOG_USEC, if meant for this process.
+func NewNotifier() (*Notifier, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil, nil
+	}
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	if strings.HasPrefix(path, "@") {
+		// Abstract namespace socket
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to NOTIFY_SOCKET: %v", err)
+	}
+	n := &Notifier{conn: conn, env: []string{"NOTIFY_SOCKET=" + os.Getenv("NOTIFY_SOCKET")}}
+
+	pid := os.Getenv("WATCHDOG_PID")
+	usec := os.Getenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+	os.Unsetenv("WATCHDOG_USEC")
+	if usec != "" && (pid == "" || pid == strconv.Itoa(os.Getpid())) {
+		v, err := strconv.ParseInt(usec, 10, 64)
+		if err != nil || v <= 0 {
+			conn.Close()
+			return nil, fmt.Errorf("Invalid WATCHDOG_USEC: %s", usec)
+		}
+		n.watchdog = time.Duration(v) * time.Microsecond
+		n.env = append(n.env, "WATCHDOG_USEC="+usec)
+	}
+	return n, nil
+}
+
+// Notify sends newline separated assignments, e.g. "READY=1"
+func (n *Notifier) Notify(state ...string) error {
+	if n == nil {
+		return nil
+	}
+	_, err := n.conn.Write([]byte(strings.Join(state, "\n")))
+	return err
+}
+
+// Ready tells the service manager that startup or a reload finished
+func (n *Notifier) Ready(status string) error {
+	return n.Notify("READY=1", "STATUS="+status)
+}
+
+// Reloading tells the service manager that the configuration is being
+// reloaded. Ready must be called once done.
+func (n *Notifier) Reloading() error {
+	return n.Notify("RELOADING=1")
+}
+
+// Stopping tells the service manager that the service is shutting down
+func (n *Notifier) Stopping() error {
+	return n.Notify("STOPPING=1")
+}
+
+// Watchdog pings the service manager at half the watchdog interval, until
+// stop is closed. It returns immediately if no watchdog is configured.
+func (n *Notifier) Watchdog(stop <-chan struct{}) {
+	if n == nil || n.watchdog <= 0 {
+		return
+	}
+	ticker := time.NewTicker(n.watchdog / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := n.Notify("WATCHDOG=1"); err != nil {
+				log.Warnf("Unable to send watchdog notification: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Env returns the environment of a process taking over as the main
+// process of the service, see Upgrade
+func (n *Notifier) Env() []string {
+	if n == nil {
+		return nil
+	}
+	return n.env
+}
+
+// Close closes the connection to the service manager
+func (n *Notifier) Close() error {
+	if n == nil {
+		return nil
+	}
+	return n.conn.Close()
+}
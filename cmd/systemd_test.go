@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain runs the helper processes started by the tests, see runHelper
+func TestMain(m *testing.M) {
+	switch os.Getenv("SOCKS5_TEST_HELPER") {
+	case "":
+		os.Exit(m.Run())
+	case "activated":
+		activatedHelper()
+	case "upgraded":
+		upgradedHelper()
+	case "exit":
+	default:
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
+
+// runHelper runs the test binary as the helper called name, passing it
+// env and files, starting at fd 3. It returns what the helper printed.
+func runHelper(t *testing.T, name string, env []string, files ...*os.File) []byte {
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), "SOCKS5_TEST_HELPER="+name)
+	cmd.Env = append(cmd.Env, env...)
+	cmd.ExtraFiles = files
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("helper %s failed: %v", name, err)
+	}
+	return out
+}
+
+// setenv sets environment variables for the duration of a test
+func setenv(t *testing.T, kv ...string) {
+	for i := 0; i < len(kv); i += 2 {
+		key := kv[i]
+		os.Setenv(key, kv[i+1])
+		t.Cleanup(func() { os.Unsetenv(key) })
+	}
+}
+
+type activatedResult struct {
+	Listeners map[string][]string
+	Err       string
+	// Set if the LISTEN_* variables were cleared
+	Cleared bool
+}
+
+// activatedHelper prints the addresses of the listeners passed to it. A
+// LISTEN_PID of "self" is replaced by the helper's PID.
+func activatedHelper() {
+	if os.Getenv("LISTEN_PID") == "self" {
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	}
+	listeners, err := ActivatedListeners()
+	result := activatedResult{Listeners: make(map[string][]string)}
+	if err != nil {
+		result.Err = err.Error()
+	}
+	for name, ls := range listeners {
+		for _, l := range ls {
+			result.Listeners[name] = append(result.Listeners[name], l.Addr().String())
+			l.Close()
+		}
+	}
+	result.Cleared = os.Getenv("LISTEN_PID") == "" && os.Getenv("LISTEN_FDS") == "" && os.Getenv("LISTEN_FDNAMES") == ""
+	json.NewEncoder(os.Stdout).Encode(&result)
+}
+
+// listenerFiles opens n TCP listeners, returning their files and addresses
+func listenerFiles(t *testing.T, n int) ([]*os.File, []string) {
+	files := make([]*os.File, n)
+	addrs := make([]string, n)
+	for i := range files {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer l.Close()
+		files[i], err = l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		t.Cleanup(func() { files[i].Close() })
+		addrs[i] = l.Addr().String()
+	}
+	return files, addrs
+}
+
+func TestActivatedListeners(t *testing.T) {
+	files, addrs := listenerFiles(t, 3)
+	regular, err := os.Open(os.Args[0])
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer regular.Close()
+
+	cases := []struct {
+		name   string
+		env    []string
+		files  []*os.File
+		expect activatedResult
+	}{
+		{
+			name:  "named and unnamed",
+			env:   []string{"LISTEN_PID=self", "LISTEN_FDS=3", "LISTEN_FDNAMES=public::public"},
+			files: files,
+			expect: activatedResult{Listeners: map[string][]string{
+				"public":  {addrs[0], addrs[2]},
+				"unknown": {addrs[1]},
+			}},
+		},
+		{
+			name:   "without names",
+			env:    []string{"LISTEN_PID=self", "LISTEN_FDS=1"},
+			files:  files[:1],
+			expect: activatedResult{Listeners: map[string][]string{"unknown": {addrs[0]}}},
+		},
+		{
+			name:   "handed over without PID",
+			env:    []string{"LISTEN_FDS=1", "LISTEN_FDNAMES=public"},
+			files:  files[:1],
+			expect: activatedResult{Listeners: map[string][]string{"public": {addrs[0]}}},
+		},
+		{
+			name:   "meant for another process",
+			env:    []string{"LISTEN_PID=1", "LISTEN_FDS=1", "LISTEN_FDNAMES=public"},
+			files:  files[:1],
+			expect: activatedResult{Listeners: map[string][]string{}},
+		},
+		{
+			name:   "no sockets",
+			expect: activatedResult{Listeners: map[string][]string{}},
+		},
+		{
+			name:   "invalid count",
+			env:    []string{"LISTEN_PID=self", "LISTEN_FDS=two"},
+			expect: activatedResult{Listeners: map[string][]string{}, Err: "Invalid LISTEN_FDS: two"},
+		},
+		{
+			name:   "negative count",
+			env:    []string{"LISTEN_PID=self", "LISTEN_FDS=-1"},
+			expect: activatedResult{Listeners: map[string][]string{}, Err: "Invalid LISTEN_FDS: -1"},
+		},
+	}
+	for _, c := range cases {
+		var result activatedResult
+		if err := json.Unmarshal(runHelper(t, "activated", c.env, c.files...), &result); err != nil {
+			t.Fatalf("%s: err: %v", c.name, err)
+		}
+		c.expect.Cleared = true
+		if !reflect.DeepEqual(result, c.expect) {
+			t.Fatalf("%s: expected %+v, got %+v", c.name, c.expect, result)
+		}
+	}
+
+	// A file which isn't a socket is refused
+	var result activatedResult
+	out := runHelper(t, "activated", []string{"LISTEN_PID=self", "LISTEN_FDS=1", "LISTEN_FDNAMES=public"}, regular)
+	if err := json.Unmarshal(out, &result); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !strings.HasPrefix(result.Err, "Unable to use socket public (fd 3)") {
+		t.Fatalf("expected error, got %+v", result)
+	}
+}
+
+// listenNotify listens for notifications like systemd does
+func listenNotify(t *testing.T, path string) *net.UnixConn {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readNotification(t *testing.T, conn *net.UnixConn) string {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return string(buf[:n])
+}
+
+// watchdogStops checks that Watchdog returns once stop is closed, or
+// immediately if no watchdog is configured
+func watchdogStops(t *testing.T, n *Notifier, stop chan struct{}) {
+	done := make(chan struct{})
+	go func() {
+		n.Watchdog(stop)
+		close(done)
+	}()
+	if stop != nil {
+		close(stop)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("watchdog didn't stop")
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn := listenNotify(t, path)
+	setenv(t, "NOTIFY_SOCKET", path)
+
+	n, err := NewNotifier()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer n.Close()
+	if os.Getenv("NOTIFY_SOCKET") != "" {
+		t.Fatalf("expected NOTIFY_SOCKET to be cleared")
+	}
+
+	n.Ready("Serving 1 listener")
+	if msg := readNotification(t, conn); msg != "READY=1\nSTATUS=Serving 1 listener" {
+		t.Fatalf("bad: %q", msg)
+	}
+	n.Reloading()
+	if msg := readNotification(t, conn); msg != "RELOADING=1" {
+		t.Fatalf("bad: %q", msg)
+	}
+	n.Stopping()
+	if msg := readNotification(t, conn); msg != "STOPPING=1" {
+		t.Fatalf("bad: %q", msg)
+	}
+	if env := n.Env(); !reflect.DeepEqual(env, []string{"NOTIFY_SOCKET=" + path}) {
+		t.Fatalf("bad env: %v", env)
+	}
+
+	// Without WATCHDOG_USEC, there is no watchdog to ping
+	watchdogStops(t, n, nil)
+}
+
+func TestNotifier_Abstract(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract sockets are Linux only")
+	}
+	name := "socks5-test-" + strconv.Itoa(os.Getpid())
+	conn := listenNotify(t, "\x00"+name)
+	setenv(t, "NOTIFY_SOCKET", "@"+name)
+
+	n, err := NewNotifier()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer n.Close()
+	n.Stopping()
+	if msg := readNotification(t, conn); msg != "STOPPING=1" {
+		t.Fatalf("bad: %q", msg)
+	}
+}
+
+func TestNotifier_Unset(t *testing.T) {
+	n, err := NewNotifier()
+	if n != nil || err != nil {
+		t.Fatalf("expected no notifier, got %v %v", n, err)
+	}
+	// A nil Notifier ignores everything
+	if err := n.Ready("Serving"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n.Env() != nil || n.Close() != nil {
+		t.Fatalf("bad nil notifier")
+	}
+	watchdogStops(t, n, nil)
+}
+
+func TestNotifier_Watchdog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn := listenNotify(t, path)
+	setenv(t, "NOTIFY_SOCKET", path, "WATCHDOG_USEC", "20000", "WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+
+	n, err := NewNotifier()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer n.Close()
+	if os.Getenv("WATCHDOG_USEC") != "" || os.Getenv("WATCHDOG_PID") != "" {
+		t.Fatalf("expected WATCHDOG_* to be cleared")
+	}
+	if env := n.Env(); !reflect.DeepEqual(env, []string{"NOTIFY_SOCKET=" + path, "WATCHDOG_USEC=20000"}) {
+		t.Fatalf("bad env: %v", env)
+	}
+
+	// Pinged at half the interval
+	stop := make(chan struct{})
+	go n.Watchdog(stop)
+	for i := 0; i < 2; i++ {
+		if msg := readNotification(t, conn); msg != "WATCHDOG=1" {
+			t.Fatalf("bad: %q", msg)
+		}
+	}
+	close(stop)
+	watchdogStops(t, n, make(chan struct{}))
+}
+
+func TestNotifier_WatchdogOtherProcess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	listenNotify(t, path)
+	setenv(t, "NOTIFY_SOCKET", path, "WATCHDOG_USEC", "20000", "WATCHDOG_PID", "1")
+
+	n, err := NewNotifier()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer n.Close()
+	if env := n.Env(); !reflect.DeepEqual(env, []string{"NOTIFY_SOCKET=" + path}) {
+		t.Fatalf("bad env: %v", env)
+	}
+	watchdogStops(t, n, nil)
+}
+
+func TestNotifier_InvalidWatchdog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	listenNotify(t, path)
+	for _, usec := range []string{"soon", "0", "-1"} {
+		setenv(t, "NOTIFY_SOCKET", path, "WATCHDOG_USEC", usec)
+		if _, err := NewNotifier(); err == nil || err.Error() != "Invalid WATCHDOG_USEC: "+usec {
+			t.Fatalf("%s: expected error, got %v", usec, err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/fholzer/go-socks5/pkg/socks5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"google.golang.org/grpc/credentials"
+)
+
+const defaultServiceName = "go-socks5"
+
+// tracingShutdownTimeout bounds exporting the spans still batched when the
+// provider is shut down
+const tracingShutdownTimeout = 5 * time.Second
+
+// NewTracing sets up exporting traces to an OTLP collector, and returns
+// an observer recording them, and the provider to shut down once done
+func NewTracing(cfg *tracingConfig) (*socks5.TracingObserver, *sdktrace.TracerProvider, error) {
+	if cfg.Endpoint == "" {
+		return nil, nil, fmt.Errorf("No endpoint given")
+	}
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	} else if cfg.TLS != nil {
+		tlsConf, err := NewTLSClientConfig(cfg.TLS)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to parse tls: %v", err)
+		}
+		opts = append(opts, otlptracegrpc.WithTLSCredentials(credentials.NewTLS(tlsConf)))
+	}
+	if len(cfg.Headers) > 0 {
+		headers := make(map[string]string, len(cfg.Headers))
+		for _, header := range cfg.Headers {
+			headers[header.Name] = header.Value
+		}
+		opts = append(opts, otlptracegrpc.WithHeaders(headers))
+	}
+	if cfg.Timeout > 0 {
+		opts = append(opts, otlptracegrpc.WithTimeout(cfg.Timeout))
+	}
+	// The connection is established in the background
+	exporter, err := otlptracegrpc.New(context.Background(), opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+	ratio := cfg.SampleRatio
+	if ratio <= 0 {
+		ratio = 1
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String(serviceName),
+			semconv.ServiceVersionKey.String(versionInfo.Version))),
+	)
+	observer := socks5.NewTracingObserver(provider)
+	observer.Attributes = tracingAttributes
+	return observer, provider, nil
+}
+
+// shutdownTracing exports the spans still batched by provider, and closes
+// its connection to the collector
+func shutdownTracing(provider *sdktrace.TracerProvider) {
+	if provider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	defer cancel()
+	if err := provider.Shutdown(ctx); err != nil {
+		log.Warnf("Unable to export remaining traces. %v", err)
+	}
+}
+
+// tracingAttributes records the rule and forwarder chosen by the Picker
+func tracingAttributes(ctx context.Context, req *socks5.Request) []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+	if rule, ok := ctx.Value("matchingRuleId").(int); ok {
+		attrs = append(attrs, attribute.Int("socks5.rule", rule))
+	}
+	if proxyType, ok := ctx.Value("proxyType").(string); ok {
+		attrs = append(attrs, attribute.String("socks5.forwarder.type", proxyType))
+	}
+	if proxyAddress, ok := ctx.Value("proxyAddress").(string); ok {
+		attrs = append(attrs, attribute.String("socks5.forwarder.address", proxyAddress))
+	}
+	return attrs
+}
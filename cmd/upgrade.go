@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// upgradeReadyTimeout is how long a new process may take to start serving
+const upgradeReadyTimeout = 30 * time.Second
+
+// socket is a listening socket opened for the listener called name
+type socket struct {
+	net.Listener
+	name string
+}
+
+// Upgrade starts the binary again, handing over the listening sockets the
+// same way systemd passes them (LISTEN_FDS). It returns once the new
+// process is serving, after which this process should stop accepting
+// connections. If the new process fails to start, it is killed, and this
+// process keeps serving.
+func Upgrade(sockets []socket, notifier *Notifier) (*os.Process, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*os.File, 0, len(sockets)+1)
+	names := make([]string, 0, len(sockets))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, s := range sockets {
+		filer, ok := s.Listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, fmt.Errorf("Unable to pass on socket of listener %s", s.name)
+		}
+		f, err := filer.File()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to pass on socket of listener %s: %v", s.name, err)
+		}
+		files = append(files, f)
+		names = append(names, s.name)
+	}
+
+	// The new process writes to the pipe once it's serving
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer ready.Close()
+	files = append(files, readyW)
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		"LISTEN_FDS="+strconv.Itoa(len(sockets)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		"UPGRADE_READY_FD="+strconv.Itoa(listenFDsStart+len(sockets)))
+	cmd.Env = append(cmd.Env, notifier.Env()...)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	// Keep only the new process' end of the pipe open, so exiting
+	// prematurely is noticed
+	readyW.Close()
+	go cmd.Wait()
+
+	result := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		if n, _ := ready.Read(buf); n == 0 {
+			result <- fmt.Errorf("New process exited before serving")
+			return
+		}
+		result <- nil
+	}()
+	select {
+	case err = <-result:
+	case <-time.After(upgradeReadyTimeout):
+		err = fmt.Errorf("New process didn't start serving within %v", upgradeReadyTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		return nil, err
+	}
+	return cmd.Process, nil
+}
+
+// upgradeReady tells the process that started this one using Upgrade that
+// it's serving
+func upgradeReady() {
+	fd := os.Getenv("UPGRADE_READY_FD")
+	if fd == "" {
+		return
+	}
+	os.Unsetenv("UPGRADE_READY_FD")
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		log.Warnf("Invalid UPGRADE_READY_FD: %s", fd)
+		return
+	}
+	f := os.NewFile(uintptr(n), "upgrade")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// keepSocketFile stops l from removing its unix socket file when closed, as
+// another process serves it
+func keepSocketFile(l net.Listener) {
+	if unix, ok := l.(*net.UnixListener); ok {
+		unix.SetUnlinkOnClose(false)
+	}
+}
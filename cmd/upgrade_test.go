@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// upgradedHelper serves the listeners handed over by Upgrade, answering
+// each connection with the name of its listener
+func upgradedHelper() {
+	listeners, err := ActivatedListeners()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	for name, ls := range listeners {
+		for _, l := range ls {
+			go func(l net.Listener, name string) {
+				for {
+					conn, err := l.Accept()
+					if err != nil {
+						return
+					}
+					conn.Write([]byte(name))
+					conn.Close()
+				}
+			}(l, name)
+		}
+	}
+	upgradeReady()
+	// Exit eventually, even if the test doesn't stop us
+	time.Sleep(upgradeReadyTimeout)
+}
+
+func TestUpgrade(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socks5.sock")
+	unix, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer unix.Close()
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer tcp.Close()
+
+	setenv(t, "SOCKS5_TEST_HELPER", "upgraded")
+	process, err := Upgrade([]socket{{unix, "local"}, {tcp, "public"}}, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer process.Kill()
+
+	// Stop serving here, the new process keeps accepting
+	keepSocketFile(unix)
+	unix.Close()
+	tcp.Close()
+	for _, addr := range []net.Addr{unix.Addr(), tcp.Addr()} {
+		conn, err := net.DialTimeout(addr.Network(), addr.String(), time.Second)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+		name, err := ioutil.ReadAll(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		expected := map[string]string{"unix": "local", "tcp": "public"}[addr.Network()]
+		if string(name) != expected {
+			t.Fatalf("expected %s to be served by %s, got %q", addr, expected, name)
+		}
+	}
+}
+
+func TestUpgrade_ExitBeforeServing(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	setenv(t, "SOCKS5_TEST_HELPER", "exit")
+	process, err := Upgrade([]socket{{l, "public"}}, nil)
+	if err == nil || !strings.Contains(err.Error(), "exited before serving") {
+		t.Fatalf("expected error, got %v", err)
+	}
+	if process != nil {
+		t.Fatalf("expected no process")
+	}
+}
+
+func TestKeepSocketFile(t *testing.T) {
+	dir := t.TempDir()
+	kept, err := net.Listen("unix", filepath.Join(dir, "kept.sock"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	keepSocketFile(kept)
+	kept.Close()
+	if _, err := os.Stat(filepath.Join(dir, "kept.sock")); err != nil {
+		t.Fatalf("expected socket file to be kept: %v", err)
+	}
+
+	removed, err := net.Listen("unix", filepath.Join(dir, "removed.sock"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	removed.Close()
+	if _, err := os.Stat(filepath.Join(dir, "removed.sock")); !os.IsNotExist(err) {
+		t.Fatalf("expected socket file to be removed: %v", err)
+	}
+
+	// Other listeners are left alone
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	keepSocketFile(tcp)
+	tcp.Close()
+}
@@ -1,6 +1,8 @@
 package socks5
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 )
@@ -35,6 +37,13 @@ type Authenticator interface {
 	GetCode() uint8
 }
 
+// ContextAuthenticator is an Authenticator which is passed a context
+// carrying information about the client connection, see ClientAddrFromContext
+type ContextAuthenticator interface {
+	Authenticator
+	AuthenticateContext(ctx context.Context, reader io.Reader, writer io.Writer) (*AuthContext, error)
+}
+
 // NoAuthAuthenticator is used to handle the "No Authentication" mode
 type NoAuthAuthenticator struct{}
 
@@ -47,10 +56,77 @@ func (a NoAuthAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*
 	return &AuthContext{NoAuth, nil}, err
 }
 
+// AuthOutcome classifies the result of an authentication attempt,
+// e.g. for logging and metrics
+type AuthOutcome uint8
+
+const (
+	AuthOutcomeSuccess AuthOutcome = iota
+	// Username or password were rejected
+	AuthOutcomeInvalidCredentials
+	// The credential backend couldn't be queried
+	AuthOutcomeBackendError
+	// The client or user is locked out after too many failures
+	AuthOutcomeLockedOut
+	// The client didn't offer a supported auth method
+	AuthOutcomeNoAcceptableMethod
+	// The client violated the protocol or the connection failed
+	AuthOutcomeProtocolError
+)
+
+func (o AuthOutcome) String() string {
+	switch o {
+	case AuthOutcomeSuccess:
+		return "success"
+	case AuthOutcomeInvalidCredentials:
+		return "invalid_credentials"
+	case AuthOutcomeBackendError:
+		return "backend_error"
+	case AuthOutcomeLockedOut:
+		return "locked_out"
+	case AuthOutcomeNoAcceptableMethod:
+		return "no_acceptable_method"
+	default:
+		return "protocol_error"
+	}
+}
+
+// AuthOutcomeOf classifies an error returned by authentication
+func AuthOutcomeOf(err error) AuthOutcome {
+	var backendErr *CredentialBackendError
+	switch {
+	case err == nil:
+		return AuthOutcomeSuccess
+	case errors.Is(err, UserAuthFailed):
+		return AuthOutcomeInvalidCredentials
+	case errors.Is(err, ErrLockedOut):
+		return AuthOutcomeLockedOut
+	case errors.As(err, &backendErr):
+		return AuthOutcomeBackendError
+	case errors.Is(err, NoSupportedAuth):
+		return AuthOutcomeNoAcceptableMethod
+	default:
+		return AuthOutcomeProtocolError
+	}
+}
+
 // UserPassAuthenticator is used to handle username/password based
-// authentication
+// authentication. If Verifier is set, it is used to check credentials.
+// Otherwise Credentials is used, either directly if it implements
+// CredentialVerifier, or via CredentialStoreVerifier.
 type UserPassAuthenticator struct {
 	Credentials CredentialStore
+	Verifier    CredentialVerifier
+}
+
+func (a UserPassAuthenticator) verifier() CredentialVerifier {
+	if a.Verifier != nil {
+		return a.Verifier
+	}
+	if v, ok := a.Credentials.(CredentialVerifier); ok {
+		return v
+	}
+	return CredentialStoreVerifier{a.Credentials}
 }
 
 func (a UserPassAuthenticator) GetCode() uint8 {
@@ -58,6 +134,10 @@ func (a UserPassAuthenticator) GetCode() uint8 {
 }
 
 func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
+	return a.AuthenticateContext(context.Background(), reader, writer)
+}
+
+func (a UserPassAuthenticator) AuthenticateContext(ctx context.Context, reader io.Reader, writer io.Writer) (*AuthContext, error) {
 	// Tell the client to use user/pass auth
 	if _, err := writer.Write([]byte{socks5Version, UserPassAuth}); err != nil {
 		return nil, err
@@ -94,23 +174,40 @@ func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer)
 	}
 
 	// Verify the password
-	if a.Credentials.Valid(string(user), string(pass)) {
-		if _, err := writer.Write([]byte{userAuthVersion, authSuccess}); err != nil {
-			return nil, err
+	identity, err := a.verifier().Verify(ctx, string(user), string(pass))
+	if err != nil {
+		if _, werr := writer.Write([]byte{userAuthVersion, authFailure}); werr != nil {
+			return nil, werr
 		}
-	} else {
-		if _, err := writer.Write([]byte{userAuthVersion, authFailure}); err != nil {
+		var backendErr *CredentialBackendError
+		switch {
+		case errors.Is(err, ErrInvalidCredentials):
+			return nil, UserAuthFailed
+		case errors.Is(err, ErrLockedOut), errors.As(err, &backendErr):
 			return nil, err
+		default:
+			return nil, &CredentialBackendError{err}
 		}
-		return nil, UserAuthFailed
+	}
+	if _, err := writer.Write([]byte{userAuthVersion, authSuccess}); err != nil {
+		return nil, err
 	}
 
 	// Done
-	return &AuthContext{UserPassAuth, map[string]string{"Username": string(user)}}, nil
+	if identity.Username == "" {
+		identity.Username = string(user)
+	}
+	return &AuthContext{UserPassAuth, identity.Payload()}, nil
 }
 
 // authenticate is used to handle connection authentication
 func (s *Server) authenticate(conn io.Writer, bufConn io.Reader) (*AuthContext, error) {
+	return s.authenticateContext(context.Background(), &Request{}, conn, bufConn)
+}
+
+// authenticateContext is used to handle connection authentication,
+// passing ctx to authenticators supporting it
+func (s *Server) authenticateContext(ctx context.Context, req *Request, conn io.Writer, bufConn io.Reader) (*AuthContext, error) {
 	// Get the methods
 	methods, err := readMethods(bufConn)
 	if err != nil {
@@ -121,11 +218,16 @@ func (s *Server) authenticate(conn io.Writer, bufConn io.Reader) (*AuthContext,
 	for _, method := range methods {
 		cator, found := s.authMethods[method]
 		if found {
+			req.observers.OnAuthMethod(ctx, req, method)
+			if ctxCator, ok := cator.(ContextAuthenticator); ok {
+				return ctxCator.AuthenticateContext(ctx, bufConn, conn)
+			}
 			return cator.Authenticate(bufConn, conn)
 		}
 	}
 
 	// No usable method found
+	req.observers.OnAuthMethod(ctx, req, noAcceptable)
 	return nil, noAcceptableAuth(conn)
 }
 
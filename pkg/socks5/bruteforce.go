@@ -0,0 +1,368 @@
+package socks5
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fholzer/go-socks5/pkg/axe"
+)
+
+const (
+	// DefaultBruteForceMaxFailures is used if BruteForceConfig.MaxFailures is zero
+	DefaultBruteForceMaxFailures = 5
+	// DefaultBruteForceWindow is used if BruteForceConfig.Window is zero
+	DefaultBruteForceWindow = 10 * time.Minute
+	// DefaultBruteForceLockout is used if BruteForceConfig.Lockout is zero
+	DefaultBruteForceLockout = 15 * time.Minute
+	// DefaultBruteForceBaseDelay is used if BruteForceConfig.BaseDelay is zero
+	DefaultBruteForceBaseDelay = 100 * time.Millisecond
+	// DefaultBruteForceMaxDelay is used if BruteForceConfig.MaxDelay is zero
+	DefaultBruteForceMaxDelay = 5 * time.Second
+
+	// maxBruteForceRecords is the number of clients or users tracked. Once
+	// reached, the client or user which failed least recently is forgotten.
+	maxBruteForceRecords = 10000
+)
+
+var (
+	// ErrLockedOut is returned by a BruteForceGuard if the client or the
+	// user is temporarily locked out
+	ErrLockedOut = fmt.Errorf("Too many failed authentication attempts")
+)
+
+// LockoutKind specifies whether a lockout applies to a client or a user
+type LockoutKind uint8
+
+const (
+	LockoutClient LockoutKind = iota
+	LockoutUser
+)
+
+func (k LockoutKind) String() string {
+	if k == LockoutClient {
+		return "client"
+	}
+	return "user"
+}
+
+// Lockout describes a client IP or username which is locked out
+type Lockout struct {
+	Kind LockoutKind
+	// Key is the client IP or the username
+	Key      string
+	Failures int
+	Until    time.Time
+}
+
+// BruteForceConfig is used to setup a BruteForceGuard
+type BruteForceConfig struct {
+	// MaxFailures is the number of failures within Window after which a
+	// client IP or username is locked out.
+	// Defaults to DefaultBruteForceMaxFailures.
+	MaxFailures int
+
+	// Window in which failures are counted.
+	// Defaults to DefaultBruteForceWindow.
+	Window time.Duration
+
+	// Lockout is the time a client IP or username is locked out.
+	// Defaults to DefaultBruteForceLockout.
+	Lockout time.Duration
+
+	// BaseDelay is the delay before answering the first failed attempt.
+	// It is doubled for every subsequent failure, up to MaxDelay.
+	// Defaults to DefaultBruteForceBaseDelay and DefaultBruteForceMaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// TrustedNetworks are exempt from failure tracking
+	TrustedNetworks []net.IPNet
+
+	// Logger can be used to provide a custom log target.
+	// Defaults to stdout.
+	Logger axe.Logger
+}
+
+type failureRecord struct {
+	key         string
+	failures    int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+// stale returns whether r neither counts towards a lockout nor is locked
+// out any more
+func (r *failureRecord) stale(now time.Time, window time.Duration) bool {
+	return now.Sub(r.first) > window && now.After(r.lockedUntil)
+}
+
+// failureRecords holds the failure records of clients or users, the one
+// which failed most recently first
+type failureRecords struct {
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+func newFailureRecords() *failureRecords {
+	return &failureRecords{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (f *failureRecords) get(key string) *failureRecord {
+	if elem, ok := f.entries[key]; ok {
+		return elem.Value.(*failureRecord)
+	}
+	return nil
+}
+
+// add makes r the most recently failed record
+func (f *failureRecords) add(r *failureRecord) {
+	if elem, ok := f.entries[r.key]; ok {
+		elem.Value = r
+		f.lru.MoveToFront(elem)
+		return
+	}
+	f.entries[r.key] = f.lru.PushFront(r)
+}
+
+func (f *failureRecords) remove(key string) bool {
+	elem, ok := f.entries[key]
+	if !ok {
+		return false
+	}
+	delete(f.entries, key)
+	f.lru.Remove(elem)
+	return true
+}
+
+// failureState holds the failures tracked by a BruteForceGuard
+type failureState struct {
+	mu      sync.Mutex
+	clients *failureRecords
+	users   *failureRecords
+}
+
+// BruteForceGuard is a CredentialVerifier which tracks failed
+// authentication attempts per client IP and per username. Failures are
+// answered with an exponentially growing delay, and after too many
+// failures the client IP or username is temporarily locked out.
+// The client IP is taken from the context, see WithClientAddr.
+type BruteForceGuard struct {
+	verifier CredentialVerifier
+	config   *BruteForceConfig
+	*failureState
+}
+
+// NewBruteForceGuard creates a BruteForceGuard protecting verifier
+func NewBruteForceGuard(verifier CredentialVerifier, conf *BruteForceConfig) *BruteForceGuard {
+	// Defaults are filled in on a copy, leaving the caller's config as is
+	copied := *conf
+	conf = &copied
+	if conf.MaxFailures == 0 {
+		conf.MaxFailures = DefaultBruteForceMaxFailures
+	}
+	if conf.Window == 0 {
+		conf.Window = DefaultBruteForceWindow
+	}
+	if conf.Lockout == 0 {
+		conf.Lockout = DefaultBruteForceLockout
+	}
+	if conf.BaseDelay == 0 {
+		conf.BaseDelay = DefaultBruteForceBaseDelay
+	}
+	if conf.MaxDelay == 0 {
+		conf.MaxDelay = DefaultBruteForceMaxDelay
+	}
+	if conf.Logger == nil {
+		conf.Logger = axe.New()
+	}
+	return &BruteForceGuard{
+		verifier: verifier,
+		config:   conf,
+		failureState: &failureState{
+			clients: newFailureRecords(),
+			users:   newFailureRecords(),
+		},
+	}
+}
+
+// Inherit makes g share the failures tracked by previous, e.g. a guard
+// replaced when reloading the configuration, so lockouts stay in place.
+// It must be called before g is used.
+func (g *BruteForceGuard) Inherit(previous *BruteForceGuard) {
+	g.failureState = previous.failureState
+}
+
+func (g *BruteForceGuard) Verify(ctx context.Context, user, password string) (*Identity, error) {
+	client := ""
+	if addr, ok := ClientAddrFromContext(ctx); ok {
+		if ip := addrIP(addr); ip != nil {
+			if g.trusted(ip) {
+				return g.verifier.Verify(ctx, user, password)
+			}
+			client = ip.String()
+		}
+	}
+
+	if g.locked(client, user) {
+		return nil, ErrLockedOut
+	}
+
+	identity, err := g.verifier.Verify(ctx, user, password)
+	switch {
+	case err == nil:
+		g.reset(client, user)
+	case errors.Is(err, ErrInvalidCredentials):
+		delay := g.fail(client, user)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+	}
+	return identity, err
+}
+
+// Lockouts returns all current lockouts
+func (g *BruteForceGuard) Lockouts() []Lockout {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	var lockouts []Lockout
+	collect := func(kind LockoutKind, records *failureRecords) {
+		for elem := records.lru.Front(); elem != nil; elem = elem.Next() {
+			if r := elem.Value.(*failureRecord); r.lockedUntil.After(now) {
+				lockouts = append(lockouts, Lockout{kind, r.key, r.failures, r.lockedUntil})
+			}
+		}
+	}
+	collect(LockoutClient, g.clients)
+	collect(LockoutUser, g.users)
+	sort.Slice(lockouts, func(i, j int) bool {
+		return lockouts[i].Until.Before(lockouts[j].Until)
+	})
+	return lockouts
+}
+
+// Unlock clears the failures of a client IP or username.
+// It returns false if there were none.
+func (g *BruteForceGuard) Unlock(kind LockoutKind, key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.records(kind).remove(key) {
+		return false
+	}
+	g.config.Logger.Infof("socks: Cleared authentication failures of %v %s", kind, key)
+	return true
+}
+
+// UnlockAll clears all tracked failures
+func (g *BruteForceGuard) UnlockAll() {
+	g.mu.Lock()
+	g.clients = newFailureRecords()
+	g.users = newFailureRecords()
+	g.mu.Unlock()
+}
+
+func (g *BruteForceGuard) records(kind LockoutKind) *failureRecords {
+	if kind == LockoutClient {
+		return g.clients
+	}
+	return g.users
+}
+
+func (g *BruteForceGuard) trusted(ip net.IP) bool {
+	for _, n := range g.config.TrustedNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *BruteForceGuard) locked(client, user string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	if r := g.clients.get(client); r != nil && client != "" && r.lockedUntil.After(now) {
+		return true
+	}
+	if r := g.users.get(user); r != nil && r.lockedUntil.After(now) {
+		return true
+	}
+	return false
+}
+
+func (g *BruteForceGuard) reset(client, user string) {
+	g.mu.Lock()
+	g.clients.remove(client)
+	g.users.remove(user)
+	g.mu.Unlock()
+}
+
+// fail records a failure and returns the delay before answering
+func (g *BruteForceGuard) fail(client, user string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	failures := g.record(LockoutClient, client)
+	if n := g.record(LockoutUser, user); n > failures {
+		failures = n
+	}
+
+	delay := g.config.BaseDelay
+	for i := 1; i < failures && delay < g.config.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > g.config.MaxDelay {
+		delay = g.config.MaxDelay
+	}
+	return delay
+}
+
+// record adds a failure for key and returns its number of failures
+// within the window. Must be called with g.mu held.
+func (g *BruteForceGuard) record(kind LockoutKind, key string) int {
+	if kind == LockoutClient && key == "" {
+		return 0
+	}
+	records := g.records(kind)
+	now := time.Now()
+
+	r := records.get(key)
+	if r == nil || now.Sub(r.first) > g.config.Window {
+		r = &failureRecord{key: key, first: now}
+	}
+	r.failures++
+	records.add(r)
+
+	// Stale records gather at the back, each is purged once. Past the
+	// limit, the least recently failed records go even if still counted.
+	for records.lru.Len() > 1 {
+		old := records.lru.Back().Value.(*failureRecord)
+		if records.lru.Len() <= maxBruteForceRecords && !old.stale(now, g.config.Window) {
+			break
+		}
+		records.remove(old.key)
+	}
+
+	if r.failures >= g.config.MaxFailures && !r.lockedUntil.After(now) {
+		r.lockedUntil = now.Add(g.config.Lockout)
+		g.config.Logger.Warnf("socks: Locking out %v %s for %v after %d failed authentication attempts", kind, key, g.config.Lockout, r.failures)
+	}
+	return r.failures
+}
+
+// addrIP returns the IP of addr, or nil if addr isn't an IP based address
+func addrIP(addr net.Addr) net.IP {
+	if spec := NewAddrSpec(addr); spec != nil {
+		return spec.IP
+	}
+	return nil
+}
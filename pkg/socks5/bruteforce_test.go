@@ -0,0 +1,222 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fholzer/go-socks5/pkg/axe"
+)
+
+func clientContext(ip string) context.Context {
+	return WithClientAddr(context.Background(), &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000})
+}
+
+func newTestGuard(trusted ...string) *BruteForceGuard {
+	conf := &BruteForceConfig{
+		MaxFailures: 3,
+		Window:      time.Minute,
+		Lockout:     time.Minute,
+		BaseDelay:   time.Millisecond,
+		MaxDelay:    4 * time.Millisecond,
+		Logger:      axe.New(),
+	}
+	for _, cidr := range trusted {
+		_, n, _ := net.ParseCIDR(cidr)
+		conf.TrustedNetworks = append(conf.TrustedNetworks, *n)
+	}
+	return NewBruteForceGuard(CredentialStoreVerifier{StaticCredentials{"foo": "bar", "baz": "qux"}}, conf)
+}
+
+func TestBruteForceGuard_LockoutClient(t *testing.T) {
+	g := newTestGuard()
+	ctx := clientContext("10.0.0.1")
+
+	for i := 0; i < 3; i++ {
+		if _, err := g.Verify(ctx, "foo", "wrong"); err != ErrInvalidCredentials {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Valid credentials are rejected while locked out
+	if _, err := g.Verify(ctx, "baz", "qux"); err != ErrLockedOut {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Other clients are only affected by the user lockout
+	other := clientContext("10.0.0.2")
+	if _, err := g.Verify(other, "foo", "bar"); err != ErrLockedOut {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := g.Verify(other, "baz", "qux"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	lockouts := g.Lockouts()
+	if len(lockouts) != 2 {
+		t.Fatalf("expected 2 lockouts, got %v", lockouts)
+	}
+
+	if !g.Unlock(LockoutClient, "10.0.0.1") {
+		t.Fatalf("expected client to be unlocked")
+	}
+	if !g.Unlock(LockoutUser, "foo") {
+		t.Fatalf("expected user to be unlocked")
+	}
+	if g.Unlock(LockoutUser, "foo") {
+		t.Fatalf("expected nothing to unlock")
+	}
+	if _, err := g.Verify(ctx, "foo", "bar"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestBruteForceGuard_SuccessResets(t *testing.T) {
+	g := newTestGuard()
+	ctx := clientContext("10.0.0.1")
+
+	for i := 0; i < 5; i++ {
+		g.Verify(ctx, "foo", "wrong")
+		g.Verify(ctx, "foo", "wrong")
+		if _, err := g.Verify(ctx, "foo", "bar"); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if len(g.Lockouts()) != 0 {
+		t.Fatalf("expected no lockouts")
+	}
+}
+
+func TestBruteForceGuard_Delay(t *testing.T) {
+	g := newTestGuard()
+	g.config.BaseDelay = 20 * time.Millisecond
+	g.config.MaxDelay = 40 * time.Millisecond
+	g.config.MaxFailures = 10
+	ctx := clientContext("10.0.0.1")
+
+	start := time.Now()
+	g.Verify(ctx, "foo", "wrong")
+	g.Verify(ctx, "foo", "wrong")
+	g.Verify(ctx, "foo", "wrong")
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("expected exponential delay, took %v", elapsed)
+	}
+}
+
+func TestBruteForceGuard_Trusted(t *testing.T) {
+	g := newTestGuard("10.0.0.0/24")
+	ctx := clientContext("10.0.0.1")
+
+	for i := 0; i < 5; i++ {
+		g.Verify(ctx, "foo", "wrong")
+	}
+	if _, err := g.Verify(ctx, "foo", "bar"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(g.Lockouts()) != 0 {
+		t.Fatalf("expected no lockouts")
+	}
+}
+
+func TestBruteForceGuard_Inherit(t *testing.T) {
+	previous := newTestGuard()
+	ctx := clientContext("10.0.0.1")
+	for i := 0; i < 3; i++ {
+		previous.Verify(ctx, "foo", "wrong")
+	}
+
+	g := newTestGuard()
+	g.Inherit(previous)
+	if _, err := g.Verify(ctx, "foo", "bar"); err != ErrLockedOut {
+		t.Fatalf("expected lockout to be kept, got %v", err)
+	}
+
+	// Failures still counted by the previous guard are shared
+	other := clientContext("10.0.0.2")
+	for i := 0; i < 3; i++ {
+		previous.Verify(other, "baz", "wrong")
+	}
+	if _, err := g.Verify(other, "baz", "qux"); err != ErrLockedOut {
+		t.Fatalf("expected lockout, got %v", err)
+	}
+	if n := len(g.Lockouts()); n != 4 {
+		t.Fatalf("expected 4 lockouts, got %d", n)
+	}
+}
+
+func TestBruteForceGuard_Records(t *testing.T) {
+	g := newTestGuard()
+
+	// A spray of usernames within the window is bounded, forgetting the
+	// least recently failed first
+	g.mu.Lock()
+	for i := 0; i < maxBruteForceRecords+10; i++ {
+		g.record(LockoutUser, fmt.Sprintf("user%d", i))
+		if i == maxBruteForceRecords-1 {
+			g.record(LockoutUser, "user0")
+		}
+	}
+	n := g.users.lru.Len()
+	first, second := g.users.get("user0"), g.users.get("user1")
+	g.mu.Unlock()
+	if n != maxBruteForceRecords {
+		t.Fatalf("expected %d records, got %d", maxBruteForceRecords, n)
+	}
+	if first == nil || second != nil {
+		t.Fatalf("expected user1 to be evicted before user0")
+	}
+
+	// Stale records are purged as new failures come in
+	g = newTestGuard()
+	g.config.Window = time.Millisecond
+	g.config.Lockout = time.Millisecond
+	g.mu.Lock()
+	g.record(LockoutUser, "foo")
+	g.record(LockoutUser, "bar")
+	g.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	g.mu.Lock()
+	g.record(LockoutUser, "baz")
+	n = g.users.lru.Len()
+	g.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("expected stale records to be purged, got %d", n)
+	}
+}
+
+func TestPasswordAuth_LockedOut(t *testing.T) {
+	g := newTestGuard()
+	g.config.MaxFailures = 1
+	ctx := clientContext("10.0.0.1")
+	g.Verify(ctx, "foo", "wrong")
+
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{1, UserPassAuth})
+	req.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+	var resp bytes.Buffer
+
+	s, _ := New(&Config{AuthMethods: []Authenticator{UserPassAuthenticator{Verifier: g}}})
+	_, err := s.authenticateContext(ctx, &Request{}, &resp, req)
+	if outcome := AuthOutcomeOf(err); outcome != AuthOutcomeLockedOut {
+		t.Fatalf("bad outcome: %v (%v)", outcome, err)
+	}
+
+	out := resp.Bytes()
+	if !bytes.Equal(out, []byte{socks5Version, UserPassAuth, 1, authFailure}) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestBruteForceGuard_Defaults(t *testing.T) {
+	conf := &BruteForceConfig{}
+	g := NewBruteForceGuard(CredentialStoreVerifier{StaticCredentials{}}, conf)
+	if conf.MaxFailures != 0 || conf.Window != 0 || conf.Lockout != 0 || conf.Logger != nil {
+		t.Fatalf("config modified: %+v", conf)
+	}
+	if g.config.MaxFailures != DefaultBruteForceMaxFailures || g.config.Lockout != DefaultBruteForceLockout {
+		t.Fatalf("defaults not applied: %+v", g.config)
+	}
+}
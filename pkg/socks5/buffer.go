@@ -0,0 +1,31 @@
+package socks5
+
+import (
+	"sync"
+)
+
+// bufferPool hands out relay buffers of a fixed size, so buffers are only
+// held by connections actually relaying data
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	p := &bufferPool{size: size}
+	p.pool.New = func() interface{} {
+		buf := make([]byte, p.size)
+		return &buf
+	}
+	return p
+}
+
+// Get returns a buffer, allocating it if none is available
+func (p *bufferPool) Get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+// Put returns a buffer obtained by Get to the pool
+func (p *bufferPool) Put(buf *[]byte) {
+	p.pool.Put(buf)
+}
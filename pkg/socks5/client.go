@@ -0,0 +1,209 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Client connects through a SOCKS server, and issues the Tor name
+// resolution extension commands. Each call uses a new connection.
+type Client struct {
+	// Address of the SOCKS server
+	Address string
+
+	// Username and Password are used if the server requires
+	// username/password authentication
+	Username string
+	Password string
+
+	// Optional function for dialing the server
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Resolve asks the server for an address of name
+func (c *Client) Resolve(ctx context.Context, name string) (net.IP, error) {
+	if len(name) > 255 {
+		return nil, fmt.Errorf("Name too long: %s", name)
+	}
+	addr, err := c.do(ctx, ResolveCommand, &AddrSpec{FQDN: name})
+	if err != nil {
+		return nil, err
+	}
+	if addr.IP == nil {
+		return nil, fmt.Errorf("Server replied without address")
+	}
+	return addr.IP, nil
+}
+
+// ResolvePTR asks the server for the name of ip
+func (c *Client) ResolvePTR(ctx context.Context, ip net.IP) (string, error) {
+	addr, err := c.do(ctx, ResolvePTRCommand, &AddrSpec{IP: ip})
+	if err != nil {
+		return "", err
+	}
+	if addr.FQDN == "" {
+		return "", fmt.Errorf("Server replied without name")
+	}
+	return addr.FQDN, nil
+}
+
+// DialContext connects to addr through the server. It has the signature
+// of Config.Dial, and can be used to chain SOCKS servers. If the server
+// rejects the request, a ReplyError carrying its reply code is returned.
+func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("Unsupported network: %s", network)
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("Invalid port: %s", portStr)
+	}
+
+	dest := &AddrSpec{Port: port}
+	if ip := net.ParseIP(host); ip != nil {
+		dest.IP = ip
+	} else if len(host) > 255 {
+		return nil, fmt.Errorf("Name too long: %s", host)
+	} else {
+		dest.FQDN = host
+	}
+
+	conn, _, err := c.request(ctx, ConnectCommand, dest)
+	return conn, err
+}
+
+// do sends a single request, and returns the address of the reply
+func (c *Client) do(ctx context.Context, command uint8, dest *AddrSpec) (*AddrSpec, error) {
+	conn, addr, err := c.request(ctx, command, dest)
+	if err != nil {
+		return nil, err
+	}
+	conn.Close()
+	return addr, nil
+}
+
+// request sends a request on a new connection, and returns the connection
+// along with the address of the reply. Replies are read byte by byte as
+// required, so nothing sent by the destination is consumed.
+func (c *Client) request(ctx context.Context, command uint8, dest *AddrSpec) (net.Conn, *AddrSpec, error) {
+	dial := c.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dial(ctx, "tcp", c.Address)
+	if err != nil {
+		return nil, nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// Close the connection if ctx is done before the reply arrives
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	addr, err := c.negotiate(conn, command, dest)
+	close(done)
+	<-stopped
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, addr, nil
+}
+
+func (c *Client) negotiate(conn net.Conn, command uint8, dest *AddrSpec) (*AddrSpec, error) {
+	if err := c.authenticate(conn, conn); err != nil {
+		return nil, err
+	}
+
+	// sendReply formats requests just like replies
+	if err := sendReply(conn, command, dest); err != nil {
+		return nil, fmt.Errorf("Failed to send request: %v", err)
+	}
+
+	header := []byte{0, 0, 0}
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, fmt.Errorf("Failed to read reply: %v", err)
+	}
+	if header[0] != socks5Version {
+		return nil, fmt.Errorf("Unsupported reply version: %v", header[0])
+	}
+	if header[1] != successReply {
+		return nil, &ReplyError{Code: header[1]}
+	}
+	addr, err := readAddrSpec(conn)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read reply: %v", err)
+	}
+	return addr, nil
+}
+
+// authenticate negotiates the authentication method, and authenticates
+// using username and password if the server asks for them
+func (c *Client) authenticate(conn io.Writer, bufConn io.Reader) error {
+	methods := []byte{socks5Version, 1, NoAuth}
+	if c.Username != "" {
+		methods = []byte{socks5Version, 2, NoAuth, UserPassAuth}
+	}
+	if _, err := conn.Write(methods); err != nil {
+		return fmt.Errorf("Failed to send auth methods: %v", err)
+	}
+
+	header := []byte{0, 0}
+	if _, err := io.ReadFull(bufConn, header); err != nil {
+		return fmt.Errorf("Failed to read auth method: %v", err)
+	}
+	if header[0] != socks5Version {
+		return fmt.Errorf("Unsupported SOCKS version: %v", header[0])
+	}
+
+	switch header[1] {
+	case NoAuth:
+		return nil
+	case UserPassAuth:
+		if c.Username == "" {
+			break
+		}
+		if len(c.Username) > 255 || len(c.Password) > 255 {
+			return fmt.Errorf("Username or password too long")
+		}
+		msg := []byte{userAuthVersion, byte(len(c.Username))}
+		msg = append(msg, c.Username...)
+		msg = append(msg, byte(len(c.Password)))
+		msg = append(msg, c.Password...)
+		if _, err := conn.Write(msg); err != nil {
+			return fmt.Errorf("Failed to send credentials: %v", err)
+		}
+		if _, err := io.ReadFull(bufConn, header); err != nil {
+			return fmt.Errorf("Failed to read auth status: %v", err)
+		}
+		if header[1] != authSuccess {
+			return UserAuthFailed
+		}
+		return nil
+	}
+	return NoSupportedAuth
+}
@@ -0,0 +1,110 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/fholzer/go-socks5/pkg/axe"
+)
+
+type reverseResolver struct {
+	staticResolver
+	name string
+}
+
+func (r reverseResolver) ResolveAddr(ctx context.Context, ip net.IP) (context.Context, []string, error) {
+	return ctx, []string{r.name}, nil
+}
+
+// emptyReverseResolver finds no names, without failing
+type emptyReverseResolver struct {
+	staticResolver
+}
+
+func (r emptyReverseResolver) ResolveAddr(ctx context.Context, ip net.IP) (context.Context, []string, error) {
+	return ctx, []string{}, nil
+}
+
+func startServer(t *testing.T, conf *Config) (string, func()) {
+	if conf.Logger == nil {
+		conf.Logger = axe.New()
+	}
+	s, err := New(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go s.Serve(l)
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func TestClient_Resolve(t *testing.T) {
+	addr, stop := startServer(t, &Config{
+		Credentials: StaticCredentials{"foo": "bar"},
+		Resolver:    reverseResolver{staticResolver{net.ParseIP("192.0.2.1")}, "foo.example.com."},
+	})
+	defer stop()
+
+	c := &Client{Address: addr, Username: "foo", Password: "bar"}
+	ctx := context.Background()
+
+	ip, err := c.Resolve(ctx, "foo.example.com")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("bad ip: %v", ip)
+	}
+
+	name, err := c.ResolvePTR(ctx, net.ParseIP("192.0.2.1"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if name != "foo.example.com" {
+		t.Fatalf("bad name: %v", name)
+	}
+
+	c.Password = "wrong"
+	if _, err := c.Resolve(ctx, "foo.example.com"); err != UserAuthFailed {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestClient_ResolveErrors(t *testing.T) {
+	// staticResolver doesn't support reverse lookups
+	addr, stop := startServer(t, &Config{
+		Resolver: staticResolver{net.ParseIP("192.0.2.1")},
+		Rules:    &PermitCommand{EnableResolvePTR: true},
+	})
+	defer stop()
+
+	c := &Client{Address: addr}
+	ctx := context.Background()
+
+	var replyErr *ReplyError
+	if _, err := c.Resolve(ctx, "foo.example.com"); !errors.As(err, &replyErr) || replyErr.Code != ruleFailure {
+		t.Fatalf("expected rule failure, got %v", err)
+	}
+	if _, err := c.ResolvePTR(ctx, net.ParseIP("192.0.2.1")); !errors.As(err, &replyErr) || replyErr.Code != hostUnreachable {
+		t.Fatalf("expected host unreachable, got %v", err)
+	}
+}
+
+func TestClient_ResolvePTR_NoName(t *testing.T) {
+	addr, stop := startServer(t, &Config{
+		Resolver: emptyReverseResolver{staticResolver{net.ParseIP("192.0.2.1")}},
+		Rules:    &PermitCommand{EnableResolvePTR: true},
+	})
+	defer stop()
+
+	c := &Client{Address: addr}
+	var replyErr *ReplyError
+	if _, err := c.ResolvePTR(context.Background(), net.ParseIP("192.0.2.1")); !errors.As(err, &replyErr) || replyErr.Code != hostUnreachable {
+		t.Fatalf("expected host unreachable, got %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+type contextKey int
+
+const (
+	clientAddrKey contextKey = iota
+	destinationIPsKey
+	resolverNameKey
+	remoteResolutionKey
+	tracingSpanKey
+	authContextKey
+)
+
+// WithClientAddr returns a copy of ctx carrying the address of the client
+func WithClientAddr(ctx context.Context, addr net.Addr) context.Context {
+	return context.WithValue(ctx, clientAddrKey, addr)
+}
+
+// ClientAddrFromContext returns the address of the client, if known
+func ClientAddrFromContext(ctx context.Context) (net.Addr, bool) {
+	addr, ok := ctx.Value(clientAddrKey).(net.Addr)
+	return addr, ok && addr != nil
+}
+
+// WithDestinationIPs returns a copy of ctx carrying all addresses the
+// destination of a request resolved to, in the order they should be tried
+func WithDestinationIPs(ctx context.Context, ips []net.IP) context.Context {
+	return context.WithValue(ctx, destinationIPsKey, ips)
+}
+
+// DestinationIPsFromContext returns the addresses the destination of a
+// request resolved to, if known
+func DestinationIPsFromContext(ctx context.Context) ([]net.IP, bool) {
+	ips, ok := ctx.Value(destinationIPsKey).([]net.IP)
+	return ips, ok && len(ips) > 0
+}
+
+// WithResolverName returns a copy of ctx recording the name of the
+// resolver used to look up the destination of a request
+func WithResolverName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, resolverNameKey, name)
+}
+
+// ResolverNameFromContext returns the name of the resolver used to look
+// up the destination of a request, if recorded
+func ResolverNameFromContext(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(resolverNameKey).(string)
+	return name, ok
+}
+
+// WithRemoteResolution returns a copy of ctx indicating that the
+// destination of a request is resolved by the next hop, e.g. an upstream
+// proxy. Its name is then passed on unresolved when dialing.
+func WithRemoteResolution(ctx context.Context) context.Context {
+	return context.WithValue(ctx, remoteResolutionKey, true)
+}
+
+// RemoteResolutionFromContext reports whether the destination of a
+// request is resolved by the next hop
+func RemoteResolutionFromContext(ctx context.Context) bool {
+	remote, _ := ctx.Value(remoteResolutionKey).(bool)
+	return remote
+}
+
+// WithAuthContext returns a copy of ctx carrying the result of
+// authenticating the client
+func WithAuthContext(ctx context.Context, authContext *AuthContext) context.Context {
+	return context.WithValue(ctx, authContextKey, authContext)
+}
+
+// AuthContextFromContext returns the result of authenticating the
+// client, if known
+func AuthContextFromContext(ctx context.Context) (*AuthContext, bool) {
+	authContext, ok := ctx.Value(authContextKey).(*AuthContext)
+	return authContext, ok && authContext != nil
+}
+
+// detachedContext carries the values of a context, but neither its
+// deadline nor its cancellation
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (d detachedContext) Value(key interface{}) interface{} { return d.parent.Value(key) }
@@ -1,10 +1,80 @@
 package socks5
 
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrInvalidCredentials is returned by a CredentialVerifier if the
+	// user doesn't exist, the password is wrong or the user isn't permitted
+	ErrInvalidCredentials = fmt.Errorf("Invalid credentials")
+)
+
 // CredentialStore is used to support user/pass authentication
 type CredentialStore interface {
 	Valid(user, password string) bool
 }
 
+// Identity describes an authenticated user
+type Identity struct {
+	Username string
+	// Groups the user is a member of
+	Groups []string
+	// Attributes are additional backend specific properties of the user
+	Attributes map[string]string
+}
+
+// Payload returns the identity in the form used by AuthContext.Payload.
+// Groups are joined by commas.
+func (i *Identity) Payload() map[string]string {
+	payload := make(map[string]string, len(i.Attributes)+2)
+	for k, v := range i.Attributes {
+		payload[k] = v
+	}
+	if len(i.Groups) > 0 {
+		payload["Groups"] = strings.Join(i.Groups, ",")
+	}
+	payload["Username"] = i.Username
+	return payload
+}
+
+// CredentialVerifier is used to support user/pass authentication against
+// backends which can fail or provide additional information about a user.
+// Verify returns ErrInvalidCredentials for rejected credentials, and a
+// *CredentialBackendError if the backend couldn't be queried.
+type CredentialVerifier interface {
+	Verify(ctx context.Context, user, password string) (*Identity, error)
+}
+
+// CredentialBackendError is returned by a CredentialVerifier if the
+// credentials couldn't be checked, e.g. because the backend is unreachable
+type CredentialBackendError struct {
+	Err error
+}
+
+func (e *CredentialBackendError) Error() string {
+	return fmt.Sprintf("Credential backend failed: %v", e.Err)
+}
+
+func (e *CredentialBackendError) Unwrap() error {
+	return e.Err
+}
+
+// CredentialStoreVerifier adapts a CredentialStore to the
+// CredentialVerifier interface
+type CredentialStoreVerifier struct {
+	Store CredentialStore
+}
+
+func (c CredentialStoreVerifier) Verify(ctx context.Context, user, password string) (*Identity, error) {
+	if !c.Store.Valid(user, password) {
+		return nil, ErrInvalidCredentials
+	}
+	return &Identity{Username: user}, nil
+}
+
 // StaticCredentials enables using a map directly as a credential store
 type StaticCredentials map[string]string
 
@@ -0,0 +1,215 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GehirnInc/crypt"
+	_ "github.com/GehirnInc/crypt/apr1_crypt"
+	_ "github.com/GehirnInc/crypt/sha256_crypt"
+	_ "github.com/GehirnInc/crypt/sha512_crypt"
+	"github.com/fholzer/go-socks5/pkg/axe"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// DefaultCredentialsCheckInterval is the minimum time between two
+	// checks of a credentials file for modifications.
+	DefaultCredentialsCheckInterval = 5 * time.Second
+)
+
+// dummyHash is compared against when an unknown user tries to log in,
+// so that the time taken doesn't reveal whether a user exists.
+var dummyHash = []byte("$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy")
+
+// FileCredentials is a CredentialStore backed by a file of hashed passwords.
+// Files ending in .yml or .yaml are parsed as a YAML user list, anything
+// else is parsed as an Apache htpasswd file. Supported hashes are bcrypt,
+// SHA-256/SHA-512 crypt, APR1 and {SHA}. The file is reloaded when it
+// changes on disk.
+type FileCredentials struct {
+	// CheckInterval is the minimum time between two checks of the
+	// file for modifications.
+	CheckInterval time.Duration
+
+	path string
+	log  axe.Logger
+
+	mu        sync.RWMutex
+	users     map[string]string
+	modTime   time.Time
+	size      int64
+	lastCheck time.Time
+}
+
+type yamlUserList struct {
+	Users []struct {
+		Name     string `yaml:"name"`
+		Password string `yaml:"password"`
+	} `yaml:"users"`
+}
+
+// NewFileCredentials creates a FileCredentials reading from path.
+// If logger is nil, a default logger is used.
+func NewFileCredentials(path string, logger axe.Logger) (*FileCredentials, error) {
+	if logger == nil {
+		logger = axe.New()
+	}
+	f := &FileCredentials{
+		CheckInterval: DefaultCredentialsCheckInterval,
+		path:          path,
+		log:           logger,
+	}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload unconditionally re-reads the credentials file.
+func (f *FileCredentials) Reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return fmt.Errorf("Unable to stat credentials file: %v", err)
+	}
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("Unable to read credentials file: %v", err)
+	}
+
+	var users map[string]string
+	switch strings.ToLower(filepath.Ext(f.path)) {
+	case ".yml", ".yaml":
+		users, err = parseYAMLUsers(data)
+	default:
+		users, err = parseHtpasswd(data)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to parse credentials file %s: %v", f.path, err)
+	}
+
+	f.mu.Lock()
+	f.users = users
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	f.lastCheck = time.Now()
+	f.mu.Unlock()
+	return nil
+}
+
+// reloadIfChanged re-reads the credentials file if its modification time
+// or size changed. On failure the previously loaded users are kept.
+func (f *FileCredentials) reloadIfChanged() {
+	f.mu.RLock()
+	due := time.Since(f.lastCheck) >= f.CheckInterval
+	f.mu.RUnlock()
+	if !due {
+		return
+	}
+
+	f.mu.Lock()
+	f.lastCheck = time.Now()
+	modTime, size := f.modTime, f.size
+	f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		f.log.Warnf("socks: Unable to stat credentials file: %v", err)
+		return
+	}
+	if info.ModTime().Equal(modTime) && info.Size() == size {
+		return
+	}
+	if err := f.Reload(); err != nil {
+		f.log.Errorf("socks: %v", err)
+		return
+	}
+	f.log.Infof("socks: Reloaded credentials file %s", f.path)
+}
+
+func (f *FileCredentials) Valid(user, password string) bool {
+	f.reloadIfChanged()
+
+	f.mu.RLock()
+	hash, ok := f.users[user]
+	f.mu.RUnlock()
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return verifyPasswordHash(hash, password)
+}
+
+// verifyPasswordHash checks password against a crypt(3) style hash.
+func verifyPasswordHash(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash[len("{SHA}"):]), []byte(expected)) == 1
+	case crypt.IsHashSupported(hash):
+		return crypt.NewFromHash(hash).Verify(hash, []byte(password)) == nil
+	}
+	return false
+}
+
+func isSupportedHash(hash string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "{SHA}"} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return crypt.IsHashSupported(hash)
+}
+
+func parseHtpasswd(data []byte) (map[string]string, error) {
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: expected user:hash", lineNo)
+		}
+		user, hash := line[:i], line[i+1:]
+		if !isSupportedHash(hash) {
+			return nil, fmt.Errorf("line %d: unsupported hash for user %s", lineNo, user)
+		}
+		users[user] = hash
+	}
+	return users, scanner.Err()
+}
+
+func parseYAMLUsers(data []byte) (map[string]string, error) {
+	var list yamlUserList
+	if err := yaml.UnmarshalStrict(data, &list); err != nil {
+		return nil, err
+	}
+	users := make(map[string]string, len(list.Users))
+	for i, u := range list.Users {
+		if u.Name == "" {
+			return nil, fmt.Errorf("user #%d: missing name", i)
+		}
+		if !isSupportedHash(u.Password) {
+			return nil, fmt.Errorf("user %s: unsupported password hash", u.Name)
+		}
+		users[u.Name] = u.Password
+	}
+	return users, nil
+}
@@ -0,0 +1,157 @@
+package socks5
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GehirnInc/crypt"
+	"github.com/fholzer/go-socks5/pkg/axe"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func hashPassword(t *testing.T, c crypt.Crypt, password string) string {
+	hash, err := c.New().Generate([]byte(password), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return hash
+}
+
+func TestFileCredentials_Htpasswd(t *testing.T) {
+	bhash, err := bcrypt.GenerateFromPassword([]byte("bar"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "socks5")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, ".htpasswd")
+	content := "# comment\n" +
+		"foo:" + string(bhash) + "\n" +
+		"apr:" + hashPassword(t, crypt.APR1, "bar") + "\n" +
+		"sha256:" + hashPassword(t, crypt.SHA256, "bar") + "\n" +
+		"sha512:" + hashPassword(t, crypt.SHA512, "bar") + "\n" +
+		"sha1:{SHA}Ys23Ag/5IOWqZCw9QGaVDdHwH00=\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	creds, err := NewFileCredentials(path, axe.New())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, user := range []string{"foo", "apr", "sha256", "sha512", "sha1"} {
+		if !creds.Valid(user, "bar") {
+			t.Fatalf("expect valid for %s", user)
+		}
+		if creds.Valid(user, "baz") {
+			t.Fatalf("expect invalid for %s", user)
+		}
+	}
+
+	if creds.Valid("unknown", "bar") {
+		t.Fatalf("expect invalid")
+	}
+}
+
+func TestFileCredentials_YAML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socks5")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "users.yml")
+	content := "users:\n" +
+		"  - name: foo\n" +
+		"    password: " + hashPassword(t, crypt.SHA512, "bar") + "\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	creds, err := NewFileCredentials(path, axe.New())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if !creds.Valid("foo", "bar") {
+		t.Fatalf("expect valid")
+	}
+	if creds.Valid("foo", "baz") {
+		t.Fatalf("expect invalid")
+	}
+}
+
+func TestFileCredentials_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socks5")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, ".htpasswd")
+	if err := ioutil.WriteFile(path, []byte("foo:"+hashPassword(t, crypt.SHA256, "bar")+"\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	creds, err := NewFileCredentials(path, axe.New())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	creds.CheckInterval = 0
+
+	if !creds.Valid("foo", "bar") {
+		t.Fatalf("expect valid")
+	}
+
+	content := "foo:" + hashPassword(t, crypt.SHA256, "baz") + "\n" +
+		"qux:" + hashPassword(t, crypt.SHA256, "bar") + "\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+
+	if creds.Valid("foo", "bar") {
+		t.Fatalf("expect invalid after reload")
+	}
+	if !creds.Valid("qux", "bar") {
+		t.Fatalf("expect valid after reload")
+	}
+
+	// A broken file must not wipe the loaded users
+	if err := ioutil.WriteFile(path, []byte("garbage\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	later = later.Add(time.Minute)
+	os.Chtimes(path, later, later)
+
+	if !creds.Valid("qux", "bar") {
+		t.Fatalf("expect previous users to be kept")
+	}
+}
+
+func TestFileCredentials_RejectsPlaintext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socks5")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, ".htpasswd")
+	if err := ioutil.WriteFile(path, []byte("foo:bar\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if _, err := NewFileCredentials(path, axe.New()); err == nil {
+		t.Fatalf("expect error")
+	}
+}
@@ -0,0 +1,242 @@
+package socks5
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fholzer/go-socks5/pkg/axe"
+)
+
+const (
+	// DefaultHTTPCredentialsTimeout is used if HTTPCredentialsConfig.Timeout is zero
+	DefaultHTTPCredentialsTimeout = 5 * time.Second
+
+	// maxHTTPCredentialsCacheSize is the number of cached results. The
+	// least recently used results are evicted first.
+	maxHTTPCredentialsCacheSize = 10000
+)
+
+// HTTPCredentialsConfig is used to setup a HTTPCredentials store
+type HTTPCredentialsConfig struct {
+	// URL credentials are POSTed to
+	URL string
+
+	// Timeout for a single request to URL.
+	// Defaults to DefaultHTTPCredentialsTimeout.
+	Timeout time.Duration
+
+	// TLSConfig can be provided to verify the server against a custom CA
+	// or to authenticate using a client certificate.
+	TLSConfig *tls.Config
+
+	// CacheTTL is the time a successful authentication is cached.
+	// Zero disables caching.
+	CacheTTL time.Duration
+
+	// NegativeCacheTTL is the time a rejected authentication is cached.
+	// Zero disables caching.
+	NegativeCacheTTL time.Duration
+
+	// Logger can be used to provide a custom log target.
+	// Defaults to stdout.
+	Logger axe.Logger
+}
+
+// HTTPCredentials is a CredentialStore and CredentialVerifier which
+// validates credentials by POSTing them as JSON to a web service. The
+// service responds with a JSON object like
+//
+//	{"allow": true, "groups": ["admins"], "destinations": ["10.0.0.0/8"], "attributes": {"team": "ops"}}
+//
+// Destinations are added to the identity's attributes comma separated as
+// "AllowedDestinations".
+type HTTPCredentials struct {
+	config *HTTPCredentialsConfig
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]*list.Element
+	lru   *list.List
+}
+
+type httpCredentialsRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type httpCredentialsResponse struct {
+	Allow        bool              `json:"allow"`
+	Groups       []string          `json:"groups"`
+	Destinations []string          `json:"destinations"`
+	Attributes   map[string]string `json:"attributes"`
+}
+
+type httpCredentialsResult struct {
+	key      [sha256.Size]byte
+	identity *Identity
+	expires  time.Time
+}
+
+// NewHTTPCredentials creates a new HTTPCredentials store
+func NewHTTPCredentials(conf *HTTPCredentialsConfig) (*HTTPCredentials, error) {
+	// Defaults are filled in on a copy, leaving the caller's config as is
+	copied := *conf
+	conf = &copied
+	if conf.URL == "" {
+		return nil, fmt.Errorf("URL must be specified")
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = DefaultHTTPCredentialsTimeout
+	}
+	if conf.Logger == nil {
+		conf.Logger = axe.New()
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if conf.TLSConfig != nil {
+		transport.TLSClientConfig = conf.TLSConfig
+	}
+
+	return &HTTPCredentials{
+		config: conf,
+		client: &http.Client{
+			Timeout:   conf.Timeout,
+			Transport: transport,
+		},
+		cache: make(map[[sha256.Size]byte]*list.Element),
+		lru:   list.New(),
+	}, nil
+}
+
+func (h *HTTPCredentials) Valid(user, password string) bool {
+	_, err := h.Verify(context.Background(), user, password)
+	return err == nil
+}
+
+func (h *HTTPCredentials) Verify(ctx context.Context, user, password string) (*Identity, error) {
+	key := sha256.Sum256([]byte(user + "\x00" + password))
+	if res := h.cached(key); res != nil {
+		return res.identity, res.err()
+	}
+
+	resp, err := h.query(ctx, user, password)
+	if err != nil {
+		h.config.Logger.Errorf("socks: Credential check for %s failed: %v", user, err)
+		return nil, &CredentialBackendError{err}
+	}
+
+	res := &httpCredentialsResult{key: key}
+	ttl := h.config.NegativeCacheTTL
+	if resp.Allow {
+		ttl = h.config.CacheTTL
+		res.identity = &Identity{
+			Username:   user,
+			Groups:     resp.Groups,
+			Attributes: make(map[string]string),
+		}
+		for k, v := range resp.Attributes {
+			res.identity.Attributes[k] = v
+		}
+		if len(resp.Destinations) > 0 {
+			res.identity.Attributes["AllowedDestinations"] = strings.Join(resp.Destinations, ",")
+		}
+	}
+	if ttl > 0 {
+		res.expires = time.Now().Add(ttl)
+		h.store(key, res)
+	}
+	return res.identity, res.err()
+}
+
+func (r *httpCredentialsResult) err() error {
+	if r.identity == nil {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+// Flush drops all cached results
+func (h *HTTPCredentials) Flush() {
+	h.mu.Lock()
+	h.cache = make(map[[sha256.Size]byte]*list.Element)
+	h.lru.Init()
+	h.mu.Unlock()
+}
+
+func (h *HTTPCredentials) cached(key [sha256.Size]byte) *httpCredentialsResult {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	elem, ok := h.cache[key]
+	if !ok {
+		return nil
+	}
+	res := elem.Value.(*httpCredentialsResult)
+	if time.Now().After(res.expires) {
+		h.remove(elem)
+		return nil
+	}
+	h.lru.MoveToFront(elem)
+	return res
+}
+
+func (h *HTTPCredentials) store(key [sha256.Size]byte, res *httpCredentialsResult) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if elem, ok := h.cache[key]; ok {
+		elem.Value = res
+		h.lru.MoveToFront(elem)
+		return
+	}
+	h.cache[key] = h.lru.PushFront(res)
+	for h.lru.Len() > maxHTTPCredentialsCacheSize {
+		h.remove(h.lru.Back())
+	}
+}
+
+func (h *HTTPCredentials) remove(elem *list.Element) {
+	h.lru.Remove(elem)
+	delete(h.cache, elem.Value.(*httpCredentialsResult).key)
+}
+
+func (h *HTTPCredentials) query(ctx context.Context, user, password string) (*httpCredentialsResponse, error) {
+	body, err := json.Marshal(&httpCredentialsRequest{Username: user, Password: password})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected HTTP status: %s", resp.Status)
+	}
+
+	var result httpCredentialsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("Unable to decode response: %v", err)
+	}
+	return &result, nil
+}
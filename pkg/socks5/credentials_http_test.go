@@ -0,0 +1,241 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fholzer/go-socks5/pkg/axe"
+)
+
+func newCredentialsServer(t *testing.T, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		var req httpCredentialsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp := httpCredentialsResponse{}
+		if req.Username == "foo" && req.Password == "bar" {
+			resp.Allow = true
+			resp.Groups = []string{"admins", "ops"}
+			resp.Destinations = []string{"10.0.0.0/8"}
+			resp.Attributes = map[string]string{"team": "infra"}
+		}
+		json.NewEncoder(w).Encode(&resp)
+	}))
+}
+
+func TestHTTPCredentials(t *testing.T) {
+	var calls int32
+	srv := newCredentialsServer(t, &calls)
+	defer srv.Close()
+
+	creds, err := NewHTTPCredentials(&HTTPCredentialsConfig{
+		URL:    srv.URL,
+		Logger: axe.New(),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	identity, err := creds.Verify(context.Background(), "foo", "bar")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if identity.Username != "foo" {
+		t.Fatalf("bad username: %v", identity)
+	}
+	if len(identity.Groups) != 2 || identity.Groups[0] != "admins" || identity.Groups[1] != "ops" {
+		t.Fatalf("bad groups: %v", identity)
+	}
+	if identity.Attributes["AllowedDestinations"] != "10.0.0.0/8" {
+		t.Fatalf("bad destinations: %v", identity)
+	}
+	if identity.Attributes["team"] != "infra" {
+		t.Fatalf("bad attributes: %v", identity)
+	}
+
+	if _, err := creds.Verify(context.Background(), "foo", "baz"); err != ErrInvalidCredentials {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Caching is disabled by default
+	creds.Valid("foo", "bar")
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Fatalf("expected 3 calls, got %d", n)
+	}
+}
+
+func TestHTTPCredentials_Cache(t *testing.T) {
+	var calls int32
+	srv := newCredentialsServer(t, &calls)
+	defer srv.Close()
+
+	creds, err := NewHTTPCredentials(&HTTPCredentialsConfig{
+		URL:              srv.URL,
+		CacheTTL:         time.Minute,
+		NegativeCacheTTL: 50 * time.Millisecond,
+		Logger:           axe.New(),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if !creds.Valid("foo", "bar") {
+			t.Fatalf("expect valid")
+		}
+		if creds.Valid("foo", "baz") {
+			t.Fatalf("expect invalid")
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("expected 2 calls, got %d", n)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	creds.Valid("foo", "baz")
+	creds.Valid("foo", "bar")
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Fatalf("expected 3 calls, got %d", n)
+	}
+
+	creds.Flush()
+	creds.Valid("foo", "bar")
+	if n := atomic.LoadInt32(&calls); n != 4 {
+		t.Fatalf("expected 4 calls, got %d", n)
+	}
+}
+
+func TestHTTPCredentials_CacheSize(t *testing.T) {
+	conf := &HTTPCredentialsConfig{URL: "http://127.0.0.1/"}
+	creds, err := NewHTTPCredentials(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if conf.Timeout != 0 || conf.Logger != nil {
+		t.Fatalf("config modified: %+v", conf)
+	}
+
+	// Results which haven't expired yet are evicted as well, least
+	// recently used first
+	expires := time.Now().Add(time.Hour)
+	key := func(i int) [sha256.Size]byte {
+		return sha256.Sum256([]byte(fmt.Sprintf("user\x00%d", i)))
+	}
+	for i := 0; i < maxHTTPCredentialsCacheSize+10; i++ {
+		creds.store(key(i), &httpCredentialsResult{key: key(i), expires: expires})
+		if i == maxHTTPCredentialsCacheSize-1 {
+			if creds.cached(key(0)) == nil {
+				t.Fatalf("expected cached result")
+			}
+		}
+	}
+	if n := len(creds.cache); n != maxHTTPCredentialsCacheSize || creds.lru.Len() != n {
+		t.Fatalf("expected %d cached results, got %d", maxHTTPCredentialsCacheSize, n)
+	}
+	if creds.cached(key(0)) == nil {
+		t.Fatalf("expected recently used result to be kept")
+	}
+	if creds.cached(key(1)) != nil {
+		t.Fatalf("expected least recently used result to be evicted")
+	}
+	if creds.cached(key(maxHTTPCredentialsCacheSize+9)) == nil {
+		t.Fatalf("expected latest result to be cached")
+	}
+}
+
+func TestHTTPCredentials_BackendError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	creds, err := NewHTTPCredentials(&HTTPCredentialsConfig{
+		URL:    srv.URL,
+		Logger: axe.New(),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	_, err = creds.Verify(context.Background(), "foo", "bar")
+	if _, ok := err.(*CredentialBackendError); !ok {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestPasswordAuth_Payload(t *testing.T) {
+	var calls int32
+	srv := newCredentialsServer(t, &calls)
+	defer srv.Close()
+
+	creds, err := NewHTTPCredentials(&HTTPCredentialsConfig{
+		URL:    srv.URL,
+		Logger: axe.New(),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{1, UserPassAuth})
+	req.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+	var resp bytes.Buffer
+
+	s, _ := New(&Config{AuthMethods: []Authenticator{UserPassAuthenticator{Credentials: creds}}})
+	ctx, err := s.authenticate(&resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if ctx.Payload["Username"] != "foo" {
+		t.Fatalf("bad username: %v", ctx.Payload)
+	}
+	if ctx.Payload["Groups"] != "admins,ops" {
+		t.Fatalf("bad groups: %v", ctx.Payload)
+	}
+	if ctx.Payload["team"] != "infra" {
+		t.Fatalf("bad attributes: %v", ctx.Payload)
+	}
+}
+
+func TestPasswordAuth_BackendError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	creds, err := NewHTTPCredentials(&HTTPCredentialsConfig{
+		URL:    srv.URL,
+		Logger: axe.New(),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{1, UserPassAuth})
+	req.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+	var resp bytes.Buffer
+
+	s, _ := New(&Config{Credentials: creds})
+	_, err = s.authenticate(&resp, req)
+	if outcome := AuthOutcomeOf(err); outcome != AuthOutcomeBackendError {
+		t.Fatalf("bad outcome: %v (%v)", outcome, err)
+	}
+
+	out := resp.Bytes()
+	if !bytes.Equal(out, []byte{socks5Version, UserPassAuth, 1, authFailure}) {
+		t.Fatalf("bad: %v", out)
+	}
+}
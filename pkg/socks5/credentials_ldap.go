@@ -0,0 +1,322 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/fholzer/go-socks5/pkg/axe"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	// DefaultLDAPUserFilter is used if LDAPCredentialsConfig.UserFilter is empty
+	DefaultLDAPUserFilter = "(uid=%s)"
+
+	// DefaultLDAPGroupAttribute is used if LDAPCredentialsConfig.GroupAttribute is empty
+	DefaultLDAPGroupAttribute = "memberOf"
+
+	// DefaultLDAPPoolSize is used if LDAPCredentialsConfig.PoolSize is zero
+	DefaultLDAPPoolSize = 4
+
+	// DefaultLDAPTimeout is used if LDAPCredentialsConfig.Timeout is zero
+	DefaultLDAPTimeout = 5 * time.Second
+)
+
+// LDAPCredentialsConfig is used to setup a LDAPCredentials store
+type LDAPCredentialsConfig struct {
+	// URL of the directory server, e.g. ldap://dc1.example.com:389
+	// or ldaps://dc1.example.com:636
+	URL string
+
+	// StartTLS upgrades a ldap:// connection to TLS before binding
+	StartTLS bool
+
+	// TLSConfig is used for ldaps:// and StartTLS connections
+	TLSConfig *tls.Config
+
+	// BindDN and BindPassword are used to search for the user's DN.
+	// If BindDN is empty, the search is done anonymously.
+	BindDN       string
+	BindPassword string
+
+	// BaseDN is the subtree in which users are searched
+	BaseDN string
+
+	// UserFilter is used to find a user's entry. %s is replaced by the
+	// escaped username. Defaults to DefaultLDAPUserFilter.
+	UserFilter string
+
+	// GroupAttribute is the attribute of the user's entry listing the
+	// DNs of the groups the user is a member of.
+	// Defaults to DefaultLDAPGroupAttribute.
+	GroupAttribute string
+
+	// RequiredGroups, if not empty, only permits users which are a member
+	// of at least one of these groups. Groups may be given as DN or CN.
+	RequiredGroups []string
+
+	// PoolSize is the maximum number of idle connections kept open.
+	// Defaults to DefaultLDAPPoolSize.
+	PoolSize int
+
+	// Timeout for connecting and for each LDAP operation.
+	// Defaults to DefaultLDAPTimeout.
+	Timeout time.Duration
+
+	// Logger can be used to provide a custom log target.
+	// Defaults to stdout.
+	Logger axe.Logger
+}
+
+// LDAPCredentials is a CredentialStore and CredentialVerifier which
+// validates credentials against a LDAP directory, e.g. Active Directory.
+// The user's entry is searched for, and the password is verified by binding
+// as the user's DN. The identity's groups are the CNs of the user's groups,
+// the user's DN is added to its attributes as "UserDN".
+type LDAPCredentials struct {
+	config *LDAPCredentialsConfig
+	pool   chan *ldap.Conn
+}
+
+// NewLDAPCredentials creates a new LDAPCredentials store
+func NewLDAPCredentials(conf *LDAPCredentialsConfig) (*LDAPCredentials, error) {
+	// Defaults are filled in on a copy, leaving the caller's config as is
+	copied := *conf
+	conf = &copied
+	if conf.URL == "" {
+		return nil, fmt.Errorf("URL must be specified")
+	}
+	if conf.BaseDN == "" {
+		return nil, fmt.Errorf("BaseDN must be specified")
+	}
+	if conf.UserFilter == "" {
+		conf.UserFilter = DefaultLDAPUserFilter
+	}
+	if conf.GroupAttribute == "" {
+		conf.GroupAttribute = DefaultLDAPGroupAttribute
+	}
+	if conf.PoolSize == 0 {
+		conf.PoolSize = DefaultLDAPPoolSize
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = DefaultLDAPTimeout
+	}
+	if conf.Logger == nil {
+		conf.Logger = axe.New()
+	}
+
+	return &LDAPCredentials{
+		config: conf,
+		pool:   make(chan *ldap.Conn, conf.PoolSize),
+	}, nil
+}
+
+func (l *LDAPCredentials) Valid(user, password string) bool {
+	_, err := l.Verify(context.Background(), user, password)
+	return err == nil
+}
+
+func (l *LDAPCredentials) Verify(ctx context.Context, user, password string) (*Identity, error) {
+	// An empty password would result in an unauthenticated bind,
+	// which most servers accept for any DN.
+	if user == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, &CredentialBackendError{err}
+	}
+
+	identity, err := l.authenticate(user, password)
+	if ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+		// Pooled connections may have been closed by the server
+		identity, err = l.authenticate(user, password)
+	}
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		l.config.Logger.Errorf("socks: LDAP authentication of %s failed: %v", user, err)
+		return nil, &CredentialBackendError{err}
+	}
+	if identity == nil {
+		return nil, ErrInvalidCredentials
+	}
+	return identity, nil
+}
+
+// Close closes all idle connections
+func (l *LDAPCredentials) Close() {
+	for {
+		select {
+		case conn := <-l.pool:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// authenticate returns the identity of an authenticated user, nil if the
+// user does not exist or is not permitted, or an error.
+func (l *LDAPCredentials) authenticate(user, password string) (*Identity, error) {
+	conn, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+	reusable := false
+	defer func() {
+		if reusable {
+			l.put(conn)
+		} else {
+			conn.Close()
+		}
+	}()
+
+	search := ldap.NewSearchRequest(
+		l.config.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(l.config.Timeout/time.Second), false,
+		fmt.Sprintf(l.config.UserFilter, ldap.EscapeFilter(user)),
+		[]string{"dn", l.config.GroupAttribute},
+		nil,
+	)
+	result, err := conn.Search(search)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Entries) != 1 {
+		reusable = true
+		if len(result.Entries) > 1 {
+			l.config.Logger.Warnf("socks: LDAP search for %s returned %d entries", user, len(result.Entries))
+		}
+		return nil, nil
+	}
+	entry := result.Entries[0]
+
+	groupDNs := entry.GetEqualFoldAttributeValues(l.config.GroupAttribute)
+	if !l.inRequiredGroup(groupDNs) {
+		reusable = true
+		return nil, nil
+	}
+
+	err = conn.Bind(entry.DN, password)
+	if err != nil {
+		// A failed bind leaves the connection anonymous, so it can only be
+		// reused after binding the service account again.
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			reusable = l.bindService(conn) == nil
+		}
+		return nil, err
+	}
+	reusable = l.bindService(conn) == nil
+
+	groups := make([]string, 0, len(groupDNs))
+	for _, dn := range groupDNs {
+		groups = append(groups, groupName(dn))
+	}
+	return &Identity{
+		Username:   user,
+		Groups:     groups,
+		Attributes: map[string]string{"UserDN": entry.DN},
+	}, nil
+}
+
+func (l *LDAPCredentials) inRequiredGroup(groupDNs []string) bool {
+	if len(l.config.RequiredGroups) == 0 {
+		return true
+	}
+	for _, dn := range groupDNs {
+		name := groupName(dn)
+		for _, required := range l.config.RequiredGroups {
+			if strings.EqualFold(required, dn) || strings.EqualFold(required, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// groupName returns the value of the first RDN of dn, e.g. "admins" for
+// "cn=admins,ou=groups,dc=example,dc=com"
+func groupName(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 || len(parsed.RDNs[0].Attributes) == 0 {
+		return dn
+	}
+	return parsed.RDNs[0].Attributes[0].Value
+}
+
+func (l *LDAPCredentials) get() (*ldap.Conn, error) {
+	for {
+		select {
+		case conn := <-l.pool:
+			if conn.IsClosing() {
+				conn.Close()
+				continue
+			}
+			return conn, nil
+		default:
+			return l.dial()
+		}
+	}
+}
+
+func (l *LDAPCredentials) put(conn *ldap.Conn) {
+	select {
+	case l.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (l *LDAPCredentials) dial() (*ldap.Conn, error) {
+	opts := []ldap.DialOpt{ldap.DialWithDialer(&net.Dialer{Timeout: l.config.Timeout})}
+	if l.config.TLSConfig != nil {
+		opts = append(opts, ldap.DialWithTLSConfig(l.config.TLSConfig))
+	}
+	conn, err := ldap.DialURL(l.config.URL, opts...)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(l.config.Timeout)
+
+	if l.config.StartTLS {
+		tlsConf := l.config.TLSConfig
+		if tlsConf == nil {
+			tlsConf = &tls.Config{}
+		}
+		if tlsConf.ServerName == "" {
+			tlsConf = tlsConf.Clone()
+			tlsConf.ServerName = hostFromURL(l.config.URL)
+		}
+		if err := conn.StartTLS(tlsConf); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("StartTLS failed: %v", err)
+		}
+	}
+
+	if err := l.bindService(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (l *LDAPCredentials) bindService(conn *ldap.Conn) error {
+	if l.config.BindDN == "" {
+		return conn.UnauthenticatedBind("")
+	}
+	return conn.Bind(l.config.BindDN, l.config.BindPassword)
+}
+
+func hostFromURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
@@ -0,0 +1,250 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fholzer/go-socks5/pkg/axe"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+type ldapUser struct {
+	dn       string
+	password string
+	groups   []string
+}
+
+// ldapStandIn is a minimal in-process LDAP server supporting simple bind
+// and equality searches on uid.
+type ldapStandIn struct {
+	listener net.Listener
+	users    map[string]*ldapUser
+
+	mu    sync.Mutex
+	binds int
+}
+
+func newLDAPStandIn(t *testing.T, users map[string]*ldapUser) *ldapStandIn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s := &ldapStandIn{listener: l, users: users}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *ldapStandIn) URL() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+func (s *ldapStandIn) Close() {
+	s.listener.Close()
+}
+
+func (s *ldapStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			s.mu.Lock()
+			s.binds++
+			s.mu.Unlock()
+			name := op.Children[1].Data.String()
+			password := op.Children[2].Data.String()
+			code := uint16(ldap.LDAPResultInvalidCredentials)
+			if name == "" && password == "" {
+				code = ldap.LDAPResultSuccess
+			}
+			for _, u := range s.users {
+				if u.dn == name && u.password == password {
+					code = ldap.LDAPResultSuccess
+				}
+			}
+			s.reply(conn, id, ldap.ApplicationBindResponse, code)
+
+		case ldap.ApplicationSearchRequest:
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			for uid, u := range s.users {
+				if !strings.EqualFold(filter, "(uid="+uid+")") {
+					continue
+				}
+				entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+				entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, u.dn, ""))
+				attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+				attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+				attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "memberOf", ""))
+				vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+				for _, g := range u.groups {
+					vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, g, ""))
+				}
+				attr.AppendChild(vals)
+				attrs.AppendChild(attr)
+				entry.AppendChild(attrs)
+				s.send(conn, id, entry)
+			}
+			s.reply(conn, id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)
+
+		default:
+			return
+		}
+	}
+}
+
+func (s *ldapStandIn) reply(conn net.Conn, id interface{}, tag ber.Tag, code uint16) {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	s.send(conn, id, op)
+}
+
+func (s *ldapStandIn) send(conn net.Conn, id interface{}, op *ber.Packet) {
+	msg := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	msg.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	msg.AppendChild(op)
+	conn.Write(msg.Bytes())
+}
+
+func newTestLDAPDirectory(t *testing.T) *ldapStandIn {
+	return newLDAPStandIn(t, map[string]*ldapUser{
+		"foo": {
+			dn:       "uid=foo,ou=people,dc=example,dc=com",
+			password: "bar",
+			groups:   []string{"cn=admins,ou=groups,dc=example,dc=com", "cn=ops,ou=groups,dc=example,dc=com"},
+		},
+		"baz": {
+			dn:       "uid=baz,ou=people,dc=example,dc=com",
+			password: "qux",
+		},
+	})
+}
+
+func TestLDAPCredentials(t *testing.T) {
+	srv := newTestLDAPDirectory(t)
+	defer srv.Close()
+
+	creds, err := NewLDAPCredentials(&LDAPCredentialsConfig{
+		URL:    srv.URL(),
+		BaseDN: "dc=example,dc=com",
+		Logger: axe.New(),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer creds.Close()
+
+	identity, err := creds.Verify(context.Background(), "foo", "bar")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(identity.Groups) != 2 || identity.Groups[0] != "admins" || identity.Groups[1] != "ops" {
+		t.Fatalf("bad groups: %v", identity)
+	}
+	if identity.Attributes["UserDN"] != "uid=foo,ou=people,dc=example,dc=com" {
+		t.Fatalf("bad dn: %v", identity)
+	}
+
+	if creds.Valid("foo", "baz") {
+		t.Fatalf("expect invalid password")
+	}
+	if creds.Valid("unknown", "bar") {
+		t.Fatalf("expect unknown user")
+	}
+	if creds.Valid("foo", "") {
+		t.Fatalf("expect empty password to be rejected")
+	}
+	if !creds.Valid("baz", "qux") {
+		t.Fatalf("expect valid")
+	}
+}
+
+func TestLDAPCredentials_RequiredGroups(t *testing.T) {
+	srv := newTestLDAPDirectory(t)
+	defer srv.Close()
+
+	creds, err := NewLDAPCredentials(&LDAPCredentialsConfig{
+		URL:            srv.URL(),
+		BaseDN:         "dc=example,dc=com",
+		RequiredGroups: []string{"ops"},
+		Logger:         axe.New(),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer creds.Close()
+
+	if !creds.Valid("foo", "bar") {
+		t.Fatalf("expect valid")
+	}
+	if creds.Valid("baz", "qux") {
+		t.Fatalf("expect user without group to be rejected")
+	}
+}
+
+func TestLDAPCredentials_Pool(t *testing.T) {
+	srv := newTestLDAPDirectory(t)
+	defer srv.Close()
+
+	creds, err := NewLDAPCredentials(&LDAPCredentialsConfig{
+		URL:          srv.URL(),
+		BaseDN:       "dc=example,dc=com",
+		BindDN:       "uid=baz,ou=people,dc=example,dc=com",
+		BindPassword: "qux",
+		PoolSize:     1,
+		Logger:       axe.New(),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer creds.Close()
+
+	for i := 0; i < 3; i++ {
+		if !creds.Valid("foo", "bar") {
+			t.Fatalf("expect valid")
+		}
+	}
+	if len(creds.pool) != 1 {
+		t.Fatalf("expected connection to be pooled")
+	}
+
+	// Initial service bind, then a user bind and service re-bind per login
+	srv.mu.Lock()
+	binds := srv.binds
+	srv.mu.Unlock()
+	if binds != 7 {
+		t.Fatalf("expected 7 binds, got %d", binds)
+	}
+}
+
+func TestLDAPCredentials_Defaults(t *testing.T) {
+	conf := &LDAPCredentialsConfig{URL: "ldap://127.0.0.1", BaseDN: "dc=example,dc=com"}
+	creds, err := NewLDAPCredentials(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if conf.UserFilter != "" || conf.PoolSize != 0 || conf.Timeout != 0 || conf.Logger != nil {
+		t.Fatalf("config modified: %+v", conf)
+	}
+	if creds.config.UserFilter != DefaultLDAPUserFilter || creds.config.PoolSize != DefaultLDAPPoolSize {
+		t.Fatalf("defaults not applied: %+v", creds.config)
+	}
+}
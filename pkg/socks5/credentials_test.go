@@ -1,6 +1,7 @@
 package socks5
 
 import (
+	"context"
 	"testing"
 )
 
@@ -22,3 +23,19 @@ func TestStaticCredentials(t *testing.T) {
 		t.Fatalf("expect invalid")
 	}
 }
+
+func TestCredentialStoreVerifier(t *testing.T) {
+	v := CredentialStoreVerifier{StaticCredentials{"foo": "bar"}}
+
+	identity, err := v.Verify(context.Background(), "foo", "bar")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if identity.Username != "foo" {
+		t.Fatalf("bad username: %v", identity.Username)
+	}
+
+	if _, err := v.Verify(context.Background(), "foo", "baz"); err != ErrInvalidCredentials {
+		t.Fatalf("err: %v", err)
+	}
+}
@@ -7,6 +7,10 @@ import (
 	"github.com/fholzer/go-socks5/pkg/axe"
 )
 
+// Finalizer is called once the server is done with a connection. This
+// includes connections which failed to authenticate or sent a request
+// which couldn't be read, in which case request.DestAddr is nil and
+// request.Err tells why.
 type Finalizer interface {
 	Finalize(request *Request, conn net.Conn, ctx context.Context) error
 }
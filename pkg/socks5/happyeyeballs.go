@@ -0,0 +1,255 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultHappyEyeballsDelay is used if HappyEyeballsDialer.Delay is zero.
+	// RFC 8305 recommends 250ms.
+	DefaultHappyEyeballsDelay = 250 * time.Millisecond
+)
+
+// AddressFamily controls which addresses of a name are used, and in
+// which order they are tried
+type AddressFamily int
+
+const (
+	// PreferIPv6 tries IPv6 addresses first, as recommended by RFC 8305
+	PreferIPv6 AddressFamily = iota
+	// PreferIPv4 tries IPv4 addresses first
+	PreferIPv4
+	// IPv4Only ignores IPv6 addresses
+	IPv4Only
+	// IPv6Only ignores IPv4 addresses
+	IPv6Only
+)
+
+var addressFamilyNames = map[AddressFamily]string{
+	PreferIPv6: "prefer_ipv6",
+	PreferIPv4: "prefer_ipv4",
+	IPv4Only:   "ipv4_only",
+	IPv6Only:   "ipv6_only",
+}
+
+func (f AddressFamily) String() string {
+	if name, ok := addressFamilyNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("AddressFamily(%d)", int(f))
+}
+
+// ParseAddressFamily parses the names returned by AddressFamily.String.
+// An empty string yields PreferIPv6.
+func ParseAddressFamily(s string) (AddressFamily, error) {
+	if s == "" {
+		return PreferIPv6, nil
+	}
+	for f, name := range addressFamilyNames {
+		if strings.EqualFold(s, name) {
+			return f, nil
+		}
+	}
+	return PreferIPv6, fmt.Errorf("Unknown address family: %s", s)
+}
+
+// Sort returns the addresses to be tried, in order. Addresses of a
+// disabled family are dropped, the remaining ones are interleaved
+// starting with the preferred family (RFC 8305 section 4). The order
+// within each family is retained.
+func (f AddressFamily) Sort(ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	first, second := v6, v4
+	switch f {
+	case PreferIPv4:
+		first, second = v4, v6
+	case IPv4Only:
+		first, second = v4, nil
+	case IPv6Only:
+		first, second = v6, nil
+	}
+
+	sorted := make([]net.IP, 0, len(first)+len(second))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+	return sorted
+}
+
+// HappyEyeballsDialer connects to the first reachable address of a
+// destination. Connection attempts are started one after another,
+// Delay apart, and a failed attempt immediately starts the next one.
+// The first established connection wins, all others are abandoned.
+//
+// If the context carries the addresses a request's destination resolved
+// to (see WithDestinationIPs), and the address being dialed is one of
+// them, all of them are tried. If all attempts fail, a refused connection
+// is reported in favour of other errors, as it shows the destination was
+// reachable.
+type HappyEyeballsDialer struct {
+	// Dialer is used for the individual connection attempts.
+	// Defaults to a zero net.Dialer.
+	Dialer *net.Dialer
+
+	// Delay between two connection attempts.
+	// Defaults to DefaultHappyEyeballsDelay.
+	Delay time.Duration
+
+	// Family is applied to the addresses of names resolved by the dialer.
+	Family AddressFamily
+
+	// Resolver resolves names passed to the dialer.
+	// Defaults to the system resolver.
+	Resolver NameResolver
+}
+
+// DialContext has the signature of Config.Dial
+func (d *HappyEyeballsDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+		if candidates, ok := DestinationIPsFromContext(ctx); ok && containsIP(candidates, ip) {
+			ips = candidates
+		}
+	} else {
+		ips, err = d.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		ips = d.Family.Sort(ips)
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("No %v address found for %s", d.Family, host)
+		}
+	}
+
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip.String(), port)
+	}
+	return d.dialParallel(ctx, network, addrs)
+}
+
+func (d *HappyEyeballsDialer) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if d.Resolver != nil {
+		_, ips, err := resolveAll(ctx, d.Resolver, host)
+		return ips, err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips, nil
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+func (d *HappyEyeballsDialer) dialParallel(ctx context.Context, network string, addrs []string) (net.Conn, error) {
+	dialer := d.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	if len(addrs) == 1 {
+		return dialer.DialContext(ctx, network, addrs[0])
+	}
+	delay := d.Delay
+	if delay <= 0 {
+		delay = DefaultHappyEyeballsDelay
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult)
+	next, pending := 0, 0
+	start := func() {
+		go func(addr string) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			results <- dialResult{conn, err}
+		}(addrs[next])
+		next++
+		pending++
+	}
+
+	var dialErr error
+	start()
+	for pending > 0 {
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if next < len(addrs) {
+			timer = time.NewTimer(delay)
+			timeout = timer.C
+		}
+
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if timer != nil {
+					timer.Stop()
+				}
+				// Close connections of attempts still in progress
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if res := <-results; res.conn != nil {
+							res.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			// Keep a refusal, otherwise report the last error
+			if dialErr == nil || !errors.Is(dialErr, syscall.ECONNREFUSED) {
+				dialErr = res.err
+			}
+			if next < len(addrs) {
+				start()
+			}
+		case <-timeout:
+			start()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	return nil, dialErr
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, candidate := range ips {
+		if candidate.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,201 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func parseIPs(addrs ...string) []net.IP {
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = net.ParseIP(addr)
+	}
+	return ips
+}
+
+func TestAddressFamily_Sort(t *testing.T) {
+	ips := parseIPs("192.0.2.1", "192.0.2.2", "2001:db8::1", "192.0.2.3", "2001:db8::2")
+
+	cases := []struct {
+		family AddressFamily
+		expect []net.IP
+	}{
+		{PreferIPv6, parseIPs("2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3")},
+		{PreferIPv4, parseIPs("192.0.2.1", "2001:db8::1", "192.0.2.2", "2001:db8::2", "192.0.2.3")},
+		{IPv4Only, parseIPs("192.0.2.1", "192.0.2.2", "192.0.2.3")},
+		{IPv6Only, parseIPs("2001:db8::1", "2001:db8::2")},
+	}
+	for _, c := range cases {
+		sorted := c.family.Sort(ips)
+		if len(sorted) != len(c.expect) {
+			t.Fatalf("%v: bad: %v", c.family, sorted)
+		}
+		for i := range sorted {
+			if !sorted[i].Equal(c.expect[i]) {
+				t.Fatalf("%v: bad: %v", c.family, sorted)
+			}
+		}
+	}
+}
+
+func TestParseAddressFamily(t *testing.T) {
+	for _, f := range []AddressFamily{PreferIPv6, PreferIPv4, IPv4Only, IPv6Only} {
+		parsed, err := ParseAddressFamily(f.String())
+		if err != nil || parsed != f {
+			t.Fatalf("bad: %v %v", parsed, err)
+		}
+	}
+	if f, err := ParseAddressFamily(""); err != nil || f != PreferIPv6 {
+		t.Fatalf("bad default: %v %v", f, err)
+	}
+	if _, err := ParseAddressFamily("ipv5"); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestHappyEyeballsDialer_Failover(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	// Nothing listens on 127.0.0.2, connections are refused
+	ctx := WithDestinationIPs(context.Background(), parseIPs("127.0.0.2", "127.0.0.1"))
+	d := &HappyEyeballsDialer{Delay: time.Second}
+
+	start := time.Now()
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort("127.0.0.2", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if remote := conn.RemoteAddr().(*net.TCPAddr); !remote.IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("bad remote: %v", remote)
+	}
+	// A refused attempt starts the next one without waiting for Delay
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("expected immediate failover, took %v", elapsed)
+	}
+}
+
+func TestHappyEyeballsDialer_AllFail(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+
+	ctx := WithDestinationIPs(context.Background(), parseIPs("127.0.0.1", "127.0.0.2", "127.0.0.3"))
+	d := &HappyEyeballsDialer{Delay: 10 * time.Millisecond}
+	if _, err := d.DialContext(ctx, "tcp", net.JoinHostPort("127.0.0.1", port)); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestHappyEyeballsDialer_IgnoresUnrelatedIPs(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+
+	// The destination was rewritten to an address not in the list, so
+	// only that address is tried
+	ctx := WithDestinationIPs(context.Background(), parseIPs("127.0.0.1"))
+	d := &HappyEyeballsDialer{Delay: 10 * time.Millisecond}
+	if _, err := d.DialContext(ctx, "tcp", net.JoinHostPort("127.0.0.2", port)); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+// multiResolver resolves all names to the same addresses
+type multiResolver []net.IP
+
+func (r multiResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, r[0], nil
+}
+
+func (r multiResolver) ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	return ctx, r, nil
+}
+
+// unreachableIPv6 fails connection attempts to IPv6 addresses as if there
+// was no route, and records all attempts
+func unreachableIPv6(attempts chan<- string) *net.Dialer {
+	return &net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+		attempts <- address
+		if host, _, _ := net.SplitHostPort(address); net.ParseIP(host).To4() == nil {
+			return syscall.ENETUNREACH
+		}
+		return nil
+	}}
+}
+
+func TestHappyEyeballsDialer_Resolver(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+
+	attempts := make(chan string, 4)
+	d := &HappyEyeballsDialer{
+		Dialer:   unreachableIPv6(attempts),
+		Family:   IPv4Only,
+		Resolver: multiResolver(parseIPs("2001:db8::1", "127.0.0.1")),
+	}
+	conn, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("dest.example.com", port))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+	if len(attempts) != 1 {
+		t.Fatalf("expected only the IPv4 address to be tried, got %d attempts", len(attempts))
+	}
+}
+
+func TestHappyEyeballsDialer_PrefersRefusal(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+
+	// The refusal is reported whether IPv4 is tried first or last
+	for _, family := range []AddressFamily{PreferIPv6, PreferIPv4} {
+		attempts := make(chan string, 4)
+		d := &HappyEyeballsDialer{
+			Dialer:   unreachableIPv6(attempts),
+			Delay:    10 * time.Millisecond,
+			Family:   family,
+			Resolver: multiResolver(parseIPs("2001:db8::1", "127.0.0.1")),
+		}
+		_, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("dest.example.com", port))
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Fatalf("%v: expected connection refused, got %v", family, err)
+		}
+		if len(attempts) != 2 {
+			t.Fatalf("%v: expected 2 attempts, got %d", family, len(attempts))
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Observer is notified as a connection passes through each stage of the
+// pipeline, e.g. to collect metrics, trace or audit requests. All
+// callbacks of a connection get the same Request, which is filled in as
+// the stages progress, and are called from the goroutine serving it.
+//
+// Observers keep per connection state in the context returned by
+// OnAccept. The context passed to later callbacks is derived from it.
+// Embed NopObserver to implement only some of the callbacks.
+type Observer interface {
+	// OnAccept is called when the server starts serving conn
+	OnAccept(ctx context.Context, req *Request, conn net.Conn) context.Context
+
+	// OnVersion is called after the version byte was read
+	OnVersion(ctx context.Context, req *Request, version uint8, err error)
+
+	// OnAuthMethod is called with the authentication method chosen, or
+	// with 0xFF if the client offered no supported method
+	OnAuthMethod(ctx context.Context, req *Request, method uint8)
+
+	// OnAuth is called with the result of authentication, which
+	// started at start
+	OnAuth(ctx context.Context, req *Request, start time.Time, outcome AuthOutcome, err error)
+
+	// OnRequest is called after the command and destination were read
+	OnRequest(ctx context.Context, req *Request, err error)
+
+	// OnResolve is called after the destination was looked up. The
+	// addresses found are available using DestinationIPsFromContext.
+	OnResolve(ctx context.Context, req *Request, start time.Time, err error)
+
+	// OnRewrite is called after the AddressRewriter was applied, see
+	// Request.RealDestAddr
+	OnRewrite(ctx context.Context, req *Request, start time.Time)
+
+	// OnRule is called with the decision of the RuleSet
+	OnRule(ctx context.Context, req *Request, start time.Time, allowed bool)
+
+	// OnPick is called after the Picker chose how to dial the destination
+	OnPick(ctx context.Context, req *Request, start time.Time)
+
+	// OnDial is called after dialing the destination
+	OnDial(ctx context.Context, req *Request, start time.Time, addr string, err error)
+
+	// OnReply is called after a reply was sent to the client
+	OnReply(ctx context.Context, req *Request, reply uint8, err error)
+
+	// OnClose is called when the server is done with the connection,
+	// with the error serving it failed with, if any
+	OnClose(ctx context.Context, req *Request, err error)
+}
+
+// NopObserver implements Observer, ignoring all callbacks
+type NopObserver struct{}
+
+func (NopObserver) OnAccept(ctx context.Context, req *Request, conn net.Conn) context.Context {
+	return ctx
+}
+
+func (NopObserver) OnVersion(ctx context.Context, req *Request, version uint8, err error) {}
+
+func (NopObserver) OnAuthMethod(ctx context.Context, req *Request, method uint8) {}
+
+func (NopObserver) OnAuth(ctx context.Context, req *Request, start time.Time, outcome AuthOutcome, err error) {
+}
+
+func (NopObserver) OnRequest(ctx context.Context, req *Request, err error) {}
+
+func (NopObserver) OnResolve(ctx context.Context, req *Request, start time.Time, err error) {}
+
+func (NopObserver) OnRewrite(ctx context.Context, req *Request, start time.Time) {}
+
+func (NopObserver) OnRule(ctx context.Context, req *Request, start time.Time, allowed bool) {}
+
+func (NopObserver) OnPick(ctx context.Context, req *Request, start time.Time) {}
+
+func (NopObserver) OnDial(ctx context.Context, req *Request, start time.Time, addr string, err error) {
+}
+
+func (NopObserver) OnReply(ctx context.Context, req *Request, reply uint8, err error) {}
+
+func (NopObserver) OnClose(ctx context.Context, req *Request, err error) {}
+
+// observers notifies each Observer in turn
+type observers []Observer
+
+func (o observers) OnAccept(ctx context.Context, req *Request, conn net.Conn) context.Context {
+	for _, observer := range o {
+		ctx = observer.OnAccept(ctx, req, conn)
+	}
+	return ctx
+}
+
+func (o observers) OnVersion(ctx context.Context, req *Request, version uint8, err error) {
+	for _, observer := range o {
+		observer.OnVersion(ctx, req, version, err)
+	}
+}
+
+func (o observers) OnAuthMethod(ctx context.Context, req *Request, method uint8) {
+	for _, observer := range o {
+		observer.OnAuthMethod(ctx, req, method)
+	}
+}
+
+func (o observers) OnAuth(ctx context.Context, req *Request, start time.Time, outcome AuthOutcome, err error) {
+	for _, observer := range o {
+		observer.OnAuth(ctx, req, start, outcome, err)
+	}
+}
+
+func (o observers) OnRequest(ctx context.Context, req *Request, err error) {
+	for _, observer := range o {
+		observer.OnRequest(ctx, req, err)
+	}
+}
+
+func (o observers) OnResolve(ctx context.Context, req *Request, start time.Time, err error) {
+	for _, observer := range o {
+		observer.OnResolve(ctx, req, start, err)
+	}
+}
+
+func (o observers) OnRewrite(ctx context.Context, req *Request, start time.Time) {
+	for _, observer := range o {
+		observer.OnRewrite(ctx, req, start)
+	}
+}
+
+func (o observers) OnRule(ctx context.Context, req *Request, start time.Time, allowed bool) {
+	for _, observer := range o {
+		observer.OnRule(ctx, req, start, allowed)
+	}
+}
+
+func (o observers) OnPick(ctx context.Context, req *Request, start time.Time) {
+	for _, observer := range o {
+		observer.OnPick(ctx, req, start)
+	}
+}
+
+func (o observers) OnDial(ctx context.Context, req *Request, start time.Time, addr string, err error) {
+	for _, observer := range o {
+		observer.OnDial(ctx, req, start, addr, err)
+	}
+}
+
+func (o observers) OnReply(ctx context.Context, req *Request, reply uint8, err error) {
+	for _, observer := range o {
+		observer.OnReply(ctx, req, reply, err)
+	}
+}
+
+func (o observers) OnClose(ctx context.Context, req *Request, err error) {
+	for _, observer := range o {
+		observer.OnClose(ctx, req, err)
+	}
+}
@@ -0,0 +1,141 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recordingObserver records the stages a connection passes through
+type recordingObserver struct {
+	NopObserver
+	name   string
+	events chan string
+}
+
+func (o *recordingObserver) record(ctx context.Context, event string) {
+	if ctx.Value(o) != o.name {
+		event += " (missing context)"
+	}
+	o.events <- event
+}
+
+func (o *recordingObserver) OnAccept(ctx context.Context, req *Request, conn net.Conn) context.Context {
+	ctx = context.WithValue(ctx, o, o.name)
+	o.record(ctx, "accept")
+	return ctx
+}
+
+func (o *recordingObserver) OnVersion(ctx context.Context, req *Request, version uint8, err error) {
+	o.record(ctx, fmt.Sprintf("version %d", version))
+}
+
+func (o *recordingObserver) OnAuthMethod(ctx context.Context, req *Request, method uint8) {
+	o.record(ctx, fmt.Sprintf("auth method %d", method))
+}
+
+func (o *recordingObserver) OnAuth(ctx context.Context, req *Request, start time.Time, outcome AuthOutcome, err error) {
+	o.record(ctx, "auth "+outcome.String())
+}
+
+func (o *recordingObserver) OnRequest(ctx context.Context, req *Request, err error) {
+	o.record(ctx, fmt.Sprintf("request %d %v", req.Command, req.DestAddr))
+}
+
+func (o *recordingObserver) OnResolve(ctx context.Context, req *Request, start time.Time, err error) {
+	o.record(ctx, fmt.Sprintf("resolve %v", req.DestAddr.IP))
+}
+
+func (o *recordingObserver) OnRule(ctx context.Context, req *Request, start time.Time, allowed bool) {
+	o.record(ctx, fmt.Sprintf("rule %v", allowed))
+}
+
+func (o *recordingObserver) OnReply(ctx context.Context, req *Request, reply uint8, err error) {
+	o.record(ctx, fmt.Sprintf("reply %d", reply))
+}
+
+func (o *recordingObserver) OnClose(ctx context.Context, req *Request, err error) {
+	o.record(ctx, "close")
+	close(o.events)
+}
+
+func (o *recordingObserver) collect(t *testing.T) []string {
+	var events []string
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event, ok := <-o.events:
+			if !ok {
+				return events
+			}
+			events = append(events, event)
+		case <-timeout:
+			t.Fatalf("connection not closed, got %v", events)
+		}
+	}
+}
+
+func TestObserver(t *testing.T) {
+	first := &recordingObserver{name: "first", events: make(chan string, 32)}
+	second := &recordingObserver{name: "second", events: make(chan string, 32)}
+	addr, stop := startServer(t, &Config{
+		Resolver:    staticResolver{net.ParseIP("192.0.2.1")},
+		LazyResolve: true,
+		Observers:   []Observer{first, second},
+	})
+	defer stop()
+
+	c := &Client{Address: addr}
+	if _, err := c.Resolve(context.Background(), "foo.example.com"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expected := []string{
+		"accept",
+		"version 5",
+		"auth method 0",
+		"auth success",
+		"request 240 foo.example.com:0",
+		"rule true",
+		"resolve 192.0.2.1",
+		"reply 0",
+		"close",
+	}
+	if events := first.collect(t); !reflect.DeepEqual(events, expected) {
+		t.Fatalf("bad events: %v", events)
+	}
+	if events := second.collect(t); !reflect.DeepEqual(events, expected) {
+		t.Fatalf("bad events: %v", events)
+	}
+}
+
+func TestObserver_Blocked(t *testing.T) {
+	o := &recordingObserver{name: "observer", events: make(chan string, 32)}
+	addr, stop := startServer(t, &Config{
+		Rules:     PermitNone(),
+		Observers: []Observer{o},
+	})
+	defer stop()
+
+	c := &Client{Address: addr}
+	if _, err := c.DialContext(context.Background(), "tcp", "192.0.2.1:80"); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	expected := []string{
+		"accept",
+		"version 5",
+		"auth method 0",
+		"auth success",
+		"request 1 192.0.2.1:80",
+		"rule false",
+		"reply 2",
+		"close",
+	}
+	if events := o.collect(t); !reflect.DeepEqual(events, expected) {
+		t.Fatalf("bad events: %v", events)
+	}
+}
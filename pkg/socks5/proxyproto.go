@@ -0,0 +1,414 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultProxyHeaderTimeout is the time allowed for reading a PROXY
+// protocol header, unless ProxyProtocolListener.Timeout is set
+const DefaultProxyHeaderTimeout = 5 * time.Second
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	// Longest v1 header, including CRLF
+	proxyV1MaxLength = 107
+
+	proxyV2CommandLocal = 0x0
+	proxyV2CommandProxy = 0x1
+
+	proxyV2FamilyInet  = 0x1
+	proxyV2FamilyInet6 = 0x2
+)
+
+// ProxyProtocolListener accepts connections passed on by load balancers
+// using the PROXY protocol, versions 1 and 2. Connections from trusted
+// sources must start with a PROXY header. RemoteAddr and LocalAddr of the
+// connections returned by Accept report the addresses conveyed in it.
+// Connections from other sources are returned as they are.
+//
+// Headers are read when the connection is first used, so slow clients
+// don't hold up Accept.
+type ProxyProtocolListener struct {
+	net.Listener
+
+	// Trusted networks PROXY headers are accepted from
+	Trusted []net.IPNet
+
+	// Timeout for reading the header.
+	// Defaults to DefaultProxyHeaderTimeout.
+	Timeout time.Duration
+}
+
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	timeout := l.Timeout
+	if timeout == 0 {
+		timeout = DefaultProxyHeaderTimeout
+	}
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn), timeout: timeout}, nil
+}
+
+func (l *ProxyProtocolListener) trusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range l.Trusted {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtocolConn reads the PROXY header on first use
+type proxyProtocolConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.remoteAddr, c.localAddr, c.err = readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.err = fmt.Errorf("Failed to read PROXY header from %v: %w", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remoteAddr
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.localAddr == nil {
+		return c.Conn.LocalAddr()
+	}
+	return c.localAddr
+}
+
+// CloseWrite closes the writing side of the underlying connection, if it
+// supports that, see Relay
+func (c *proxyProtocolConn) CloseWrite() error {
+	if conn, ok := c.Conn.(closeWriter); ok {
+		return conn.CloseWrite()
+	}
+	return nil
+}
+
+// readProxyHeader reads a PROXY header of either version. Nil addresses
+// are returned if the header doesn't convey any, e.g. for health checks.
+func readProxyHeader(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	// The first byte tells the versions apart, so clients not sending a
+	// header are refused without waiting for more
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	var prefix []byte
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		prefix = proxyV1Prefix
+	case proxyV2Signature[0]:
+		prefix = proxyV2Signature
+	default:
+		return nil, nil, fmt.Errorf("Missing PROXY header")
+	}
+	peeked, err := r.Peek(len(prefix))
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(peeked, prefix) {
+		return nil, nil, fmt.Errorf("Missing PROXY header")
+	}
+	if prefix[0] == proxyV1Prefix[0] {
+		return readProxyHeaderV1(r)
+	}
+	return readProxyHeaderV2(r)
+}
+
+// readProxyHeaderV1 reads a header of the form
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("Invalid PROXY v1 header")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("Invalid PROXY v1 header %q", line)
+	}
+	src, err := parseProxyV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseProxyV1Addr(protocol, host, portStr string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || strings.Contains(host, ":") != (protocol == "TCP6") {
+		return nil, fmt.Errorf("Invalid PROXY v1 address %s", host)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("Invalid PROXY v1 port %s", portStr)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyHeaderV2 reads a binary header. TLVs following the addresses
+// are skipped. Addresses are returned as TCP addresses regardless of the
+// transport protocol given.
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	versionCommand, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:]))
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+
+	if versionCommand>>4 != 2 {
+		return nil, nil, fmt.Errorf("Unsupported PROXY version: %v", versionCommand>>4)
+	}
+	switch versionCommand & 0xF {
+	case proxyV2CommandLocal:
+		return nil, nil, nil
+	case proxyV2CommandProxy:
+	default:
+		return nil, nil, fmt.Errorf("Unsupported PROXY v2 command: %v", versionCommand&0xF)
+	}
+
+	var size int
+	switch family >> 4 {
+	case proxyV2FamilyInet:
+		size = net.IPv4len
+	case proxyV2FamilyInet6:
+		size = net.IPv6len
+	default:
+		// Unix socket and unspecified addresses don't identify a client
+		return nil, nil, nil
+	}
+	if len(payload) < 2*size+4 {
+		return nil, nil, fmt.Errorf("PROXY v2 header too short")
+	}
+	srcIP := net.IP(append([]byte(nil), payload[:size]...))
+	dstIP := net.IP(append([]byte(nil), payload[size:2*size]...))
+	srcPort := int(binary.BigEndian.Uint16(payload[2*size:]))
+	dstPort := int(binary.BigEndian.Uint16(payload[2*size+2:]))
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}, nil
+}
+
+// ProxyTLVUsername is the TLV type ProxyHeaderDialer uses for the
+// username by default. It is the first of the types reserved for
+// applications.
+const ProxyTLVUsername = 0xE0
+
+// ProxyTLV is a type-length-value field of a PROXY v2 header
+type ProxyTLV struct {
+	Type  uint8
+	Value []byte
+}
+
+// WriteProxyHeader writes a PROXY protocol header of version 1 or 2,
+// conveying a connection from src to dst. If either address isn't a TCP
+// address, the header says the addresses are unknown. TLVs are only
+// written by version 2.
+func WriteProxyHeader(w io.Writer, version int, src, dst net.Addr, tlvs []ProxyTLV) error {
+	srcAddr, _ := src.(*net.TCPAddr)
+	dstAddr, _ := dst.(*net.TCPAddr)
+	var header []byte
+	switch version {
+	case 1:
+		header = proxyHeaderV1(srcAddr, dstAddr)
+	case 2:
+		var err error
+		if header, err = proxyHeaderV2(srcAddr, dstAddr, tlvs); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Unsupported PROXY version: %v", version)
+	}
+	_, err := w.Write(header)
+	return err
+}
+
+// proxyAddrs returns the addresses of src and dst of equal length, mapping
+// IPv4 to IPv6 addresses if their families differ
+func proxyAddrs(src, dst *net.TCPAddr) (net.IP, net.IP) {
+	if src == nil || dst == nil {
+		return nil, nil
+	}
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if srcIP == nil || dstIP == nil {
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+	return srcIP, dstIP
+}
+
+func proxyHeaderV1(src, dst *net.TCPAddr) []byte {
+	srcIP, dstIP := proxyAddrs(src, dst)
+	if srcIP == nil || dstIP == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	protocol := "TCP4"
+	format := func(ip net.IP) string { return ip.String() }
+	if len(srcIP) == net.IPv6len {
+		protocol = "TCP6"
+		format = func(ip net.IP) string {
+			// String prints mapped IPv4 addresses in dotted form
+			if ip4 := ip.To4(); ip4 != nil {
+				return "::ffff:" + ip4.String()
+			}
+			return ip.String()
+		}
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", protocol, format(srcIP), format(dstIP), src.Port, dst.Port))
+}
+
+func proxyHeaderV2(src, dst *net.TCPAddr, tlvs []ProxyTLV) ([]byte, error) {
+	var payload []byte
+	family := byte(0)
+	if srcIP, dstIP := proxyAddrs(src, dst); srcIP != nil && dstIP != nil {
+		family = proxyV2FamilyInet<<4 | 0x1
+		if len(srcIP) == net.IPv6len {
+			family = proxyV2FamilyInet6<<4 | 0x1
+		}
+		payload = append(payload, srcIP...)
+		payload = append(payload, dstIP...)
+		payload = append(payload, byte(src.Port>>8), byte(src.Port), byte(dst.Port>>8), byte(dst.Port))
+	}
+	for _, tlv := range tlvs {
+		if len(tlv.Value) > 0xFFFF {
+			return nil, fmt.Errorf("PROXY TLV %#x too long", tlv.Type)
+		}
+		payload = append(payload, tlv.Type, byte(len(tlv.Value)>>8), byte(len(tlv.Value)))
+		payload = append(payload, tlv.Value...)
+	}
+	if len(payload) > 0xFFFF {
+		return nil, fmt.Errorf("PROXY header too long")
+	}
+
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, 0x20|proxyV2CommandProxy, family, byte(len(payload)>>8), byte(len(payload)))
+	return append(header, payload...), nil
+}
+
+// ProxyHeaderDialer sends a PROXY protocol header on each connection it
+// dials, conveying the address of the client, see ClientAddrFromContext.
+// The destination is the address dialed if it is an IP address, and the
+// remote address of the connection otherwise.
+type ProxyHeaderDialer struct {
+	// Dial is used to connect.
+	// Defaults to HappyEyeballsDialer.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Version of the PROXY protocol, 1 or 2.
+	// Defaults to 1.
+	Version int
+
+	// UsernameTLV is the type of the TLV the username of authenticated
+	// clients is sent in, see AuthContextFromContext. Zero sends no
+	// username. Requires version 2.
+	UsernameTLV uint8
+}
+
+func (d *ProxyHeaderDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	version := d.Version
+	if version == 0 {
+		version = 1
+	}
+	dial := d.Dial
+	if dial == nil {
+		dial = (&HappyEyeballsDialer{}).DialContext
+	}
+
+	conn, err := dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	src, _ := ClientAddrFromContext(ctx)
+	dst := conn.RemoteAddr()
+	if host, portStr, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			port, _ := strconv.Atoi(portStr)
+			dst = &net.TCPAddr{IP: ip, Port: port}
+		}
+	}
+	var tlvs []ProxyTLV
+	if authContext, ok := AuthContextFromContext(ctx); ok && d.UsernameTLV != 0 {
+		if username := authContext.Payload["Username"]; username != "" {
+			tlvs = append(tlvs, ProxyTLV{Type: d.UsernameTLV, Value: []byte(username)})
+		}
+	}
+
+	if err := WriteProxyHeader(conn, version, src, dst, tlvs); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to send PROXY header: %w", err)
+	}
+	return conn, nil
+}
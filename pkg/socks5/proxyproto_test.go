@@ -0,0 +1,232 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(command, family byte, addrs ...byte) []byte {
+		b := append([]byte(nil), proxyV2Signature...)
+		b = append(b, 0x20|command, family, 0, byte(len(addrs)))
+		return append(b, addrs...)
+	}
+	cases := []struct {
+		header string
+		src    string
+		dst    string
+		err    bool
+	}{
+		{header: "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n", src: "192.0.2.1:56324", dst: "192.0.2.2:443"},
+		{header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", src: "[2001:db8::1]:56324", dst: "[2001:db8::2]:443"},
+		{header: "PROXY UNKNOWN\r\n"},
+		{header: "PROXY TCP4 2001:db8::1 192.0.2.2 56324 443\r\n", err: true},
+		{header: "PROXY TCP4 192.0.2.1 192.0.2.2 56324\r\n", err: true},
+		{header: "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\n", err: true},
+		{header: "PROXY " + strings.Repeat("x", 110), err: true},
+		{header: "\x05\x01\x00", err: true},
+		{
+			header: string(v2(proxyV2CommandProxy, 0x11, 192, 0, 2, 1, 192, 0, 2, 2, 0xDC, 0x04, 0x01, 0xBB)),
+			src:    "192.0.2.1:56324",
+			dst:    "192.0.2.2:443",
+		},
+		{
+			// With a trailing TLV
+			header: string(v2(proxyV2CommandProxy, 0x11, 192, 0, 2, 1, 192, 0, 2, 2, 0xDC, 0x04, 0x01, 0xBB, 0x04, 0x00, 0x01, 0x00)),
+			src:    "192.0.2.1:56324",
+			dst:    "192.0.2.2:443",
+		},
+		{header: string(v2(proxyV2CommandLocal, 0x00))},
+		{header: string(v2(proxyV2CommandProxy, 0x11, 192, 0, 2, 1)), err: true},
+		{header: string(v2(0x2, 0x11)), err: true},
+	}
+	for _, c := range cases {
+		r := bufio.NewReader(strings.NewReader(c.header + "rest"))
+		src, dst, err := readProxyHeader(r)
+		if (err != nil) != c.err {
+			t.Fatalf("%q: unexpected error %v", c.header, err)
+		}
+		if err != nil {
+			continue
+		}
+		if (src == nil && c.src != "") || (src != nil && src.String() != c.src) {
+			t.Fatalf("%q: bad source %v", c.header, src)
+		}
+		if (dst == nil && c.dst != "") || (dst != nil && dst.String() != c.dst) {
+			t.Fatalf("%q: bad destination %v", c.header, dst)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "rest" {
+			t.Fatalf("%q: bad rest %q", c.header, rest)
+		}
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	remoteAddrs := make(chan *AddrSpec, 2)
+	s, _ := New(&Config{
+		Resolver: staticResolver{net.ParseIP("192.0.2.1")},
+		Observers: []Observer{closeObserver{onClose: func(req *Request) {
+			remoteAddrs <- req.RemoteAddr
+		}}},
+	})
+	go s.Serve(&ProxyProtocolListener{Listener: l, Trusted: []net.IPNet{*loopback}})
+	defer l.Close()
+
+	c := &Client{
+		Address: l.Addr().String(),
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			_, err = conn.Write([]byte("PROXY TCP4 192.0.2.10 192.0.2.20 56324 443\r\n"))
+			return conn, err
+		},
+	}
+	if _, err := c.Resolve(context.Background(), "foo.example.com"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if remoteAddr := <-remoteAddrs; remoteAddr == nil || remoteAddr.String() != "192.0.2.10:56324" {
+		t.Fatalf("bad remote address: %v", remoteAddr)
+	}
+
+	// Connections without header are refused
+	c.Dial = nil
+	if _, err := c.Resolve(context.Background(), "foo.example.com"); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestProxyProtocolListener_Untrusted(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, trusted, _ := net.ParseCIDR("192.0.2.0/24")
+	pl := &ProxyProtocolListener{Listener: l, Trusted: []net.IPNet{*trusted}}
+	defer l.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("PROXY TCP4 192.0.2.10 192.0.2.20 56324 443\r\n"))
+		conn.Close()
+	}()
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if !strings.HasPrefix(conn.RemoteAddr().String(), "127.0.0.1:") {
+		t.Fatalf("bad remote address: %v", conn.RemoteAddr())
+	}
+	data, _ := io.ReadAll(conn)
+	if !bytes.HasPrefix(data, proxyV1Prefix) {
+		t.Fatalf("header not passed on: %q", data)
+	}
+}
+
+// closeObserver calls a function when a connection is closed
+type closeObserver struct {
+	NopObserver
+	onClose func(req *Request)
+}
+
+func (o closeObserver) OnClose(ctx context.Context, req *Request, err error) {
+	o.onClose(req)
+}
+
+func TestWriteProxyHeader(t *testing.T) {
+	v4 := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+	cases := []struct {
+		src, dst net.Addr
+		v1       string
+		expSrc   string
+		expDst   string
+	}{
+		{v4, &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443}, "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n", "192.0.2.1:56324", "192.0.2.2:443"},
+		{v4, v6, "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 56324 443\r\n", "192.0.2.1:56324", "[2001:db8::2]:443"},
+		{nil, v6, "PROXY UNKNOWN\r\n", "", ""},
+		{&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, v6, "PROXY UNKNOWN\r\n", "", ""},
+	}
+	for _, c := range cases {
+		for _, version := range []int{1, 2} {
+			var buf bytes.Buffer
+			if err := WriteProxyHeader(&buf, version, c.src, c.dst, nil); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if version == 1 && buf.String() != c.v1 {
+				t.Fatalf("bad header: %q", buf.String())
+			}
+			src, dst, err := readProxyHeader(bufio.NewReader(&buf))
+			if err != nil {
+				t.Fatalf("v%d %v: err: %v", version, c.src, err)
+			}
+			if c.expSrc == "" {
+				if src != nil || dst != nil {
+					t.Fatalf("v%d: expected unknown addresses, got %v %v", version, src, dst)
+				}
+				continue
+			}
+			if src.String() != c.expSrc || dst.String() != c.expDst {
+				t.Fatalf("v%d: bad addresses %v %v", version, src, dst)
+			}
+		}
+	}
+
+	if err := WriteProxyHeader(io.Discard, 3, v4, v6, nil); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestProxyHeaderDialer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	headers := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		headers <- data
+	}()
+
+	d := &ProxyHeaderDialer{Version: 2, UsernameTLV: ProxyTLVUsername}
+	ctx := WithClientAddr(context.Background(), &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324})
+	ctx = WithAuthContext(ctx, &AuthContext{Method: UserPassAuth, Payload: map[string]string{"Username": "foo"}})
+	conn, err := d.DialContext(ctx, "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+
+	data := <-headers
+	src, dst, err := readProxyHeader(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if src.String() != "192.0.2.1:56324" || dst.String() != l.Addr().String() {
+		t.Fatalf("bad addresses %v %v", src, dst)
+	}
+	if !bytes.HasSuffix(data, []byte{ProxyTLVUsername, 0, 3, 'f', 'o', 'o'}) {
+		t.Fatalf("missing username: %q", data)
+	}
+}
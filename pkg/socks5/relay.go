@@ -0,0 +1,327 @@
+package socks5
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+// DefaultRelayLinger is how long the remaining direction of a connection
+// may stay idle, once the other direction was closed
+const DefaultRelayLinger = 30 * time.Second
+
+// RelayCounters counts the bytes relayed in each direction. They are
+// updated while relaying, and may be read concurrently.
+type RelayCounters struct {
+	upstream   int64
+	downstream int64
+}
+
+// Upstream returns the number of bytes relayed from the client to the
+// destination so far
+func (c *RelayCounters) Upstream() int64 {
+	return atomic.LoadInt64(&c.upstream)
+}
+
+// Downstream returns the number of bytes relayed from the destination to
+// the client so far
+func (c *RelayCounters) Downstream() int64 {
+	return atomic.LoadInt64(&c.downstream)
+}
+
+// RelayDirection is the outcome of relaying one direction of a connection
+type RelayDirection struct {
+	// Bytes relayed
+	Bytes int64
+	// Err is the error relaying failed with. It is nil if the source was
+	// closed, or relaying was interrupted.
+	Err error
+	// Interrupted is set if relaying stopped before the source was
+	// closed, as the other direction failed, or the source stayed idle
+	// for the linger time after the other direction was closed
+	Interrupted bool
+}
+
+// RelayResult is the outcome of a Relay
+type RelayResult struct {
+	// Upstream is the direction from the client to the destination
+	Upstream RelayDirection
+	// Downstream is the direction from the destination to the client
+	Downstream RelayDirection
+}
+
+// Err returns the error of the direction that failed first, if any
+func (r *RelayResult) Err() error {
+	if r.Upstream.Err != nil {
+		return r.Upstream.Err
+	}
+	return r.Downstream.Err
+}
+
+// Relay copies data between a client and the destination it connected to,
+// in both directions. When a side closes its direction, this is passed on
+// to the other side using CloseWrite, and the other direction is relayed
+// until it's closed as well, or stays idle for Linger. If a direction
+// fails, the other one is interrupted.
+//
+// Between plain TCP connections without a rate limit, data is relayed
+// using splice(2) on Linux. Counters are then updated per BufferSize bytes
+// relayed.
+type Relay struct {
+	// Client is the connection of the client
+	Client io.Writer
+	// ClientReader is read from instead of Client if set, e.g. a
+	// bufio.Reader on Client. Client must be an io.Reader otherwise.
+	ClientReader io.Reader
+	// Target is the connection to the destination
+	Target io.ReadWriter
+
+	// Optional rate limits of the upstream and downstream direction
+	InBucket  *ratelimit.Bucket
+	OutBucket *ratelimit.Bucket
+
+	// Linger is how long the remaining direction may stay idle once the
+	// other direction was closed. It's only enforced on connections
+	// supporting read deadlines.
+	// Defaults to DefaultRelayLinger.
+	Linger time.Duration
+
+	// BufferSize is the size of the buffer used for each direction.
+	// Defaults to PROXY_BUFFER_LENGTH.
+	BufferSize int
+
+	// Counters, if set, are updated while relaying
+	Counters *RelayCounters
+
+	// Buffers are taken from here if set
+	buffers *bufferPool
+}
+
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// relayDirection relays data from src to dst
+type relayDirection struct {
+	dst    io.Writer
+	src    io.Reader
+	bucket *ratelimit.Bucket
+	// Sets deadlines on reading src, if supported
+	srcConn interface{}
+	bytes   *int64
+	result  RelayDirection
+
+	// Set by Run to interrupt relaying, or have it stop once idle for
+	// linger nanoseconds. mark holds the bytes relayed when the last read
+	// deadline was set.
+	interrupted int32
+	linger      int64
+	mark        int64
+}
+
+// Run relays data until both directions are done
+func (r *Relay) Run() RelayResult {
+	counters := r.Counters
+	if counters == nil {
+		counters = &RelayCounters{}
+	}
+	linger := r.Linger
+	if linger <= 0 {
+		linger = DefaultRelayLinger
+	}
+
+	clientIn := r.ClientReader
+	if clientIn == nil {
+		clientIn = r.Client.(io.Reader)
+	}
+	if buffered, ok := clientIn.(*bufio.Reader); ok && r.InBucket == nil {
+		if raw, ok := r.Client.(io.Reader); ok {
+			// Pass on what the client sent along with the request, so
+			// the connection can be read from directly, see spliceCopy
+			if data, _ := buffered.Peek(buffered.Buffered()); len(data) > 0 {
+				n, err := r.Target.Write(data)
+				atomic.AddInt64(&counters.upstream, int64(n))
+				if err != nil {
+					return RelayResult{
+						Upstream:   RelayDirection{Bytes: int64(n), Err: err},
+						Downstream: RelayDirection{Interrupted: true},
+					}
+				}
+				buffered.Discard(n)
+			}
+			clientIn = raw
+		}
+	}
+
+	up := &relayDirection{
+		dst:     r.Target,
+		src:     clientIn,
+		bucket:  r.InBucket,
+		srcConn: r.Client,
+		bytes:   &counters.upstream,
+	}
+	down := &relayDirection{
+		dst:     r.Client,
+		src:     r.Target,
+		bucket:  r.OutBucket,
+		srcConn: r.Target,
+		bytes:   &counters.downstream,
+	}
+
+	buffers := r.buffers
+	if buffers == nil {
+		size := r.BufferSize
+		if size <= 0 {
+			size = PROXY_BUFFER_LENGTH
+		}
+		buffers = newBufferPool(size)
+	}
+	bufUp, bufDown := buffers.Get(), buffers.Get()
+	defer buffers.Put(bufUp)
+	defer buffers.Put(bufDown)
+
+	done := make(chan *relayDirection, 2)
+	go up.run(*bufUp, done)
+	go down.run(*bufDown, done)
+
+	first := <-done
+	other := up
+	if first == up {
+		other = down
+	}
+	if first.result.Err == nil && !first.result.Interrupted {
+		closeWrite(first.dst)
+		other.lingerFor(linger)
+	} else {
+		other.interrupt()
+	}
+	<-done
+	if other.result.Err == nil && !other.result.Interrupted {
+		closeWrite(other.dst)
+	}
+
+	return RelayResult{Upstream: up.result, Downstream: down.result}
+}
+
+func (d *relayDirection) run(buf []byte, done chan<- *relayDirection) {
+	src := d.src
+	if d.bucket != nil {
+		src = ratelimit.Reader(src, d.bucket)
+	}
+	for {
+		err := d.copy(src, buf)
+		if err != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+			if atomic.LoadInt32(&d.interrupted) != 0 {
+				d.result.Interrupted = true
+				break
+			}
+			if linger := atomic.LoadInt64(&d.linger); linger != 0 {
+				// Keep waiting as long as data is flowing
+				if n := atomic.LoadInt64(d.bytes); n != d.mark {
+					d.mark = n
+					d.setReadDeadline(time.Now().Add(time.Duration(linger)))
+					continue
+				}
+				d.result.Interrupted = true
+				break
+			}
+		}
+		d.result.Err = err
+		break
+	}
+	d.result.Bytes = atomic.LoadInt64(d.bytes)
+	done <- d
+}
+
+// copy relays data until src is closed, or an error occurs
+func (d *relayDirection) copy(src io.Reader, buf []byte) error {
+	if ok, err := spliceCopy(d.dst, src, int64(len(buf)), d.bytes); ok {
+		return err
+	}
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			written, werr := d.dst.Write(buf[:n])
+			atomic.AddInt64(d.bytes, int64(written))
+			if werr != nil {
+				return werr
+			}
+			if written < n {
+				return io.ErrShortWrite
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// lingerFor has relaying stop once src stayed idle for linger
+func (d *relayDirection) lingerFor(linger time.Duration) {
+	d.mark = atomic.LoadInt64(d.bytes)
+	atomic.StoreInt64(&d.linger, int64(linger))
+	d.setReadDeadline(time.Now().Add(linger))
+}
+
+// interrupt stops relaying as soon as possible
+func (d *relayDirection) interrupt() {
+	atomic.StoreInt32(&d.interrupted, 1)
+	now := time.Now()
+	d.setReadDeadline(now)
+	if conn, ok := d.dst.(writeDeadliner); ok {
+		conn.SetWriteDeadline(now)
+	}
+}
+
+func (d *relayDirection) setReadDeadline(t time.Time) {
+	if conn, ok := d.srcConn.(readDeadliner); ok {
+		conn.SetReadDeadline(t)
+	}
+}
+
+func closeWrite(w io.Writer) {
+	if conn, ok := w.(closeWriter); ok {
+		conn.CloseWrite()
+	}
+}
+
+// spliceCopy copies from src to dst using (*net.TCPConn).ReadFrom, which
+// moves the data within the kernel using splice(2) on Linux. Data is
+// copied in chunks of up to chunk bytes, adding each to written. It only
+// applies if both are plain TCP connections, ok is false otherwise.
+func spliceCopy(dst io.Writer, src io.Reader, chunk int64, written *int64) (ok bool, err error) {
+	dstConn, ok := dst.(*net.TCPConn)
+	if !ok {
+		return false, nil
+	}
+	srcConn, ok := src.(*net.TCPConn)
+	if !ok {
+		return false, nil
+	}
+	limited := &io.LimitedReader{R: srcConn}
+	for {
+		limited.N = chunk
+		n, err := dstConn.ReadFrom(limited)
+		atomic.AddInt64(written, n)
+		if err != nil {
+			return true, err
+		}
+		if n < chunk {
+			// src was closed
+			return true, nil
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+// tcpPair returns both ends of a TCP connection
+func tcpPair(tb testing.TB) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatalf("err: %v", err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		tb.Fatalf("err: %v", err)
+	}
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+// relayPairs sets up a relay between two TCP connections, returning the
+// client's and the destination's end
+func relayPairs(t *testing.T, relay *Relay) (*net.TCPConn, *net.TCPConn) {
+	client, in := tcpPair(t)
+	out, dest := tcpPair(t)
+	relay.Client = in
+	relay.Target = out
+	t.Cleanup(func() {
+		client.Close()
+		in.Close()
+		out.Close()
+		dest.Close()
+	})
+	return client, dest
+}
+
+func TestRelay_HalfClose(t *testing.T) {
+	// Without and with the rate limit, which disables splice
+	for _, bucket := range []*ratelimit.Bucket{nil, ratelimit.NewBucketWithRate(1e9, 1e9)} {
+		counters := &RelayCounters{}
+		relay := &Relay{InBucket: bucket, OutBucket: bucket, Counters: counters}
+		client, dest := relayPairs(t, relay)
+
+		resultCh := make(chan RelayResult, 1)
+		go func() {
+			resultCh <- relay.Run()
+		}()
+
+		// The client closes its direction after sending a request
+		client.Write([]byte("ping"))
+		client.CloseWrite()
+		dest.SetDeadline(time.Now().Add(time.Second))
+		request, err := ioutil.ReadAll(dest)
+		if err != nil || string(request) != "ping" {
+			t.Fatalf("bad: %q %v", request, err)
+		}
+
+		// The destination answers after the client closed
+		dest.Write([]byte("pong!"))
+		client.SetDeadline(time.Now().Add(time.Second))
+		reply := make([]byte, 5)
+		if _, err := io.ReadFull(client, reply); err != nil || string(reply) != "pong!" {
+			t.Fatalf("bad: %q %v", reply, err)
+		}
+		// With splice, counters are only updated per buffer size relayed
+		if up, down := counters.Upstream(), counters.Downstream(); bucket != nil && (up != 4 || down != 5) {
+			t.Fatalf("bad live counters: %d %d", up, down)
+		}
+		dest.CloseWrite()
+		if _, err := client.Read(reply); err != io.EOF {
+			t.Fatalf("expected EOF, got %v", err)
+		}
+
+		result := <-resultCh
+		expected := RelayResult{
+			Upstream:   RelayDirection{Bytes: 4},
+			Downstream: RelayDirection{Bytes: 5},
+		}
+		if result != expected {
+			t.Fatalf("bad: %+v", result)
+		}
+	}
+}
+
+func TestRelay_ProxyProtocol(t *testing.T) {
+	relay := &Relay{}
+	client, dest := relayPairs(t, relay)
+	in := relay.Client.(net.Conn)
+	relay.Client = &proxyProtocolConn{Conn: in, reader: bufio.NewReader(in), timeout: time.Second}
+	client.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 1234 1080\r\n"))
+
+	resultCh := make(chan RelayResult, 1)
+	go func() {
+		resultCh <- relay.Run()
+	}()
+
+	// The destination finishes first, which is passed on to the client
+	dest.Write([]byte("pong"))
+	dest.CloseWrite()
+	client.SetDeadline(time.Now().Add(time.Second))
+	reply, err := ioutil.ReadAll(client)
+	if err != nil || string(reply) != "pong" {
+		t.Fatalf("bad: %q %v", reply, err)
+	}
+
+	client.Write([]byte("ping"))
+	client.CloseWrite()
+	dest.SetDeadline(time.Now().Add(time.Second))
+	request, err := ioutil.ReadAll(dest)
+	if err != nil || string(request) != "ping" {
+		t.Fatalf("bad: %q %v", request, err)
+	}
+
+	result := <-resultCh
+	expected := RelayResult{
+		Upstream:   RelayDirection{Bytes: 4},
+		Downstream: RelayDirection{Bytes: 4},
+	}
+	if result != expected {
+		t.Fatalf("bad: %+v", result)
+	}
+}
+
+func TestRelay_Linger(t *testing.T) {
+	relay := &Relay{Linger: 100 * time.Millisecond}
+	client, dest := relayPairs(t, relay)
+
+	resultCh := make(chan RelayResult, 1)
+	go func() {
+		resultCh <- relay.Run()
+	}()
+
+	// The destination keeps sending for longer than the linger time
+	client.CloseWrite()
+	for i := 0; i < 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		dest.Write([]byte("x"))
+	}
+
+	// And then stays idle
+	select {
+	case result := <-resultCh:
+		if result.Upstream.Err != nil || result.Upstream.Interrupted || result.Upstream.Bytes != 0 {
+			t.Fatalf("bad upstream: %+v", result.Upstream)
+		}
+		if result.Downstream.Err != nil || !result.Downstream.Interrupted || result.Downstream.Bytes != 4 {
+			t.Fatalf("bad downstream: %+v", result.Downstream)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("relay didn't stop")
+	}
+}
+
+func TestRelay_Error(t *testing.T) {
+	relay := &Relay{}
+	client, dest := relayPairs(t, relay)
+
+	resultCh := make(chan RelayResult, 1)
+	go func() {
+		resultCh <- relay.Run()
+	}()
+
+	// A reset fails the downstream direction, and interrupts upstream
+	dest.SetLinger(0)
+	dest.Close()
+
+	select {
+	case result := <-resultCh:
+		if result.Downstream.Err == nil {
+			t.Fatalf("expected downstream error: %+v", result)
+		}
+		if !result.Upstream.Interrupted {
+			t.Fatalf("expected upstream to be interrupted: %+v", result)
+		}
+		if result.Err() != result.Downstream.Err {
+			t.Fatalf("bad: %v", result.Err())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("relay didn't stop")
+	}
+	client.Close()
+}
+
+func TestRelay_Buffered(t *testing.T) {
+	// Data read along with the request is passed on first
+	relay := &Relay{}
+	client, dest := relayPairs(t, relay)
+	client.Write([]byte("pingpong"))
+	reader := bufio.NewReader(relay.Client.(io.Reader))
+	reader.Peek(4)
+	reader.Discard(4)
+	relay.ClientReader = reader
+	client.CloseWrite()
+
+	resultCh := make(chan RelayResult, 1)
+	go func() {
+		resultCh <- relay.Run()
+	}()
+	dest.SetDeadline(time.Now().Add(time.Second))
+	request, err := ioutil.ReadAll(dest)
+	if err != nil || !bytes.Equal(request, []byte("pong")) {
+		t.Fatalf("bad: %q %v", request, err)
+	}
+	dest.CloseWrite()
+	if result := <-resultCh; result.Upstream.Bytes != 4 || result.Err() != nil {
+		t.Fatalf("bad: %+v", result)
+	}
+}
+
+// onlyReader hides all methods but Read, defeating the fast paths of
+// io.Copy
+type onlyReader struct {
+	io.Reader
+}
+
+func benchmarkRelay(b *testing.B, bucket *ratelimit.Bucket) {
+	client, in := tcpPair(b)
+	out, sink := tcpPair(b)
+	defer client.Close()
+	defer in.Close()
+	defer out.Close()
+	defer sink.Close()
+
+	relay := &Relay{Client: in, Target: out, InBucket: bucket}
+	go relay.Run()
+
+	chunk := make([]byte, 256*1024)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			client.Write(chunk)
+		}
+	}()
+	if n, err := io.CopyN(ioutil.Discard, sink, int64(b.N*len(chunk))); err != nil {
+		b.Fatalf("err: %v, relayed %d bytes", err, n)
+	}
+	b.StopTimer()
+}
+
+func BenchmarkRelay_Splice(b *testing.B) {
+	benchmarkRelay(b, nil)
+}
+
+func BenchmarkRelay_Buffered(b *testing.B) {
+	// A rate limit too high to matter disables splice
+	benchmarkRelay(b, ratelimit.NewBucketWithRate(1e12, 1e12))
+}
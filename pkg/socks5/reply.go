@@ -0,0 +1,107 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Reply codes sent to the client, as defined by RFC 1928
+const (
+	ReplySucceeded            = successReply
+	ReplyServerFailure        = serverFailure
+	ReplyRuleFailure          = ruleFailure
+	ReplyNetworkUnreachable   = networkUnreachable
+	ReplyHostUnreachable      = hostUnreachable
+	ReplyConnectionRefused    = connectionRefused
+	ReplyTTLExpired           = ttlExpired
+	ReplyCommandNotSupported  = commandNotSupported
+	ReplyAddrTypeNotSupported = addrTypeNotSupported
+)
+
+var replyMessages = map[uint8]string{
+	successReply:         "succeeded",
+	serverFailure:        "general SOCKS server failure",
+	ruleFailure:          "connection not allowed by ruleset",
+	networkUnreachable:   "network unreachable",
+	hostUnreachable:      "host unreachable",
+	connectionRefused:    "connection refused",
+	ttlExpired:           "TTL expired",
+	commandNotSupported:  "command not supported",
+	addrTypeNotSupported: "address type not supported",
+}
+
+// ReplyError is returned by Client if the server didn't reply with success.
+// If returned by a dial function, e.g. one forwarding to another SOCKS
+// server, the reply code is passed on to the client.
+type ReplyError struct {
+	Code uint8
+}
+
+func (e *ReplyError) Error() string {
+	if msg, ok := replyMessages[e.Code]; ok {
+		return "SOCKS server replied: " + msg
+	}
+	return fmt.Sprintf("SOCKS server replied with unknown code %d", e.Code)
+}
+
+// DialError can be returned by dial functions and resolvers to choose the
+// reply code sent to the client
+type DialError struct {
+	Reply uint8
+	Err   error
+}
+
+func (e *DialError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// ReplyCode returns the reply code sent to the client if connecting to or
+// resolving the destination failed with err. Reply codes carried by
+// DialError and ReplyError take precedence. Otherwise, failed lookups are
+// reported as host unreachable, and system call errors as their SOCKS
+// counterpart. Timeouts are reported as TTL expired. Everything else is
+// reported as general failure.
+func ReplyCode(err error) uint8 {
+	var dialErr *DialError
+	if errors.As(err, &dialErr) {
+		return dialErr.Reply
+	}
+	var replyErr *ReplyError
+	if errors.As(err, &replyErr) {
+		return replyErr.Code
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return hostUnreachable
+	}
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.ECONNREFUSED:
+			return connectionRefused
+		case syscall.ENETUNREACH:
+			return networkUnreachable
+		case syscall.EHOSTUNREACH:
+			return hostUnreachable
+		case syscall.ETIMEDOUT:
+			return ttlExpired
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ttlExpired
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ttlExpired
+	}
+	return serverFailure
+}
@@ -0,0 +1,62 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestReplyCode(t *testing.T) {
+	opError := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+
+	cases := []struct {
+		err    error
+		expect uint8
+	}{
+		{opError(syscall.ECONNREFUSED), ReplyConnectionRefused},
+		{opError(syscall.ENETUNREACH), ReplyNetworkUnreachable},
+		{opError(syscall.EHOSTUNREACH), ReplyHostUnreachable},
+		{opError(syscall.ETIMEDOUT), ReplyTTLExpired},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}, ReplyTTLExpired},
+		{context.DeadlineExceeded, ReplyTTLExpired},
+		{&net.DNSError{Err: "no such host", Name: "foo", IsNotFound: true}, ReplyHostUnreachable},
+		{&net.DNSError{Err: "i/o timeout", Name: "foo", IsTimeout: true}, ReplyHostUnreachable},
+		{fmt.Errorf("Connect failed: %w", &ReplyError{Code: ReplyRuleFailure}), ReplyRuleFailure},
+		{&DialError{Reply: ReplyNetworkUnreachable, Err: opError(syscall.ECONNREFUSED)}, ReplyNetworkUnreachable},
+		{errors.New("x509: certificate signed by unknown authority"), ReplyServerFailure},
+	}
+	for _, c := range cases {
+		if code := ReplyCode(c.err); code != c.expect {
+			t.Fatalf("%v: expected %d, got %d", c.err, c.expect, code)
+		}
+	}
+}
+
+func TestClient_DialPropagatesReply(t *testing.T) {
+	upstream, stopUpstream := startServer(t, &Config{Rules: PermitNone()})
+	defer stopUpstream()
+
+	addr, stop := startServer(t, &Config{
+		Dial: (&Client{Address: upstream}).DialContext,
+	})
+	defer stop()
+
+	c := &Client{Address: addr}
+	var replyErr *ReplyError
+	_, err := c.DialContext(context.Background(), "tcp", "192.0.2.1:80")
+	if !errors.As(err, &replyErr) || replyErr.Code != ReplyRuleFailure {
+		t.Fatalf("expected rule failure, got %v", err)
+	}
+}
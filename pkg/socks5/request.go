@@ -8,8 +8,6 @@ import (
 	"strconv"
 	"strings"
 	"time"
-
-	"github.com/juju/ratelimit"
 )
 
 const (
@@ -19,6 +17,11 @@ const (
 	ipv4Address      = uint8(1)
 	fqdnAddress      = uint8(3)
 	ipv6Address      = uint8(4)
+
+	// ResolveCommand and ResolvePTRCommand are Tor extensions doing
+	// forward and reverse name resolution without opening a stream
+	ResolveCommand    = uint8(0xF0)
+	ResolvePTRCommand = uint8(0xF1)
 )
 
 const (
@@ -51,12 +54,42 @@ type AddrSpec struct {
 }
 
 func (a *AddrSpec) String() string {
+	if a.FQDN != "" && a.IP == nil {
+		return fmt.Sprintf("%s:%d", a.FQDN, a.Port)
+	}
 	if a.FQDN != "" {
 		return fmt.Sprintf("%s (%s):%d", a.FQDN, a.IP, a.Port)
 	}
 	return fmt.Sprintf("%s:%d", a.IP, a.Port)
 }
 
+// NewAddrSpec returns the AddrSpec of an IP based address, such as a
+// *net.TCPAddr. It returns nil for other addresses, e.g. of Unix sockets
+// or pipes.
+func NewAddrSpec(addr net.Addr) *AddrSpec {
+	if addr == nil {
+		return nil
+	}
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return &AddrSpec{IP: a.IP, Port: a.Port}
+	case *net.UDPAddr:
+		return &AddrSpec{IP: a.IP, Port: a.Port}
+	case *net.IPAddr:
+		return &AddrSpec{IP: a.IP}
+	}
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.Atoi(portStr)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &AddrSpec{IP: ip, Port: port}
+}
+
 func (a *AddrSpec) Address() string {
 	if len(a.IP) > 0 {
 		return net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port))
@@ -76,9 +109,13 @@ type Request struct {
 	Command uint8
 	// AuthContext provided during negotiation
 	AuthContext *AuthContext
-	// AddrSpec of the the network that sent the request
+	// AddrSpec of the the network that sent the request. Nil if the
+	// client isn't connected by an IP based transport, see ClientAddr.
 	RemoteAddr *AddrSpec
-	// AddrSpec of the desired destination
+	// Address of the client, of any transport
+	ClientAddr net.Addr
+	// AddrSpec of the desired destination. Nil if the client failed to
+	// authenticate, or the request couldn't be read.
 	DestAddr *AddrSpec
 	// AddrSpec of the actual destination (might be affected by rewrite)
 	realDestAddr *AddrSpec
@@ -90,17 +127,117 @@ type Request struct {
 	ConnTime time.Time
 	// Finish Time
 	FinishTime time.Time
-	ReqByte    int64
-	RespByte   int64
-	bufConn    io.Reader
-	bufIn	   []byte
-	bufOut	   []byte
+	// Bytes relayed from the client to the destination, and back
+	ReqByte  int64
+	RespByte int64
+	// Outcome of relaying data, if started
+	RelayResult *RelayResult
+	// Updated while relaying, see BytesRelayed
+	counters RelayCounters
+	// Reply code sent to the client, if Replied is set
+	Reply   uint8
+	Replied bool
+	// Outcome of authenticating the client
+	AuthOutcome AuthOutcome
+	// Error handling the request failed with, if any. Set before the
+	// Finalizer is called.
+	Err     error
+	bufConn io.Reader
+	// Used to resolve DestAddr on demand
+	resolver   NameResolver
+	family     AddressFamily
+	resolved   bool
+	resolveErr error
+	// Notified of each stage
+	observers observers
 }
 
 func (r *Request) RealDestAddr() *AddrSpec {
 	return r.realDestAddr
 }
 
+// BytesRelayed returns the number of bytes relayed from the client to the
+// destination, and back, so far. It may be called while the request is
+// being served.
+func (r *Request) BytesRelayed() (upstream, downstream int64) {
+	return r.counters.Upstream(), r.counters.Downstream()
+}
+
+// sendReply sends a reply to the client, and records its code
+func (r *Request) sendReply(ctx context.Context, w io.Writer, resp uint8, addr *AddrSpec) error {
+	r.Reply = resp
+	r.Replied = true
+	err := sendReply(w, resp, addr)
+	r.observers.OnReply(ctx, r, resp, err)
+	return err
+}
+
+// ResolveDestination resolves the FQDN of DestAddr, and stores the
+// preferred address in DestAddr.IP. All addresses are recorded on the
+// returned context, see DestinationIPsFromContext. Rules and pickers
+// needing the destination's IP address call this if Config.LazyResolve is
+// set. Only the first call does a lookup, subsequent calls return its
+// result.
+func (r *Request) ResolveDestination(ctx context.Context) (context.Context, error) {
+	dest := r.DestAddr
+	if r.resolved || r.resolver == nil || dest.FQDN == "" || dest.IP != nil {
+		return ctx, r.resolveErr
+	}
+	r.resolved = true
+	ctx, r.resolveErr = r.resolve(ctx, dest)
+	return ctx, r.resolveErr
+}
+
+// resolveRealDestination resolves the actual destination, see
+// RealDestAddr. If it was rewritten to another name, that name is resolved
+// instead of the requested one.
+func (r *Request) resolveRealDestination(ctx context.Context) (context.Context, error) {
+	real := r.realDestAddr
+	if real == nil || real == r.DestAddr {
+		return r.ResolveDestination(ctx)
+	}
+	if real.IP != nil || real.FQDN == "" || r.resolver == nil {
+		return ctx, nil
+	}
+	if real.FQDN == r.DestAddr.FQDN {
+		// The destination was rewritten before being resolved, keeping
+		// the name
+		ctx, err := r.ResolveDestination(ctx)
+		if err != nil {
+			return ctx, err
+		}
+		real.IP = r.DestAddr.IP
+		return ctx, nil
+	}
+	return r.resolve(ctx, real)
+}
+
+// resolve resolves the FQDN of dest, and stores the preferred address in
+// dest.IP
+func (r *Request) resolve(ctx context.Context, dest *AddrSpec) (context.Context, error) {
+	start := time.Now()
+	defer func() {
+		r.ResolveTime = time.Now()
+	}()
+
+	ctx_, addrs, err := resolveAll(ctx, r.resolver, dest.FQDN)
+	if err == nil {
+		addrs = r.family.Sort(addrs)
+		if len(addrs) == 0 {
+			err = &net.DNSError{Err: fmt.Sprintf("no %v address", r.family), Name: dest.FQDN, IsNotFound: true}
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("Failed to resolve destination '%v': %w", dest.FQDN, err)
+		r.observers.OnResolve(ctx_, r, start, err)
+		return ctx, err
+	}
+	dest.IP = addrs[0]
+	ctx = WithDestinationIPs(ctx_, addrs)
+	r.observers.OnResolve(ctx, r, start, nil)
+	return ctx, nil
+}
+
 type conn interface {
 	Write([]byte) (int, error)
 	RemoteAddr() net.Addr
@@ -112,59 +249,67 @@ type closeWriter interface {
 
 // NewRequest creates a new Request from the tcp connection
 func NewRequest(bufConn io.Reader) (*Request, error) {
+	request := &Request{}
+	if err := request.read(bufConn); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// read reads the command and destination of the request
+func (r *Request) read(bufConn io.Reader) error {
 	// Read the version byte
 	header := []byte{0, 0, 0}
 	if _, err := io.ReadAtLeast(bufConn, header, 3); err != nil {
-		return nil, fmt.Errorf("Failed to get command version: %v", err)
+		return fmt.Errorf("Failed to get command version: %v", err)
 	}
 
 	// Ensure we are compatible
 	if header[0] != socks5Version {
-		return nil, fmt.Errorf("Unsupported command version: %v", header[0])
+		return fmt.Errorf("Unsupported command version: %v", header[0])
 	}
 
 	// Read in the destination address
 	dest, err := readAddrSpec(bufConn)
 	if err != nil {
-		return nil, err
-	}
-
-	request := &Request{
-		Version:   socks5Version,
-		Command:   header[1],
-		DestAddr:  dest,
-		StartTime: time.Now(),
-		bufConn:   bufConn,
-		bufIn: 	   make([]byte, PROXY_BUFFER_LENGTH),
-		bufOut:	   make([]byte, PROXY_BUFFER_LENGTH),
+		return err
 	}
 
-	return request, nil
+	r.Version = socks5Version
+	r.Command = header[1]
+	r.DestAddr = dest
+	r.StartTime = time.Now()
+	r.bufConn = bufConn
+	return nil
 }
 
 // handleRequest is used for request processing after authentication
-func (s *Server) handleRequest(req *Request, conn conn) (context.Context, error) {
-	ctx := context.Background()
+func (s *Server) handleRequest(ctx context.Context, req *Request, conn conn) (context.Context, error) {
+	req.resolver = s.config.Resolver
+	req.family = s.config.AddressFamily
+	req.observers = s.config.Observers
+
+	// Apply any address rewrites. Rewrite rules resolve the requested
+	// name on demand, as it may only exist behind the rewrite.
+	req.realDestAddr = req.DestAddr
+	if s.config.Rewriter != nil {
+		start := time.Now()
+		ctx, req.realDestAddr = s.config.Rewriter.Rewrite(ctx, req)
+		req.observers.OnRewrite(ctx, req, start)
+	}
 
-	// Resolve the address if we are using resolver and we have a FQDN
-	dest := req.DestAddr
-	if s.config.Resolver != nil && dest.FQDN != "" {
-		ctx_, addr, err := s.config.Resolver.Resolve(ctx, dest.FQDN)
+	// Resolve the actual destination if we are using resolver and it's a
+	// FQDN, unless resolving is deferred until the destination is dialed
+	if !s.config.LazyResolve {
+		ctx_, err := req.resolveRealDestination(ctx)
 		if err != nil {
-			if err := sendReply(conn, hostUnreachable, nil); err != nil {
+			if err := req.sendReply(ctx, conn, ReplyCode(err), nil); err != nil {
 				return ctx, fmt.Errorf("Failed to send reply: %v", err)
 			}
-			return ctx, fmt.Errorf("Failed to resolve destination '%v': %v", dest.FQDN, err)
+			return ctx, err
 		}
 		ctx = ctx_
-		dest.IP = addr
-	}
-	req.ResolveTime = time.Now()
-
-	// Apply any address rewrites
-	req.realDestAddr = req.DestAddr
-	if s.config.Rewriter != nil {
-		ctx, req.realDestAddr = s.config.Rewriter.Rewrite(ctx, req)
+		req.ResolveTime = time.Now()
 	}
 
 	// Switch on the command
@@ -175,14 +320,26 @@ func (s *Server) handleRequest(req *Request, conn conn) (context.Context, error)
 		return s.handleBind(ctx, conn, req)
 	case AssociateCommand:
 		return s.handleAssociate(ctx, conn, req)
+	case ResolveCommand:
+		return s.handleResolve(ctx, conn, req)
+	case ResolvePTRCommand:
+		return s.handleResolvePTR(ctx, conn, req)
 	default:
-		if err := sendReply(conn, commandNotSupported, nil); err != nil {
+		if err := req.sendReply(ctx, conn, commandNotSupported, nil); err != nil {
 			return ctx, fmt.Errorf("Failed to send reply: %v", err)
 		}
 		return ctx, fmt.Errorf("Unsupported command: %v", req.Command)
 	}
 }
 
+// allow checks the request against the RuleSet
+func (s *Server) allow(ctx context.Context, req *Request) (context.Context, bool) {
+	start := time.Now()
+	ctx, ok := s.config.Rules.Allow(ctx, req)
+	req.observers.OnRule(ctx, req, start, ok)
+	return ctx, ok
+}
+
 // handleConnect is used to handle a connect command
 func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) (context.Context, error) {
 	defer func() {
@@ -190,8 +347,8 @@ func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) (co
 	}()
 	s.config.Logger.Debugf("request CONNECT to %v", req.DestAddr)
 	// Check if this is allowed
-	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ruleFailure, nil); err != nil {
+	if ctx_, ok := s.allow(ctx, req); !ok {
+		if err := req.sendReply(ctx, conn, ruleFailure, nil); err != nil {
 			return ctx, fmt.Errorf("Failed to send reply: %v", err)
 		}
 		return ctx, fmt.Errorf("Connect to %v blocked by rules", req.DestAddr)
@@ -203,65 +360,78 @@ func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) (co
 	dial := s.config.Dial
 	var ctx_ context.Context
 	if s.config.Picker != nil {
+		start := time.Now()
 		ctx_, dial = s.config.Picker.Pick(req, ctx)
 		ctx = ctx_
+		req.observers.OnPick(ctx, req, start)
 	}
 	if dial == nil {
-		dial = func(ctx context.Context, net_, addr string) (net.Conn, error) {
-			return net.Dial(net_, addr)
+		dial = (&HappyEyeballsDialer{Family: s.config.AddressFamily, Resolver: s.config.Resolver}).DialContext
+	}
+
+	// Names are passed on as they are if the destination is resolved
+	// remotely, otherwise they are resolved now
+	addr := req.realDestAddr.Address()
+	if RemoteResolutionFromContext(ctx) {
+		if req.realDestAddr.FQDN != "" {
+			addr = net.JoinHostPort(req.realDestAddr.FQDN, strconv.Itoa(req.realDestAddr.Port))
+		}
+	} else {
+		ctx_, err := req.resolveRealDestination(ctx)
+		if err != nil {
+			if err := req.sendReply(ctx, conn, ReplyCode(err), nil); err != nil {
+				return ctx, fmt.Errorf("Failed to send reply: %v", err)
+			}
+			return ctx, err
 		}
+		ctx = ctx_
+		addr = req.realDestAddr.Address()
 	}
-	target, err := dial(ctx, "tcp", req.realDestAddr.Address())
+	start := time.Now()
+	target, err := dial(ctx, "tcp", addr)
+	req.observers.OnDial(ctx, req, start, addr, err)
 	if err != nil {
-		msg := err.Error()
-		resp := hostUnreachable
-		if strings.Contains(msg, "refused") {
-			resp = connectionRefused
-		} else if strings.Contains(msg, "network is unreachable") {
-			resp = networkUnreachable
-		}
-		if err := sendReply(conn, resp, nil); err != nil {
+		if err := req.sendReply(ctx, conn, ReplyCode(err), nil); err != nil {
 			return ctx, fmt.Errorf("Failed to send reply: %v", err)
 		}
-		return ctx, fmt.Errorf("Connect to %v failed: %v", req.DestAddr, err)
+		return ctx, fmt.Errorf("Connect to %v failed: %w", req.DestAddr, err)
 	}
 	defer target.Close()
 	req.ConnTime = time.Now()
 
 	// Send success
-	local := target.LocalAddr().(*net.TCPAddr)
-	bind := AddrSpec{IP: local.IP, Port: local.Port}
-	if err := sendReply(conn, successReply, &bind); err != nil {
+	// Targets not connected by an IP based transport, e.g. Unix sockets,
+	// are reported as bound to 0.0.0.0:0
+	bind := NewAddrSpec(target.LocalAddr())
+	if err := req.sendReply(ctx, conn, successReply, bind); err != nil {
 		return ctx, fmt.Errorf("Failed to send reply: %v", err)
 	}
 
 	// Start proxying
-	errCh := make(chan error, 2)
-	sizeCh := make(chan int64, 2)
-	go proxy(target, req.bufConn, req.bufIn, errCh, sizeCh, s.config.InBucket)
-	go proxy(conn, target, req.bufOut, errCh, sizeCh, s.config.OutBucket)
-
-	// Setup req value for finalizer read
-	req.ReqByte = <-sizeCh
-	req.RespByte = <-sizeCh
-
-	// Wait
-	for i := 0; i < 2; i++ {
-		e := <-errCh
-		if e != nil {
-			// return from this function closes target (and conn).
-			return ctx, e
-		}
+	relay := &Relay{
+		Client:       conn,
+		ClientReader: req.bufConn,
+		Target:       target,
+		InBucket:     s.config.InBucket,
+		OutBucket:    s.config.OutBucket,
+		Linger:       s.config.RelayLinger,
+		Counters:     &req.counters,
+		buffers:      s.buffers,
 	}
-	return ctx, nil
+	result := relay.Run()
+	req.ReqByte = result.Upstream.Bytes
+	req.RespByte = result.Downstream.Bytes
+	req.RelayResult = &result
+	// return from this function closes target (and conn).
+	return ctx, result.Err()
 }
 
 // handleBind is used to handle a connect command
 func (s *Server) handleBind(ctx context.Context, conn conn, req *Request) (context.Context, error) {
 	// Check if this is allowed
 	s.config.Logger.Debugf("request BIND to %v", req.DestAddr)
-	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ruleFailure, nil); err != nil {
+	if ctx_, ok := s.allow(ctx, req); !ok {
+		if err := req.sendReply(ctx, conn, ruleFailure, nil); err != nil {
 			return ctx, fmt.Errorf("Failed to send reply: %v", err)
 		}
 		return ctx, fmt.Errorf("Bind to %v blocked by rules", req.DestAddr)
@@ -270,7 +440,7 @@ func (s *Server) handleBind(ctx context.Context, conn conn, req *Request) (conte
 	}
 
 	// TODO: Support bind
-	if err := sendReply(conn, commandNotSupported, nil); err != nil {
+	if err := req.sendReply(ctx, conn, commandNotSupported, nil); err != nil {
 		return ctx, fmt.Errorf("Failed to send reply: %v", err)
 	}
 	return ctx, nil
@@ -280,8 +450,8 @@ func (s *Server) handleBind(ctx context.Context, conn conn, req *Request) (conte
 func (s *Server) handleAssociate(ctx context.Context, conn conn, req *Request) (context.Context, error) {
 	// Check if this is allowed
 	s.config.Logger.Debugf("request ASSOCIATE to %v", req.DestAddr)
-	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ruleFailure, nil); err != nil {
+	if ctx_, ok := s.allow(ctx, req); !ok {
+		if err := req.sendReply(ctx, conn, ruleFailure, nil); err != nil {
 			return ctx, fmt.Errorf("Failed to send reply: %v", err)
 		}
 		return ctx, fmt.Errorf("Associate to %v blocked by rules", req.DestAddr)
@@ -290,7 +460,88 @@ func (s *Server) handleAssociate(ctx context.Context, conn conn, req *Request) (
 	}
 
 	// TODO: Support associate
-	if err := sendReply(conn, commandNotSupported, nil); err != nil {
+	if err := req.sendReply(ctx, conn, commandNotSupported, nil); err != nil {
+		return ctx, fmt.Errorf("Failed to send reply: %v", err)
+	}
+	return ctx, nil
+}
+
+// handleResolve is used to handle a Tor RESOLVE command
+func (s *Server) handleResolve(ctx context.Context, conn conn, req *Request) (context.Context, error) {
+	defer func() {
+		req.FinishTime = time.Now()
+	}()
+	s.config.Logger.Debugf("request RESOLVE of %v", req.DestAddr)
+	// Check if this is allowed
+	if ctx_, ok := s.allow(ctx, req); !ok {
+		if err := req.sendReply(ctx, conn, ruleFailure, nil); err != nil {
+			return ctx, fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return ctx, fmt.Errorf("Resolve of %v blocked by rules", req.DestAddr)
+	} else {
+		ctx = ctx_
+	}
+
+	// Addresses are returned as they are
+	ctx_, err := req.ResolveDestination(ctx)
+	if err != nil {
+		if err := req.sendReply(ctx, conn, ReplyCode(err), nil); err != nil {
+			return ctx, fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return ctx, err
+	}
+	ctx = ctx_
+
+	if err := req.sendReply(ctx, conn, successReply, &AddrSpec{IP: req.DestAddr.IP}); err != nil {
+		return ctx, fmt.Errorf("Failed to send reply: %v", err)
+	}
+	return ctx, nil
+}
+
+// handleResolvePTR is used to handle a Tor RESOLVE_PTR command
+func (s *Server) handleResolvePTR(ctx context.Context, conn conn, req *Request) (context.Context, error) {
+	defer func() {
+		req.FinishTime = time.Now()
+	}()
+	s.config.Logger.Debugf("request RESOLVE_PTR of %v", req.DestAddr)
+	// Check if this is allowed
+	if ctx_, ok := s.allow(ctx, req); !ok {
+		if err := req.sendReply(ctx, conn, ruleFailure, nil); err != nil {
+			return ctx, fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return ctx, fmt.Errorf("Resolve PTR of %v blocked by rules", req.DestAddr)
+	} else {
+		ctx = ctx_
+	}
+
+	if req.DestAddr.IP == nil {
+		if err := req.sendReply(ctx, conn, addrTypeNotSupported, nil); err != nil {
+			return ctx, fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return ctx, fmt.Errorf("Resolve PTR of %v requires an address", req.DestAddr)
+	}
+
+	start := time.Now()
+	ctx, names, err := resolveAddr(ctx, s.config.Resolver, req.DestAddr.IP)
+	req.observers.OnResolve(ctx, req, start, err)
+	var name string
+	if err == nil && len(names) == 0 {
+		err = &net.DNSError{Err: "no name", Name: req.DestAddr.IP.String(), IsNotFound: true}
+	}
+	if err == nil {
+		name = strings.TrimSuffix(names[0], ".")
+		if len(name) > 255 {
+			err = fmt.Errorf("Name too long: %s", name)
+		}
+	}
+	if err != nil {
+		if err := req.sendReply(ctx, conn, ReplyCode(err), nil); err != nil {
+			return ctx, fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return ctx, fmt.Errorf("Failed to resolve address '%v': %w", req.DestAddr.IP, err)
+	}
+
+	if err := req.sendReply(ctx, conn, successReply, &AddrSpec{FQDN: name}); err != nil {
 		return ctx, fmt.Errorf("Failed to send reply: %v", err)
 	}
 	return ctx, nil
@@ -393,36 +644,3 @@ func sendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
 	_, err := w.Write(msg)
 	return err
 }
-
-// proxy is used to suffle data from src to destination, and sends errors
-// down a dedicated channel
-func proxy(dst io.Writer, src io.Reader, buffer []byte, errCh chan error, sizeCh chan int64, bucket *ratelimit.Bucket) {
-	// 	_, err := io.Copy(dst, src)
-	// 	if tcpConn, ok := dst.(closeWriter); ok {
-	// 		tcpConn.CloseWrite()
-	// 	}
-	// 	errCh <- err
-	if bucket != nil {
-		src = ratelimit.Reader(src, bucket)
-	}
-
-	var err error
-	var size, n int64
-	for {
-		n, err = io.CopyBuffer(dst, src, buffer)
-		size += n
-		n = 0
-		if err != nil {
-			break
-		}
-	}
-	if err == io.EOF {
-		err = nil
-	}
-	if tcpConn, ok := dst.(closeWriter); ok {
-		tcpConn.CloseWrite()
-	}
-
-	errCh <- err
-	sizeCh <- size
-}
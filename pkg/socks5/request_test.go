@@ -2,11 +2,14 @@ package socks5
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"io"
 	"net"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/fholzer/go-socks5/pkg/axe"
 )
@@ -49,11 +52,14 @@ func TestRequest_Connect(t *testing.T) {
 	lAddr := l.Addr().(*net.TCPAddr)
 
 	// Make server
-	s := &Server{config: &Config{
-		Rules:    PermitAll(),
-		Resolver: DNSResolver{},
-		Logger:   axe.New(),
-	}}
+	s := &Server{
+		config: &Config{
+			Rules:    PermitAll(),
+			Resolver: DNSResolver{},
+			Logger:   axe.New(),
+		},
+		buffers: newBufferPool(PROXY_BUFFER_LENGTH),
+	}
 
 	// Create the connect request
 	buf := bytes.NewBuffer(nil)
@@ -73,7 +79,7 @@ func TestRequest_Connect(t *testing.T) {
 		t.Fatalf("err: %v", err)
 	}
 
-	if _, err := s.handleRequest(req, resp); err != nil {
+	if _, err := s.handleRequest(context.Background(), req, resp); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -124,11 +130,14 @@ func TestRequest_Connect_RuleFail(t *testing.T) {
 	lAddr := l.Addr().(*net.TCPAddr)
 
 	// Make server
-	s := &Server{config: &Config{
-		Rules:    PermitNone(),
-		Resolver: DNSResolver{},
-		Logger:   axe.New(),
-	}}
+	s := &Server{
+		config: &Config{
+			Rules:    PermitNone(),
+			Resolver: DNSResolver{},
+			Logger:   axe.New(),
+		},
+		buffers: newBufferPool(PROXY_BUFFER_LENGTH),
+	}
 
 	// Create the connect request
 	buf := bytes.NewBuffer(nil)
@@ -148,7 +157,7 @@ func TestRequest_Connect_RuleFail(t *testing.T) {
 		t.Fatalf("err: %v", err)
 	}
 
-	if _, err := s.handleRequest(req, resp); !strings.Contains(err.Error(), "blocked by rules") {
+	if _, err := s.handleRequest(context.Background(), req, resp); !strings.Contains(err.Error(), "blocked by rules") {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -167,3 +176,145 @@ func TestRequest_Connect_RuleFail(t *testing.T) {
 		t.Fatalf("bad: %v %v", out, expected)
 	}
 }
+
+type remotePicker struct {
+	remote bool
+	addr   string
+}
+
+func (p *remotePicker) Pick(req *Request, ctx context.Context) (context.Context, func(ctx context.Context, network, addr string) (net.Conn, error)) {
+	if p.remote {
+		ctx = WithRemoteResolution(ctx)
+	}
+	return ctx, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		p.addr = addr
+		return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+	}
+}
+
+func TestRequest_Connect_LazyResolve(t *testing.T) {
+	for _, remote := range []bool{true, false} {
+		upstream := &countingResolver{ttl: time.Minute}
+		picker := &remotePicker{remote: remote}
+		s := &Server{
+			config: &Config{
+				Rules:       PermitAll(),
+				Resolver:    upstream,
+				LazyResolve: true,
+				Picker:      picker,
+				Logger:      axe.New(),
+			},
+			buffers: newBufferPool(PROXY_BUFFER_LENGTH),
+		}
+
+		buf := bytes.NewBuffer(nil)
+		buf.Write([]byte{5, 1, 0, 3, 15})
+		buf.WriteString("foo.example.com")
+		buf.Write([]byte{0, 80})
+
+		req, err := NewRequest(buf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := &MockConn{}
+		s.handleRequest(context.Background(), req, resp)
+
+		if out := resp.buf.Bytes(); len(out) < 2 || out[1] != connectionRefused {
+			t.Fatalf("bad reply: %v", out)
+		}
+		if remote {
+			if picker.addr != "foo.example.com:80" || upstream.calls != 0 {
+				t.Fatalf("expected name to be passed on, dialed %v after %d lookups", picker.addr, upstream.calls)
+			}
+		} else {
+			if picker.addr != "10.0.0.1:80" || upstream.calls != 1 {
+				t.Fatalf("expected name to be resolved, dialed %v after %d lookups", picker.addr, upstream.calls)
+			}
+		}
+	}
+}
+
+func TestRequest_Connect_Rewrite(t *testing.T) {
+	// The requested name only exists behind the rewrite
+	rewriter, err := NewRuleRewriter([]RewriteRule{
+		{Domains: []string{"missing.example.com"}, Ports: []PortRange{{5432, 5432}}, Host: "10.1.2.3", Port: PortRange{6432, 6432}},
+		{Domains: []string{"missing.example.com"}, Host: "backend.example.com"},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cases := []struct {
+		port   uint16
+		expect string
+		calls  int32
+	}{
+		{port: 5432, expect: "10.1.2.3:6432", calls: 0},
+		{port: 80, expect: "10.0.0.1:80", calls: 1},
+	}
+	for _, lazy := range []bool{false, true} {
+		for _, c := range cases {
+			upstream := &countingResolver{ttl: time.Minute}
+			picker := &remotePicker{}
+			s := &Server{
+				config: &Config{
+					Rules:         PermitAll(),
+					Resolver:      upstream,
+					LazyResolve:   lazy,
+					AddressFamily: IPv4Only,
+					Rewriter:      rewriter,
+					Picker:        picker,
+					Logger:        axe.New(),
+				},
+				buffers: newBufferPool(PROXY_BUFFER_LENGTH),
+			}
+
+			buf := bytes.NewBuffer(nil)
+			buf.Write([]byte{5, 1, 0, 3, 19})
+			buf.WriteString("missing.example.com")
+			port := []byte{0, 0}
+			binary.BigEndian.PutUint16(port, c.port)
+			buf.Write(port)
+
+			req, err := NewRequest(buf)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			resp := &MockConn{}
+			s.handleRequest(context.Background(), req, resp)
+
+			if out := resp.buf.Bytes(); len(out) < 2 || out[1] != connectionRefused {
+				t.Fatalf("lazy %v: bad reply: %v", lazy, out)
+			}
+			if picker.addr != c.expect || upstream.calls != c.calls {
+				t.Fatalf("lazy %v: expected %v after %d lookups, dialed %v after %d lookups", lazy, c.expect, c.calls, picker.addr, upstream.calls)
+			}
+		}
+	}
+}
+
+func TestNewAddrSpec(t *testing.T) {
+	pipe, _ := net.Pipe()
+	cases := []struct {
+		addr     net.Addr
+		expected string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1080}, "192.0.2.1:1080"},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}, "2001:db8::1:53"},
+		{&net.UnixAddr{Name: "/run/socks.sock", Net: "unix"}, ""},
+		{pipe.RemoteAddr(), ""},
+		{nil, ""},
+	}
+	for _, c := range cases {
+		spec := NewAddrSpec(c.addr)
+		if c.expected == "" {
+			if spec != nil {
+				t.Fatalf("%v: expected nil, got %v", c.addr, spec)
+			}
+			continue
+		}
+		if spec == nil || spec.String() != c.expected {
+			t.Fatalf("%v: bad: %v", c.addr, spec)
+		}
+	}
+}
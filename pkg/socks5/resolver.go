@@ -11,6 +11,20 @@ type NameResolver interface {
 	Resolve(ctx context.Context, name string) (context.Context, net.IP, error)
 }
 
+// MultiNameResolver is a NameResolver which can return all addresses
+// of a name
+type MultiNameResolver interface {
+	NameResolver
+	ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error)
+}
+
+// ReverseNameResolver is a NameResolver which can also look up the names
+// of an address
+type ReverseNameResolver interface {
+	NameResolver
+	ResolveAddr(ctx context.Context, ip net.IP) (context.Context, []string, error)
+}
+
 // DNSResolver uses the system DNS to resolve host names
 type DNSResolver struct{}
 
@@ -21,3 +35,41 @@ func (d DNSResolver) Resolve(ctx context.Context, name string) (context.Context,
 	}
 	return ctx, addr.IP, err
 }
+
+func (d DNSResolver) ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ctx, ips, nil
+}
+
+func (d DNSResolver) ResolveAddr(ctx context.Context, ip net.IP) (context.Context, []string, error) {
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip.String())
+	return ctx, names, err
+}
+
+// resolveAddr returns the names of ip if resolver supports reverse lookups
+func resolveAddr(ctx context.Context, resolver NameResolver, ip net.IP) (context.Context, []string, error) {
+	if r, ok := resolver.(ReverseNameResolver); ok {
+		return r.ResolveAddr(ctx, ip)
+	}
+	return ctx, nil, &net.DNSError{Err: "reverse lookups not supported", Name: ip.String()}
+}
+
+// resolveAll returns all addresses of name if resolver supports it,
+// otherwise the single address returned by resolver
+func resolveAll(ctx context.Context, resolver NameResolver, name string) (context.Context, []net.IP, error) {
+	if r, ok := resolver.(MultiNameResolver); ok {
+		return r.ResolveAll(ctx, name)
+	}
+	ctx, ip, err := resolver.Resolve(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return ctx, []net.IP{ip}, nil
+}
@@ -0,0 +1,263 @@
+package socks5
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultCacheTTL is used for answers of resolvers not reporting a TTL
+	DefaultCacheTTL = time.Minute
+	// DefaultCacheNegativeTTL is used if CachingResolverConfig.NegativeTTL is zero
+	DefaultCacheNegativeTTL = 10 * time.Second
+	// DefaultCacheMaxEntries is used if CachingResolverConfig.MaxEntries is zero
+	DefaultCacheMaxEntries = 4096
+	// DefaultCacheLookupTimeout is used if CachingResolverConfig.LookupTimeout is zero
+	DefaultCacheLookupTimeout = 30 * time.Second
+)
+
+// TTLNameResolver is a NameResolver which returns all addresses of a name
+// and reports how long they may be cached
+type TTLNameResolver interface {
+	NameResolver
+	ResolveTTL(ctx context.Context, name string) (context.Context, []net.IP, time.Duration, error)
+}
+
+// CachingResolverConfig is used to setup a CachingResolver
+type CachingResolverConfig struct {
+	// Resolver answers cache misses.
+	// Defaults to DNSResolver.
+	Resolver NameResolver
+
+	// DefaultTTL is used if Resolver doesn't report TTLs.
+	// Defaults to DefaultCacheTTL.
+	DefaultTTL time.Duration
+
+	// MinTTL and MaxTTL clamp the TTLs reported by Resolver.
+	// Zero disables the respective clamp.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+
+	// NegativeTTL is the time a non-existent name is cached.
+	// Defaults to DefaultCacheNegativeTTL.
+	NegativeTTL time.Duration
+
+	// MaxEntries is the number of names cached. The least recently used
+	// names are evicted first.
+	// Defaults to DefaultCacheMaxEntries.
+	MaxEntries int
+
+	// LookupTimeout bounds a lookup on a cache miss. The lookup is shared
+	// by all callers asking for the name meanwhile, so it isn't cancelled
+	// when the caller which started it gives up.
+	// Defaults to DefaultCacheLookupTimeout.
+	LookupTimeout time.Duration
+}
+
+// CacheStats are counters of a CachingResolver
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+}
+
+type cacheEntry struct {
+	name    string
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+type inflightLookup struct {
+	done chan struct{}
+	ips  []net.IP
+	ttl  time.Duration
+	err  error
+}
+
+// CachingResolver is a NameResolver caching the answers of another
+// NameResolver. Concurrent lookups of the same name are collapsed into a
+// single lookup. Names which don't exist are cached for NegativeTTL.
+type CachingResolver struct {
+	config *CachingResolverConfig
+
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	lru      *list.List
+	inflight map[string]*inflightLookup
+	stats    CacheStats
+}
+
+// NewCachingResolver creates a new CachingResolver
+func NewCachingResolver(conf *CachingResolverConfig) *CachingResolver {
+	// Defaults are filled in on a copy, leaving the caller's config as is
+	copied := *conf
+	conf = &copied
+	if conf.Resolver == nil {
+		conf.Resolver = DNSResolver{}
+	}
+	if conf.DefaultTTL == 0 {
+		conf.DefaultTTL = DefaultCacheTTL
+	}
+	if conf.NegativeTTL == 0 {
+		conf.NegativeTTL = DefaultCacheNegativeTTL
+	}
+	if conf.MaxEntries == 0 {
+		conf.MaxEntries = DefaultCacheMaxEntries
+	}
+	if conf.LookupTimeout == 0 {
+		conf.LookupTimeout = DefaultCacheLookupTimeout
+	}
+	return &CachingResolver{
+		config:   conf,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		inflight: make(map[string]*inflightLookup),
+	}
+}
+
+func (c *CachingResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ctx, ips, err := c.ResolveAll(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return ctx, ips[0], nil
+}
+
+func (c *CachingResolver) ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	key := canonicalName(name)
+
+	c.mu.Lock()
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*cacheEntry)
+		if time.Now().Before(entry.expires) {
+			c.lru.MoveToFront(elem)
+			c.stats.Hits++
+			c.mu.Unlock()
+			return ctx, entry.ips, entry.err
+		}
+		c.remove(elem)
+	}
+	c.stats.Misses++
+
+	call, ok := c.inflight[key]
+	if !ok {
+		call = &inflightLookup{done: make(chan struct{})}
+		c.inflight[key] = call
+		go c.share(ctx, key, name, call)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return ctx, call.ips, call.err
+	case <-ctx.Done():
+		return ctx, nil, ctx.Err()
+	}
+}
+
+// share looks up name for everyone waiting for call. The lookup sees the
+// values of ctx, but isn't cancelled along with it.
+func (c *CachingResolver) share(ctx context.Context, key, name string, call *inflightLookup) {
+	ctx, cancel := context.WithTimeout(detachedContext{ctx}, c.config.LookupTimeout)
+	defer cancel()
+	_, call.ips, call.ttl, call.err = c.lookup(ctx, name)
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	c.store(key, call)
+	c.mu.Unlock()
+	close(call.done)
+}
+
+// ResolveAddr passes reverse lookups on to the underlying resolver
+// uncached
+func (c *CachingResolver) ResolveAddr(ctx context.Context, ip net.IP) (context.Context, []string, error) {
+	return resolveAddr(ctx, c.config.Resolver, ip)
+}
+
+// Stats returns the cache's counters
+func (c *CachingResolver) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	return stats
+}
+
+// Flush drops all cached names
+func (c *CachingResolver) Flush() {
+	c.mu.Lock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.mu.Unlock()
+}
+
+// Forget drops a single name from the cache. It returns false if the name
+// wasn't cached.
+func (c *CachingResolver) Forget(name string) bool {
+	key := canonicalName(name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if ok {
+		c.remove(elem)
+	}
+	return ok
+}
+
+func (c *CachingResolver) lookup(ctx context.Context, name string) (context.Context, []net.IP, time.Duration, error) {
+	if r, ok := c.config.Resolver.(TTLNameResolver); ok {
+		return r.ResolveTTL(ctx, name)
+	}
+	ctx, ips, err := resolveAll(ctx, c.config.Resolver, name)
+	return ctx, ips, c.config.DefaultTTL, err
+}
+
+// store caches the result of a lookup. Must be called with c.mu held.
+func (c *CachingResolver) store(key string, call *inflightLookup) {
+	ttl := call.ttl
+	if call.err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(call.err, &dnsErr) || !dnsErr.IsNotFound {
+			// Only cache answers, not failures to get one
+			return
+		}
+		ttl = c.config.NegativeTTL
+	} else {
+		if c.config.MinTTL > 0 && ttl < c.config.MinTTL {
+			ttl = c.config.MinTTL
+		}
+		if c.config.MaxTTL > 0 && ttl > c.config.MaxTTL {
+			ttl = c.config.MaxTTL
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	for c.lru.Len() >= c.config.MaxEntries {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{
+		name:    key,
+		ips:     call.ips,
+		err:     call.err,
+		expires: time.Now().Add(ttl),
+	})
+}
+
+// remove drops elem from the cache. Must be called with c.mu held.
+func (c *CachingResolver) remove(elem *list.Element) {
+	delete(c.entries, elem.Value.(*cacheEntry).name)
+	c.lru.Remove(elem)
+}
@@ -0,0 +1,255 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingResolver struct {
+	calls int32
+	ttl   time.Duration
+	delay time.Duration
+}
+
+func (r *countingResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ctx, ips, _, err := r.ResolveTTL(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return ctx, ips[0], nil
+}
+
+func (r *countingResolver) ResolveTTL(ctx context.Context, name string) (context.Context, []net.IP, time.Duration, error) {
+	n := atomic.AddInt32(&r.calls, 1)
+	time.Sleep(r.delay)
+	switch name {
+	case "missing.example.com":
+		return ctx, nil, 0, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	case "broken.example.com":
+		return ctx, nil, 0, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	return ctx, []net.IP{net.IPv4(10, 0, 0, byte(n)), net.ParseIP("fd00::1")}, r.ttl, nil
+}
+
+func TestCachingResolver(t *testing.T) {
+	upstream := &countingResolver{ttl: time.Minute}
+	c := NewCachingResolver(&CachingResolverConfig{Resolver: upstream})
+	ctx := context.Background()
+
+	_, ip1, err := c.Resolve(ctx, "foo.example.com")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, ip2, err := c.Resolve(ctx, "FOO.example.com.")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !ip1.Equal(ip2) {
+		t.Fatalf("expected cached answer, got %v and %v", ip1, ip2)
+	}
+
+	_, ips, err := c.ResolveAll(ctx, "foo.example.com")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(ips) != 2 || !ips[0].Equal(ip1) {
+		t.Fatalf("expected all cached addresses, got %v", ips)
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 2 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+
+	if !c.Forget("foo.example.com") {
+		t.Fatalf("expected name to be cached")
+	}
+	_, ip3, _ := c.Resolve(ctx, "foo.example.com")
+	if ip3.Equal(ip1) {
+		t.Fatalf("expected new lookup after Forget")
+	}
+
+	c.Flush()
+	if c.Stats().Entries != 0 {
+		t.Fatalf("expected empty cache")
+	}
+}
+
+func TestCachingResolver_TTL(t *testing.T) {
+	upstream := &countingResolver{ttl: time.Hour}
+	c := NewCachingResolver(&CachingResolverConfig{
+		Resolver: upstream,
+		MaxTTL:   20 * time.Millisecond,
+	})
+	ctx := context.Background()
+
+	c.Resolve(ctx, "foo.example.com")
+	c.Resolve(ctx, "foo.example.com")
+	if n := atomic.LoadInt32(&upstream.calls); n != 1 {
+		t.Fatalf("expected 1 lookup, got %d", n)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	c.Resolve(ctx, "foo.example.com")
+	if n := atomic.LoadInt32(&upstream.calls); n != 2 {
+		t.Fatalf("expected 2 lookups, got %d", n)
+	}
+
+	// A zero TTL is raised to MinTTL
+	upstream.ttl = 0
+	c.config.MinTTL = time.Minute
+	c.Resolve(ctx, "bar.example.com")
+	c.Resolve(ctx, "bar.example.com")
+	if n := atomic.LoadInt32(&upstream.calls); n != 3 {
+		t.Fatalf("expected 3 lookups, got %d", n)
+	}
+}
+
+func TestCachingResolver_Negative(t *testing.T) {
+	upstream := &countingResolver{ttl: time.Minute}
+	c := NewCachingResolver(&CachingResolverConfig{Resolver: upstream})
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := c.Resolve(ctx, "missing.example.com"); err == nil {
+			t.Fatalf("expected error")
+		}
+	}
+	if n := atomic.LoadInt32(&upstream.calls); n != 1 {
+		t.Fatalf("expected NXDOMAIN to be cached, got %d lookups", n)
+	}
+
+	for i := 0; i < 3; i++ {
+		c.Resolve(ctx, "broken.example.com")
+	}
+	if n := atomic.LoadInt32(&upstream.calls); n != 4 {
+		t.Fatalf("expected failures not to be cached, got %d lookups", n)
+	}
+}
+
+func TestCachingResolver_Eviction(t *testing.T) {
+	upstream := &countingResolver{ttl: time.Minute}
+	c := NewCachingResolver(&CachingResolverConfig{
+		Resolver:   upstream,
+		MaxEntries: 2,
+	})
+	ctx := context.Background()
+
+	c.Resolve(ctx, "a.example.com")
+	c.Resolve(ctx, "b.example.com")
+	c.Resolve(ctx, "a.example.com")
+	c.Resolve(ctx, "c.example.com")
+
+	stats := c.Stats()
+	if stats.Evictions != 1 || stats.Entries != 2 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+	// b was least recently used
+	if c.Forget("b.example.com") {
+		t.Fatalf("expected b to be evicted")
+	}
+	if !c.Forget("a.example.com") {
+		t.Fatalf("expected a to be cached")
+	}
+}
+
+func TestCachingResolver_Collapse(t *testing.T) {
+	upstream := &countingResolver{ttl: time.Minute, delay: 20 * time.Millisecond}
+	c := NewCachingResolver(&CachingResolverConfig{Resolver: upstream})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, ip, err := c.Resolve(context.Background(), "foo.example.com")
+			if err == nil && ip == nil {
+				err = fmt.Errorf("missing ip")
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&upstream.calls); n != 1 {
+		t.Fatalf("expected 1 lookup, got %d", n)
+	}
+}
+
+func TestCachingResolver_Defaults(t *testing.T) {
+	conf := &CachingResolverConfig{}
+	c := NewCachingResolver(conf)
+	if conf.Resolver != nil || conf.DefaultTTL != 0 || conf.NegativeTTL != 0 || conf.MaxEntries != 0 {
+		t.Fatalf("config modified: %+v", conf)
+	}
+	if c.config.MaxEntries != DefaultCacheMaxEntries || c.config.DefaultTTL != DefaultCacheTTL {
+		t.Fatalf("defaults not applied: %+v", c.config)
+	}
+}
+
+// blockingResolver answers once released, unless the lookup is cancelled
+type blockingResolver struct {
+	release chan struct{}
+	client  chan net.Addr
+}
+
+func (r *blockingResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	addr, _ := ClientAddrFromContext(ctx)
+	r.client <- addr
+	select {
+	case <-r.release:
+		return ctx, net.ParseIP("192.0.2.1"), nil
+	case <-ctx.Done():
+		return ctx, nil, ctx.Err()
+	}
+}
+
+func TestCachingResolver_CollapseCancel(t *testing.T) {
+	upstream := &blockingResolver{release: make(chan struct{}), client: make(chan net.Addr, 1)}
+	c := NewCachingResolver(&CachingResolverConfig{Resolver: upstream})
+
+	// The first caller gives up while a second one waits for the same name
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	ctx, cancel := context.WithCancel(WithClientAddr(context.Background(), addr))
+	first := make(chan error, 1)
+	go func() {
+		_, _, err := c.Resolve(ctx, "foo.example.com")
+		first <- err
+	}()
+	// The lookup still sees the first caller's values
+	if got := <-upstream.client; got != addr {
+		t.Fatalf("bad client: %v", got)
+	}
+	second := make(chan error, 1)
+	go func() {
+		_, ip, err := c.Resolve(context.Background(), "foo.example.com")
+		if err == nil && !ip.Equal(net.ParseIP("192.0.2.1")) {
+			err = fmt.Errorf("bad ip: %v", ip)
+		}
+		second <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+	close(upstream.release)
+	if err := <-second; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stats := c.Stats(); stats.Entries != 1 {
+		t.Fatalf("expected the answer to be cached: %+v", stats)
+	}
+}
@@ -0,0 +1,211 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// HostsResolverName is recorded for names answered by the hosts table
+	HostsResolverName = "hosts"
+	// DefaultResolverName is recorded for names answered by the default
+	// resolver, unless RoutingResolverConfig.DefaultName is set
+	DefaultResolverName = "default"
+)
+
+// ResolverRoute sends lookups of names within a domain to a resolver
+type ResolverRoute struct {
+	// Name is recorded on the context for names answered by this route.
+	// Defaults to the first suffix.
+	Name string
+
+	// Suffixes are the domains this route applies to. A suffix matches
+	// the domain itself and all names below it.
+	Suffixes []string
+
+	// Resolver answers lookups for names matching Suffixes
+	Resolver NameResolver
+}
+
+// RoutingResolverConfig is used to setup a RoutingResolver
+type RoutingResolverConfig struct {
+	// Hosts maps names to fixed addresses. They take precedence over
+	// all resolvers.
+	Hosts map[string][]net.IP
+
+	// Routes of names to resolvers. If several suffixes match a name,
+	// the longest one wins.
+	Routes []ResolverRoute
+
+	// Default answers lookups for names not matching any route.
+	// Defaults to DNSResolver.
+	Default NameResolver
+
+	// DefaultName is recorded on the context for names answered by Default.
+	// Defaults to DefaultResolverName.
+	DefaultName string
+}
+
+type resolverRoute struct {
+	name     string
+	suffix   string
+	resolver NameResolver
+}
+
+// RoutingResolver is a NameResolver implementing split-horizon DNS. Each
+// name is looked up in a static hosts table first, and only then sent to
+// the resolver responsible for its domain. The name of the resolver that
+// answered is recorded on the returned context, see
+// ResolverNameFromContext.
+type RoutingResolver struct {
+	hosts       map[string][]net.IP
+	routes      []resolverRoute
+	defaultName string
+	resolver    NameResolver
+}
+
+// NewRoutingResolver creates a new RoutingResolver
+func NewRoutingResolver(conf *RoutingResolverConfig) (*RoutingResolver, error) {
+	r := &RoutingResolver{
+		hosts:       make(map[string][]net.IP, len(conf.Hosts)),
+		defaultName: conf.DefaultName,
+		resolver:    conf.Default,
+	}
+	if r.resolver == nil {
+		r.resolver = DNSResolver{}
+	}
+	if r.defaultName == "" {
+		r.defaultName = DefaultResolverName
+	}
+
+	for name, ips := range conf.Hosts {
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("No addresses given for host %s", name)
+		}
+		key := canonicalName(name)
+		r.hosts[key] = append(r.hosts[key], ips...)
+	}
+
+	for i, route := range conf.Routes {
+		if route.Resolver == nil {
+			return nil, fmt.Errorf("No resolver given for route #%d", i)
+		}
+		if len(route.Suffixes) == 0 {
+			return nil, fmt.Errorf("No suffixes given for route #%d", i)
+		}
+		name := route.Name
+		if name == "" {
+			name = canonicalName(route.Suffixes[0])
+		}
+		for _, suffix := range route.Suffixes {
+			r.routes = append(r.routes, resolverRoute{
+				name:     name,
+				suffix:   canonicalName(suffix),
+				resolver: route.Resolver,
+			})
+		}
+	}
+	return r, nil
+}
+
+func (r *RoutingResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ctx, ips, err := r.ResolveAll(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return ctx, ips[0], nil
+}
+
+func (r *RoutingResolver) ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	key := canonicalName(name)
+	if ips, ok := r.hosts[key]; ok {
+		return WithResolverName(ctx, HostsResolverName), ips, nil
+	}
+
+	resolverName, resolver := r.route(key)
+	return resolveAll(WithResolverName(ctx, resolverName), resolver, name)
+}
+
+// ResolveAddr answers from the hosts table first. Other addresses are
+// routed by their reverse name, e.g. 10.in-addr.arpa.
+func (r *RoutingResolver) ResolveAddr(ctx context.Context, ip net.IP) (context.Context, []string, error) {
+	var names []string
+	for name, ips := range r.hosts {
+		if containsIP(ips, ip) {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		return WithResolverName(ctx, HostsResolverName), names, nil
+	}
+
+	arpa, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return ctx, nil, err
+	}
+	resolverName, resolver := r.route(canonicalName(arpa))
+	return resolveAddr(WithResolverName(ctx, resolverName), resolver, ip)
+}
+
+// route returns the resolver responsible for name
+func (r *RoutingResolver) route(name string) (string, NameResolver) {
+	var best *resolverRoute
+	for i, route := range r.routes {
+		if name != route.suffix && !strings.HasSuffix(name, "."+route.suffix) {
+			continue
+		}
+		if best == nil || len(route.suffix) > len(best.suffix) {
+			best = &r.routes[i]
+		}
+	}
+	if best == nil {
+		return r.defaultName, r.resolver
+	}
+	return best.name, best.resolver
+}
+
+// ParseHosts reads a hosts file, as used by /etc/hosts: each line holds
+// an address followed by one or more names. Text following a '#' is
+// ignored.
+func ParseHosts(reader io.Reader) (map[string][]net.IP, error) {
+	hosts := make(map[string][]net.IP)
+	scanner := bufio.NewScanner(reader)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("Line %d: missing host name", lineNo)
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			return nil, fmt.Errorf("Line %d: invalid address %s", lineNo, fields[0])
+		}
+		for _, name := range fields[1:] {
+			key := canonicalName(name)
+			hosts[key] = append(hosts[key], ip)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+// canonicalName lowercases name and strips a trailing dot
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
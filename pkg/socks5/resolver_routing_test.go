@@ -0,0 +1,97 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+type staticResolver struct {
+	ip net.IP
+}
+
+func (r staticResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, r.ip, nil
+}
+
+func TestRoutingResolver(t *testing.T) {
+	r, err := NewRoutingResolver(&RoutingResolverConfig{
+		Hosts: map[string][]net.IP{
+			"Pinned.corp.internal.": {net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")},
+		},
+		Routes: []ResolverRoute{
+			{Suffixes: []string{"corp.internal"}, Resolver: staticResolver{net.ParseIP("10.0.0.1")}},
+			{Name: "lab", Suffixes: []string{"lab.corp.internal", "lab.example"}, Resolver: staticResolver{net.ParseIP("10.0.0.2")}},
+		},
+		Default: staticResolver{net.ParseIP("198.51.100.1")},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cases := []struct {
+		name     string
+		ip       string
+		resolver string
+	}{
+		{"pinned.corp.internal", "192.0.2.1", HostsResolverName},
+		{"corp.internal", "10.0.0.1", "corp.internal"},
+		{"www.CORP.internal.", "10.0.0.1", "corp.internal"},
+		{"db.lab.corp.internal", "10.0.0.2", "lab"},
+		{"lab.example", "10.0.0.2", "lab"},
+		{"notcorp.internal", "198.51.100.1", DefaultResolverName},
+		{"example.com", "198.51.100.1", DefaultResolverName},
+	}
+	for _, c := range cases {
+		ctx, ip, err := r.Resolve(context.Background(), c.name)
+		if err != nil {
+			t.Fatalf("%s: err: %v", c.name, err)
+		}
+		if !ip.Equal(net.ParseIP(c.ip)) {
+			t.Fatalf("%s: bad ip: %v", c.name, ip)
+		}
+		if name, _ := ResolverNameFromContext(ctx); name != c.resolver {
+			t.Fatalf("%s: bad resolver: %v", c.name, name)
+		}
+	}
+
+	_, ips, err := r.ResolveAll(context.Background(), "pinned.corp.internal")
+	if err != nil || len(ips) != 2 {
+		t.Fatalf("bad: %v %v", ips, err)
+	}
+}
+
+func TestRoutingResolver_Invalid(t *testing.T) {
+	if _, err := NewRoutingResolver(&RoutingResolverConfig{
+		Routes: []ResolverRoute{{Suffixes: []string{"corp.internal"}}},
+	}); err == nil {
+		t.Fatalf("expected error for missing resolver")
+	}
+	if _, err := NewRoutingResolver(&RoutingResolverConfig{
+		Hosts: map[string][]net.IP{"foo": nil},
+	}); err == nil {
+		t.Fatalf("expected error for missing addresses")
+	}
+}
+
+func TestParseHosts(t *testing.T) {
+	hosts, err := ParseHosts(strings.NewReader(`
+# Comment
+192.0.2.1   foo.example.com foo
+2001:db8::1 foo.example.com # trailing comment
+`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(hosts["foo.example.com"]) != 2 || len(hosts["foo"]) != 1 {
+		t.Fatalf("bad: %v", hosts)
+	}
+
+	if _, err := ParseHosts(strings.NewReader("192.0.2.1\n")); err == nil {
+		t.Fatalf("expected error for missing name")
+	}
+	if _, err := ParseHosts(strings.NewReader("foo bar\n")); err == nil {
+		t.Fatalf("expected error for invalid address")
+	}
+}
@@ -0,0 +1,340 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultUpstreamTimeout is used if UpstreamResolverConfig.Timeout is zero
+	DefaultUpstreamTimeout = 2 * time.Second
+	// DefaultUpstreamRetries is used if UpstreamResolverConfig.Retries is zero
+	DefaultUpstreamRetries = 2
+
+	dohMediaType = "application/dns-message"
+)
+
+// UpstreamResolverConfig is used to setup an UpstreamResolver
+type UpstreamResolverConfig struct {
+	// Servers to query. Each server is given as URL:
+	//   udp://192.0.2.1:53         plain DNS over UDP, falls back to TCP
+	//   tcp://192.0.2.1:53         plain DNS over TCP
+	//   tls://192.0.2.1:853        DNS-over-TLS
+	//   https://dns.example/query  DNS-over-HTTPS
+	// An address without scheme is queried over UDP, port 53 is assumed
+	// if none is given.
+	Servers []string
+
+	// Timeout for a single query.
+	// Defaults to DefaultUpstreamTimeout.
+	Timeout time.Duration
+
+	// Retries is the number of additional queries made after a failed
+	// one, each to the next server.
+	// Defaults to DefaultUpstreamRetries. Use a negative value to disable.
+	Retries int
+
+	// TLSConfig is used for DNS-over-TLS and DNS-over-HTTPS servers
+	TLSConfig *tls.Config
+}
+
+type upstreamServer struct {
+	network string
+	address string
+}
+
+func (u *upstreamServer) String() string {
+	return u.network + "://" + u.address
+}
+
+// UpstreamResolver is a NameResolver querying explicitly configured DNS
+// servers instead of the system resolver. Queries are spread across the
+// servers round robin.
+type UpstreamResolver struct {
+	config  *UpstreamResolverConfig
+	servers []*upstreamServer
+	next    uint32
+	client  *http.Client
+}
+
+// NewUpstreamResolver creates a new UpstreamResolver
+func NewUpstreamResolver(conf *UpstreamResolverConfig) (*UpstreamResolver, error) {
+	// Defaults are filled in on a copy, leaving the caller's config as is
+	copied := *conf
+	conf = &copied
+	if len(conf.Servers) == 0 {
+		return nil, fmt.Errorf("At least one server must be specified")
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = DefaultUpstreamTimeout
+	}
+	if conf.Retries == 0 {
+		conf.Retries = DefaultUpstreamRetries
+	} else if conf.Retries < 0 {
+		conf.Retries = 0
+	}
+
+	servers := make([]*upstreamServer, len(conf.Servers))
+	for i, s := range conf.Servers {
+		server, err := parseUpstreamServer(s)
+		if err != nil {
+			return nil, err
+		}
+		servers[i] = server
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if conf.TLSConfig != nil {
+		transport.TLSClientConfig = conf.TLSConfig
+	}
+
+	return &UpstreamResolver{
+		config:  conf,
+		servers: servers,
+		client: &http.Client{
+			Timeout:   conf.Timeout,
+			Transport: transport,
+		},
+	}, nil
+}
+
+func parseUpstreamServer(s string) (*upstreamServer, error) {
+	if !strings.Contains(s, "://") {
+		s = "udp://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid DNS server %s: %v", s, err)
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp":
+		return &upstreamServer{u.Scheme, withDefaultPort(u.Host, "53")}, nil
+	case "tls":
+		return &upstreamServer{"tcp-tls", withDefaultPort(u.Host, "853")}, nil
+	case "https":
+		return &upstreamServer{"https", u.String()}, nil
+	}
+	return nil, fmt.Errorf("Unsupported DNS server scheme: %s", u.Scheme)
+}
+
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+func (r *UpstreamResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ctx, ips, _, err := r.ResolveTTL(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return ctx, ips[0], nil
+}
+
+func (r *UpstreamResolver) ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	ctx, ips, _, err := r.ResolveTTL(ctx, name)
+	return ctx, ips, err
+}
+
+func (r *UpstreamResolver) ResolveTTL(ctx context.Context, name string) (context.Context, []net.IP, time.Duration, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		return ctx, []net.IP{ip}, 0, nil
+	}
+
+	// Query both families concurrently, starting at the same server
+	start := atomic.AddUint32(&r.next, 1)
+	type result struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	results := make(chan result, 1)
+	go func() {
+		ips, ttl, err := r.lookup(ctx, start, name, dns.TypeAAAA)
+		results <- result{ips, ttl, err}
+	}()
+	ips, ttl, err := r.lookup(ctx, start, name, dns.TypeA)
+	v6 := <-results
+
+	if len(v6.ips) > 0 && (len(ips) == 0 || v6.ttl < ttl) {
+		ttl = v6.ttl
+	}
+	ips = append(ips, v6.ips...)
+	if len(ips) == 0 {
+		if err == nil {
+			err = v6.err
+		}
+		if err == nil {
+			err = &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		return ctx, nil, 0, err
+	}
+	return ctx, ips, ttl, nil
+}
+
+func (r *UpstreamResolver) ResolveAddr(ctx context.Context, ip net.IP) (context.Context, []string, error) {
+	arpa, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return ctx, nil, err
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion(arpa, dns.TypePTR)
+
+	resp, err := r.exchange(ctx, atomic.AddUint32(&r.next, 1), msg)
+	if err != nil {
+		return ctx, nil, &net.DNSError{Err: err.Error(), Name: arpa, IsTemporary: true}
+	}
+	if resp.Rcode == dns.RcodeNameError {
+		return ctx, nil, &net.DNSError{Err: "no such host", Name: arpa, IsNotFound: true}
+	} else if resp.Rcode != dns.RcodeSuccess {
+		return ctx, nil, &net.DNSError{Err: dns.RcodeToString[resp.Rcode], Name: arpa, IsTemporary: true}
+	}
+
+	var names []string
+	for _, rr := range resp.Answer {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			names = append(names, ptr.Ptr)
+		}
+	}
+	if len(names) == 0 {
+		return ctx, nil, &net.DNSError{Err: "no such host", Name: arpa, IsNotFound: true}
+	}
+	return ctx, names, nil
+}
+
+// lookup queries a single record type. It returns all addresses and the
+// lowest TTL of the answer. The returned slice is empty if the name exists
+// but has no records of that type.
+func (r *UpstreamResolver) lookup(ctx context.Context, start uint32, name string, qtype uint16) ([]net.IP, time.Duration, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+
+	resp, err := r.exchange(ctx, start, msg)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: name, IsTemporary: true}
+	}
+
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+	case dns.RcodeNameError:
+		return nil, 0, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	default:
+		return nil, 0, &net.DNSError{Err: dns.RcodeToString[resp.Rcode], Name: name, IsTemporary: true}
+	}
+
+	var ips []net.IP
+	var minTTL time.Duration
+	for _, rr := range resp.Answer {
+		var ip net.IP
+		switch rec := rr.(type) {
+		case *dns.A:
+			ip = rec.A
+		case *dns.AAAA:
+			ip = rec.AAAA
+		default:
+			continue
+		}
+		ttl := time.Duration(rr.Header().Ttl) * time.Second
+		if len(ips) == 0 || ttl < minTTL {
+			minTTL = ttl
+		}
+		ips = append(ips, ip)
+	}
+	return ips, minTTL, nil
+}
+
+// exchange sends msg to the configured servers in turn, beginning with the
+// server at index start, until a server answers or all retries are used up
+func (r *UpstreamResolver) exchange(ctx context.Context, start uint32, msg *dns.Msg) (*dns.Msg, error) {
+	var err error
+	for attempt := 0; attempt <= r.config.Retries; attempt++ {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		server := r.servers[(int(start)+attempt)%len(r.servers)]
+
+		var resp *dns.Msg
+		resp, err = r.exchangeWith(ctx, server, msg)
+		if err == nil {
+			return resp, nil
+		}
+		err = fmt.Errorf("%v: %v", server, err)
+	}
+	return nil, err
+}
+
+func (r *UpstreamResolver) exchangeWith(ctx context.Context, server *upstreamServer, msg *dns.Msg) (*dns.Msg, error) {
+	if server.network == "https" {
+		return r.exchangeHTTPS(ctx, server.address, msg)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.config.Timeout)
+	defer cancel()
+
+	client := &dns.Client{
+		Net:       server.network,
+		Timeout:   r.config.Timeout,
+		TLSConfig: r.config.TLSConfig,
+	}
+	resp, _, err := client.ExchangeContext(ctx, msg, server.address)
+	if err == nil && resp.Truncated && server.network == "udp" {
+		client.Net = "tcp"
+		resp, _, err = client.ExchangeContext(ctx, msg, server.address)
+	}
+	return resp, err
+}
+
+func (r *UpstreamResolver) exchangeHTTPS(ctx context.Context, url string, msg *dns.Msg) (*dns.Msg, error) {
+	// RFC 8484 recommends a message ID of 0 for cache friendliness
+	query := msg.Copy()
+	query.Id = 0
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected HTTP status: %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	answer := new(dns.Msg)
+	if err := answer.Unpack(body); err != nil {
+		return nil, err
+	}
+	answer.Id = msg.Id
+	return answer, nil
+}
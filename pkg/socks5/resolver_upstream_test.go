@@ -0,0 +1,278 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnsStandIn answers queries for foo.example.com, v6.example.com and
+// dual.example.com and NXDOMAIN otherwise
+func dnsStandIn(calls *int32) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		if calls != nil {
+			atomic.AddInt32(calls, 1)
+		}
+		w.WriteMsg(dnsAnswer(req))
+	}
+}
+
+func dnsAnswer(req *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	q := req.Question[0]
+	switch {
+	case q.Name == "foo.example.com." && q.Qtype == dns.TypeA:
+		rr, _ := dns.NewRR("foo.example.com. 300 IN A 192.0.2.10")
+		resp.Answer = append(resp.Answer, rr)
+	case q.Name == "v6.example.com." && q.Qtype == dns.TypeAAAA:
+		rr, _ := dns.NewRR("v6.example.com. 60 IN AAAA 2001:db8::10")
+		resp.Answer = append(resp.Answer, rr)
+	case q.Name == "dual.example.com." && q.Qtype == dns.TypeA:
+		rr1, _ := dns.NewRR("dual.example.com. 120 IN A 192.0.2.20")
+		rr2, _ := dns.NewRR("dual.example.com. 90 IN A 192.0.2.21")
+		resp.Answer = append(resp.Answer, rr1, rr2)
+	case q.Name == "dual.example.com." && q.Qtype == dns.TypeAAAA:
+		rr, _ := dns.NewRR("dual.example.com. 30 IN AAAA 2001:db8::20")
+		resp.Answer = append(resp.Answer, rr)
+	case q.Name == "foo.example.com.", q.Name == "v6.example.com.":
+	default:
+		resp.Rcode = dns.RcodeNameError
+	}
+	return resp
+}
+
+func startDNSServer(t *testing.T, network string, handler dns.Handler) (string, func()) {
+	srv := &dns.Server{Handler: handler}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+
+	switch network {
+	case "udp":
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		srv.PacketConn = pc
+		go srv.ActivateAndServe()
+		<-started
+		return pc.LocalAddr().String(), func() { srv.Shutdown() }
+	default:
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		srv.Listener = l
+		go srv.ActivateAndServe()
+		<-started
+		return l.Addr().String(), func() { srv.Shutdown() }
+	}
+}
+
+func TestUpstreamResolver_UDP(t *testing.T) {
+	addr, stop := startDNSServer(t, "udp", dnsStandIn(nil))
+	defer stop()
+
+	r, err := NewUpstreamResolver(&UpstreamResolverConfig{Servers: []string{addr}})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	_, ips, ttl, err := r.ResolveTTL(context.Background(), "foo.example.com")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.10")) {
+		t.Fatalf("bad ips: %v", ips)
+	}
+	if ttl != 300*time.Second {
+		t.Fatalf("bad ttl: %v", ttl)
+	}
+
+	_, ip, err := r.Resolve(context.Background(), "v6.example.com")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("2001:db8::10")) {
+		t.Fatalf("bad ip: %v", ip)
+	}
+
+	_, _, err = r.Resolve(context.Background(), "missing.example.com")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func TestUpstreamResolver_DualStack(t *testing.T) {
+	addr, stop := startDNSServer(t, "udp", dnsStandIn(nil))
+	defer stop()
+
+	r, err := NewUpstreamResolver(&UpstreamResolverConfig{Servers: []string{addr}})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	_, ips, ttl, err := r.ResolveTTL(context.Background(), "dual.example.com")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(ips) != 3 {
+		t.Fatalf("expected all addresses, got %v", ips)
+	}
+	if ttl != 30*time.Second {
+		t.Fatalf("expected lowest ttl, got %v", ttl)
+	}
+}
+
+func TestUpstreamResolver_TCP(t *testing.T) {
+	addr, stop := startDNSServer(t, "tcp", dnsStandIn(nil))
+	defer stop()
+
+	r, err := NewUpstreamResolver(&UpstreamResolverConfig{Servers: []string{"tcp://" + addr}})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	_, ip, err := r.Resolve(context.Background(), "foo.example.com")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("192.0.2.10")) {
+		t.Fatalf("bad ip: %v", ip)
+	}
+}
+
+func TestUpstreamResolver_TLS(t *testing.T) {
+	// Borrow httptest's certificate for 127.0.0.1
+	hs := httptest.NewTLSServer(http.NotFoundHandler())
+	defer hs.Close()
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", hs.TLS)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	srv := &dns.Server{Listener: l, Net: "tcp-tls", Handler: dnsStandIn(nil)}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	r, err := NewUpstreamResolver(&UpstreamResolverConfig{
+		Servers:   []string{"tls://" + l.Addr().String()},
+		TLSConfig: hs.Client().Transport.(*http.Transport).TLSClientConfig,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	_, ip, err := r.Resolve(context.Background(), "foo.example.com")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("192.0.2.10")) {
+		t.Fatalf("bad ip: %v", ip)
+	}
+}
+
+func TestUpstreamResolver_HTTPS(t *testing.T) {
+	hs := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dohMediaType {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		req := new(dns.Msg)
+		if err := req.Unpack(body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		packed, _ := dnsAnswer(req).Pack()
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(packed)
+	}))
+	defer hs.Close()
+
+	r, err := NewUpstreamResolver(&UpstreamResolverConfig{
+		Servers:   []string{hs.URL + "/dns-query"},
+		TLSConfig: hs.Client().Transport.(*http.Transport).TLSClientConfig,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	_, ip, err := r.Resolve(context.Background(), "foo.example.com")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("192.0.2.10")) {
+		t.Fatalf("bad ip: %v", ip)
+	}
+}
+
+func TestUpstreamResolver_Failover(t *testing.T) {
+	var calls int32
+	addr, stop := startDNSServer(t, "udp", dnsStandIn(&calls))
+	defer stop()
+
+	// Nothing listens on the first server
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	dead := pc.LocalAddr().String()
+	pc.Close()
+
+	r, err := NewUpstreamResolver(&UpstreamResolverConfig{
+		Servers: []string{dead, addr},
+		Timeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		if _, _, err := r.Resolve(context.Background(), "foo.example.com"); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	// Both the A and AAAA query of each lookup reach the live server
+	if n := atomic.LoadInt32(&calls); n != 8 {
+		t.Fatalf("expected 8 queries to reach the live server, got %d", n)
+	}
+
+	r.config.Retries = 0
+	failures := 0
+	for i := 0; i < 4; i++ {
+		if _, _, err := r.Resolve(context.Background(), "foo.example.com"); err != nil {
+			failures++
+		}
+	}
+	if failures != 2 {
+		t.Fatalf("expected rotation to hit the dead server twice, got %d failures", failures)
+	}
+}
+
+func TestUpstreamResolver_Defaults(t *testing.T) {
+	// Reusing a config must not turn "no retries" into the default
+	conf := &UpstreamResolverConfig{Servers: []string{"127.0.0.1"}, Retries: -1}
+	for i := 0; i < 2; i++ {
+		r, err := NewUpstreamResolver(conf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if r.config.Retries != 0 || r.config.Timeout != DefaultUpstreamTimeout {
+			t.Fatalf("bad config: %+v", r.config)
+		}
+	}
+	if conf.Retries != -1 || conf.Timeout != 0 {
+		t.Fatalf("config modified: %+v", conf)
+	}
+}
@@ -0,0 +1,178 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	From int
+	To   int
+}
+
+// ParsePortRange parses a single port, e.g. "80", or a range of ports,
+// e.g. "8000-8099"
+func ParsePortRange(s string) (PortRange, error) {
+	from, to := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		from, to = s[:i], s[i+1:]
+	}
+	var r PortRange
+	var err error
+	if r.From, err = strconv.Atoi(strings.TrimSpace(from)); err != nil {
+		return r, fmt.Errorf("Invalid port range %s", s)
+	}
+	if r.To, err = strconv.Atoi(strings.TrimSpace(to)); err != nil {
+		return r, fmt.Errorf("Invalid port range %s", s)
+	}
+	if r.From < 1 || r.To > 65535 || r.From > r.To {
+		return r, fmt.Errorf("Invalid port range %s", s)
+	}
+	return r, nil
+}
+
+func (r PortRange) Contains(port int) bool {
+	return port >= r.From && port <= r.To
+}
+
+func (r PortRange) String() string {
+	if r.From == r.To {
+		return strconv.Itoa(r.From)
+	}
+	return fmt.Sprintf("%d-%d", r.From, r.To)
+}
+
+// RewriteRule redirects matching destinations. A destination matches if
+// it matches one of the values of each criterion given. Criteria left
+// empty match any destination.
+type RewriteRule struct {
+	// Domains match the requested name, and all names below it
+	Domains []string
+
+	// Networks match the destination address. Requested names are
+	// resolved to check them.
+	Networks []net.IPNet
+
+	// Ports match the destination port
+	Ports []PortRange
+
+	// Host replaces the destination address. It can either be an IP
+	// address or a name. Empty keeps the requested destination.
+	Host string
+
+	// Port replaces the destination port. If Port is a range, ports are
+	// mapped one to one from the matching range of Ports, which must be
+	// of equal size. A zero range keeps the requested port.
+	Port PortRange
+}
+
+// RuleRewriter is an AddressRewriter applying the first matching
+// RewriteRule
+type RuleRewriter struct {
+	rules []RewriteRule
+}
+
+// NewRuleRewriter creates a new RuleRewriter
+func NewRuleRewriter(rules []RewriteRule) (*RuleRewriter, error) {
+	r := &RuleRewriter{rules: make([]RewriteRule, len(rules))}
+	for i, rule := range rules {
+		if rule.Host == "" && rule.Port.From == 0 {
+			return nil, fmt.Errorf("Rewrite #%d changes neither host nor port", i)
+		}
+		if rule.Port.From != rule.Port.To {
+			if len(rule.Ports) == 0 {
+				return nil, fmt.Errorf("Rewrite #%d maps port range %v, but matches no ports", i, rule.Port)
+			}
+			for _, ports := range rule.Ports {
+				if ports.To-ports.From != rule.Port.To-rule.Port.From {
+					return nil, fmt.Errorf("Rewrite #%d maps port range %v to %v of different size", i, ports, rule.Port)
+				}
+			}
+		}
+		domains := make([]string, len(rule.Domains))
+		for j, domain := range rule.Domains {
+			domains[j] = canonicalName(domain)
+		}
+		rule.Domains = domains
+		r.rules[i] = rule
+	}
+	return r, nil
+}
+
+func (r *RuleRewriter) Rewrite(ctx context.Context, req *Request) (context.Context, *AddrSpec) {
+	dest := req.DestAddr
+	for i := range r.rules {
+		rule := &r.rules[i]
+		var matches bool
+		ctx, matches = rule.match(ctx, req)
+		if !matches {
+			continue
+		}
+
+		rewritten := &AddrSpec{FQDN: dest.FQDN, IP: dest.IP, Port: dest.Port}
+		if rule.Host != "" {
+			rewritten.FQDN, rewritten.IP = "", nil
+			if ip := net.ParseIP(rule.Host); ip != nil {
+				rewritten.IP = ip
+			} else {
+				rewritten.FQDN = rule.Host
+			}
+		}
+		if rule.Port.From != 0 {
+			rewritten.Port = rule.Port.From
+			for _, ports := range rule.Ports {
+				if rule.Port.From != rule.Port.To && ports.Contains(dest.Port) {
+					rewritten.Port += dest.Port - ports.From
+					break
+				}
+			}
+		}
+		return ctx, rewritten
+	}
+	return ctx, dest
+}
+
+func (rule *RewriteRule) match(ctx context.Context, req *Request) (context.Context, bool) {
+	dest := req.DestAddr
+	if len(rule.Ports) > 0 {
+		matches := false
+		for _, ports := range rule.Ports {
+			matches = matches || ports.Contains(dest.Port)
+		}
+		if !matches {
+			return ctx, false
+		}
+	}
+
+	if len(rule.Domains) > 0 {
+		if dest.FQDN == "" {
+			return ctx, false
+		}
+		name := canonicalName(dest.FQDN)
+		matches := false
+		for _, domain := range rule.Domains {
+			matches = matches || name == domain || strings.HasSuffix(name, "."+domain)
+		}
+		if !matches {
+			return ctx, false
+		}
+	}
+
+	if len(rule.Networks) > 0 {
+		ctx, err := req.ResolveDestination(ctx)
+		if err != nil || dest.IP == nil {
+			return ctx, false
+		}
+		for _, network := range rule.Networks {
+			if network.Contains(dest.IP) {
+				return ctx, true
+			}
+		}
+		return ctx, false
+	}
+	return ctx, true
+}
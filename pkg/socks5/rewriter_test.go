@@ -0,0 +1,94 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestParsePortRange(t *testing.T) {
+	if r, err := ParsePortRange("80"); err != nil || r != (PortRange{80, 80}) {
+		t.Fatalf("bad: %v %v", r, err)
+	}
+	if r, err := ParsePortRange("8000-8099"); err != nil || r != (PortRange{8000, 8099}) {
+		t.Fatalf("bad: %v %v", r, err)
+	}
+	for _, s := range []string{"", "0", "http", "90-80", "1-65536"} {
+		if _, err := ParsePortRange(s); err == nil {
+			t.Fatalf("expected error for %q", s)
+		}
+	}
+}
+
+func TestRuleRewriter(t *testing.T) {
+	_, staging, _ := net.ParseCIDR("10.20.0.0/16")
+	r, err := NewRuleRewriter([]RewriteRule{
+		{Domains: []string{"db.prod"}, Ports: []PortRange{{5432, 5432}}, Host: "10.1.2.3", Port: PortRange{6432, 6432}},
+		{Ports: []PortRange{{8000, 8099}}, Port: PortRange{9000, 9099}},
+		{Domains: []string{"web.example.com"}, Ports: []PortRange{{1, 65535}}, Port: PortRange{8080, 8080}},
+		{Domains: []string{"staging.example.com"}, Host: "192.0.2.50"},
+		{Networks: []net.IPNet{*staging}, Host: "gateway.example.com"},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cases := []struct {
+		dest   AddrSpec
+		expect string
+	}{
+		{AddrSpec{FQDN: "db.prod", Port: 5432}, "10.1.2.3:6432"},
+		{AddrSpec{FQDN: "db.prod", Port: 5433}, "db.prod:5433"},
+		{AddrSpec{IP: net.ParseIP("192.0.2.1"), Port: 8042}, "192.0.2.1:9042"},
+		{AddrSpec{FQDN: "web.example.com", Port: 443}, "web.example.com:8080"},
+		{AddrSpec{FQDN: "web.example.com", Port: 65000}, "web.example.com:8080"},
+		{AddrSpec{FQDN: "www.staging.example.com", Port: 443}, "192.0.2.50:443"},
+		{AddrSpec{IP: net.ParseIP("10.20.1.1"), Port: 22}, "gateway.example.com:22"},
+		{AddrSpec{IP: net.ParseIP("10.21.1.1"), Port: 22}, "10.21.1.1:22"},
+	}
+	for _, c := range cases {
+		dest := c.dest
+		req := &Request{DestAddr: &dest}
+		_, rewritten := r.Rewrite(context.Background(), req)
+		if addr := rewritten.Address(); addr != c.expect {
+			t.Fatalf("%v: expected %v, got %v", &dest, c.expect, addr)
+		}
+		if c.expect == dest.Address() && rewritten != req.DestAddr {
+			t.Fatalf("%v: expected destination to be kept", &dest)
+		}
+	}
+}
+
+func TestRuleRewriter_ResolvesForNetworks(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+	r, err := NewRuleRewriter([]RewriteRule{
+		{Networks: []net.IPNet{*network}, Port: PortRange{8080, 8080}},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req := &Request{
+		DestAddr: &AddrSpec{FQDN: "foo.example.com", Port: 80},
+		resolver: staticResolver{net.ParseIP("10.0.0.1")},
+	}
+	ctx, rewritten := r.Rewrite(context.Background(), req)
+	if rewritten.Address() != "10.0.0.1:8080" {
+		t.Fatalf("bad: %v", rewritten)
+	}
+	if _, ok := DestinationIPsFromContext(ctx); !ok {
+		t.Fatalf("expected resolved addresses on context")
+	}
+}
+
+func TestRuleRewriter_Invalid(t *testing.T) {
+	if _, err := NewRuleRewriter([]RewriteRule{{Domains: []string{"foo"}}}); err == nil {
+		t.Fatalf("expected error for rule without target")
+	}
+	if _, err := NewRuleRewriter([]RewriteRule{{Port: PortRange{9000, 9099}}}); err == nil {
+		t.Fatalf("expected error for port range without ports")
+	}
+	if _, err := NewRuleRewriter([]RewriteRule{{Ports: []PortRange{{8000, 8009}}, Port: PortRange{9000, 9099}}}); err == nil {
+		t.Fatalf("expected error for port ranges of different size")
+	}
+}
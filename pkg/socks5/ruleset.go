@@ -11,12 +11,12 @@ type RuleSet interface {
 
 // PermitAll returns a RuleSet which allows all types of connections
 func PermitAll() RuleSet {
-	return &PermitCommand{true, true, true}
+	return &PermitCommand{true, true, true, true, true}
 }
 
 // PermitNone returns a RuleSet which disallows all types of connections
 func PermitNone() RuleSet {
-	return &PermitCommand{false, false, false}
+	return &PermitCommand{false, false, false, false, false}
 }
 
 // PermitCommand is an implementation of the RuleSet which
@@ -25,6 +25,10 @@ type PermitCommand struct {
 	EnableConnect   bool
 	EnableBind      bool
 	EnableAssociate bool
+	// EnableResolve and EnableResolvePTR permit the Tor name resolution
+	// extensions
+	EnableResolve    bool
+	EnableResolvePTR bool
 }
 
 func (p *PermitCommand) Allow(ctx context.Context, req *Request) (context.Context, bool) {
@@ -35,6 +39,10 @@ func (p *PermitCommand) Allow(ctx context.Context, req *Request) (context.Contex
 		return ctx, p.EnableBind
 	case AssociateCommand:
 		return ctx, p.EnableAssociate
+	case ResolveCommand:
+		return ctx, p.EnableResolve
+	case ResolvePTRCommand:
+		return ctx, p.EnableResolvePTR
 	}
 
 	return ctx, false
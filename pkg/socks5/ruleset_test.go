@@ -8,7 +8,7 @@ import (
 
 func TestPermitCommand(t *testing.T) {
 	ctx := context.Background()
-	r := &PermitCommand{true, false, false}
+	r := &PermitCommand{true, false, false, false, false}
 
 	if _, ok := r.Allow(ctx, &Request{Command: ConnectCommand}); !ok {
 		t.Fatalf("expect connect")
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"net"
+	"time"
 
 	"context"
 
@@ -31,12 +32,25 @@ type Config struct {
 	// Defaults to DNSResolver if not provided.
 	Resolver NameResolver
 
+	// LazyResolve defers resolving destination names until the
+	// destination is dialed. Rules and pickers see the name only, unless
+	// they call Request.ResolveDestination. Names are not resolved at
+	// all if the picker marks the context using WithRemoteResolution.
+	LazyResolve bool
+
+	// AddressFamily selects which of the addresses a destination name
+	// resolves to are tried, and in which order.
+	// Defaults to PreferIPv6.
+	AddressFamily AddressFamily
+
 	// Rules is provided to enable custom logic around permitting
 	// various commands. If not provided, PermitAll is used.
 	Rules RuleSet
 
 	// Rewriter can be used to transparently rewrite addresses.
-	// This is invoked before the RuleSet is invoked.
+	// This is invoked before the RuleSet is invoked, and before names are
+	// resolved. The rewritten destination is resolved instead of the
+	// requested one, which may only exist behind the rewrite.
 	// Defaults to NoRewrite.
 	Rewriter AddressRewriter
 
@@ -46,11 +60,16 @@ type Config struct {
 	// Finalizer is used for complete connection and logging something
 	Finalizer Finalizer
 
+	// Observers are notified as connections pass through each stage,
+	// in the order given
+	Observers []Observer
+
 	// Logger can be used to provide a custom log target.
 	// Defaults to stdout.
 	Logger axe.Logger
 
-	// Optional function for dialing out
+	// Optional function for dialing out.
+	// Defaults to HappyEyeballsDialer, using Resolver and AddressFamily.
 	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
 
 	// Dial picker
@@ -61,6 +80,17 @@ type Config struct {
 
 	// Output ratelimit bucket
 	OutBucket *ratelimit.Bucket
+
+	// BufferSize is the size of the buffers used to relay data, one per
+	// direction of each connection. Buffers are pooled, and only taken
+	// once relaying starts.
+	// Defaults to PROXY_BUFFER_LENGTH.
+	BufferSize int
+
+	// RelayLinger is how long the remaining direction of a connection may
+	// stay idle, once the other direction was closed.
+	// Defaults to DefaultRelayLinger.
+	RelayLinger time.Duration
 }
 
 // Server is reponsible for accepting connections and handling
@@ -68,6 +98,7 @@ type Config struct {
 type Server struct {
 	config      *Config
 	authMethods map[uint8]Authenticator
+	buffers     *bufferPool
 }
 
 // New creates a new Server and potentially returns an error
@@ -75,7 +106,7 @@ func New(conf *Config) (*Server, error) {
 	// Ensure we have at least one authentication method enabled
 	if len(conf.AuthMethods) == 0 {
 		if conf.Credentials != nil {
-			conf.AuthMethods = []Authenticator{&UserPassAuthenticator{conf.Credentials}}
+			conf.AuthMethods = []Authenticator{&UserPassAuthenticator{Credentials: conf.Credentials}}
 		} else {
 			conf.AuthMethods = []Authenticator{&NoAuthAuthenticator{}}
 		}
@@ -101,8 +132,14 @@ func New(conf *Config) (*Server, error) {
 		conf.Finalizer = &LogFinalizer{conf.Logger}
 	}
 
+	// Ensure we have a buffer size
+	if conf.BufferSize <= 0 {
+		conf.BufferSize = PROXY_BUFFER_LENGTH
+	}
+
 	server := &Server{
-		config: conf,
+		config:  conf,
+		buffers: newBufferPool(conf.BufferSize),
 	}
 
 	server.authMethods = make(map[uint8]Authenticator)
@@ -136,13 +173,25 @@ func (s *Server) Serve(l net.Listener) error {
 }
 
 // ServeConn is used to serve a single connection.
-func (s *Server) ServeConn(conn net.Conn) error {
+func (s *Server) ServeConn(conn net.Conn) (err error) {
 	defer conn.Close()
 	bufConn := bufio.NewReader(conn)
 
+	request := &Request{
+		RemoteAddr: NewAddrSpec(conn.RemoteAddr()),
+		ClientAddr: conn.RemoteAddr(),
+		StartTime:  time.Now(),
+		observers:  s.config.Observers,
+	}
+	ctx := request.observers.OnAccept(WithClientAddr(context.Background(), conn.RemoteAddr()), request, conn)
+	defer func() {
+		request.observers.OnClose(ctx, request, err)
+	}()
+
 	// Read the version byte
 	version := []byte{0}
 	if _, err := bufConn.Read(version); err != nil {
+		request.observers.OnVersion(ctx, request, 0, err)
 		s.config.Logger.Errorf("socks: Failed to get version byte: %v", err)
 		return err
 	}
@@ -150,38 +199,51 @@ func (s *Server) ServeConn(conn net.Conn) error {
 	// Ensure we are compatible
 	if version[0] != socks5Version {
 		err := fmt.Errorf("Unsupported SOCKS version: %v", version)
+		request.observers.OnVersion(ctx, request, version[0], err)
 		s.config.Logger.Errorf("socks: %v", err)
 		return err
 	}
+	request.observers.OnVersion(ctx, request, version[0], nil)
 
 	// Authenticate the connection
-	authContext, err := s.authenticate(conn, bufConn)
+	authStart := time.Now()
+	authContext, err := s.authenticateContext(ctx, request, conn, bufConn)
 	if err != nil {
-		err = fmt.Errorf("Failed to authenticate: %v", err)
-		s.config.Logger.Errorf("socks: %v", err)
+		outcome := AuthOutcomeOf(err)
+		request.AuthOutcome = outcome
+		request.observers.OnAuth(ctx, request, authStart, outcome, err)
+		err = fmt.Errorf("Failed to authenticate: %w", err)
+		if outcome == AuthOutcomeBackendError {
+			s.config.Logger.Errorf("socks: Authentication backend unavailable (outcome=%v): %v", outcome, err)
+		} else {
+			s.config.Logger.Errorf("socks: %v (outcome=%v)", err, outcome)
+		}
+		s.finalize(ctx, request, conn, err)
 		return err
 	}
+	request.AuthContext = authContext
+	ctx = WithAuthContext(ctx, authContext)
+	request.observers.OnAuth(ctx, request, authStart, AuthOutcomeSuccess, nil)
 
-	request, err := NewRequest(bufConn)
-	if err != nil {
+	if err := request.read(bufConn); err != nil {
+		request.observers.OnRequest(ctx, request, err)
 		if err == unrecognizedAddrType {
-			if err := sendReply(conn, addrTypeNotSupported, nil); err != nil {
-				return fmt.Errorf("Failed to send reply: %v", err)
+			if err := request.sendReply(ctx, conn, addrTypeNotSupported, nil); err != nil {
+				err = fmt.Errorf("Failed to send reply: %v", err)
+				s.finalize(ctx, request, conn, err)
+				return err
 			}
 		}
-		return fmt.Errorf("Failed to read destination address: %v", err)
-	}
-	s.config.Logger.Debugf("[INF] new incoming request from %v", conn.RemoteAddr().(*net.TCPAddr))
-	request.AuthContext = authContext
-	if client, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
-		request.RemoteAddr = &AddrSpec{IP: client.IP, Port: client.Port}
+		err = fmt.Errorf("Failed to read destination address: %v", err)
+		s.finalize(ctx, request, conn, err)
+		return err
 	}
+	request.observers.OnRequest(ctx, request, nil)
+	s.config.Logger.Debugf("[INF] new incoming request from %v", conn.RemoteAddr())
 
 	// Process the client request
-	ctx, err := s.handleRequest(request, conn)
-	if s.config.Finalizer != nil {
-		s.config.Finalizer.Finalize(request, conn, ctx)
-	}
+	ctx, err = s.handleRequest(ctx, request, conn)
+	s.finalize(ctx, request, conn, err)
 	if err != nil {
 		err = fmt.Errorf("Failed to handle request: %v", err)
 		return err
@@ -189,3 +251,15 @@ func (s *Server) ServeConn(conn net.Conn) error {
 
 	return nil
 }
+
+// finalize passes the request to the Finalizer once it's done, including
+// requests which failed authentication or couldn't be read
+func (s *Server) finalize(ctx context.Context, request *Request, conn net.Conn, err error) {
+	request.Err = err
+	if request.FinishTime.IsZero() {
+		request.FinishTime = time.Now()
+	}
+	if s.config.Finalizer != nil {
+		s.config.Finalizer.Finalize(request, conn, ctx)
+	}
+}
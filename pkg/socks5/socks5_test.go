@@ -2,9 +2,14 @@ package socks5
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"io"
+	"io/ioutil"
+	"log"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -108,3 +113,189 @@ func TestSOCKS5_Connect(t *testing.T) {
 		t.Fatalf("bad: %v", out)
 	}
 }
+
+func TestSOCKS5_Pipe(t *testing.T) {
+	// Create a target listening on a unix socket
+	dir, err := ioutil.TempDir("", "socks5")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "target.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf := make([]byte, 4)
+		if _, err := io.ReadAtLeast(conn, buf, 4); err != nil {
+			return
+		}
+		conn.Write([]byte("pong"))
+	}()
+
+	// Serve an in-memory pipe, dialing the unix socket
+	serv, err := New(&Config{
+		Logger: axe.New(),
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn, server := net.Pipe()
+	defer conn.Close()
+	go serv.ServeConn(server)
+
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{5, 1, NoAuth})
+	req.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+	req.Write([]byte("ping"))
+	conn.SetDeadline(time.Now().Add(time.Second))
+	go conn.Write(req.Bytes())
+
+	// The target isn't IP based, so 0.0.0.0:0 is reported as bound
+	expected := []byte{
+		socks5Version, NoAuth,
+		5, 0, 0,
+		1, 0, 0, 0, 0, 0, 0,
+		'p', 'o', 'n', 'g',
+	}
+	out := make([]byte, len(expected))
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+// benchConn replays a client's request, discarding the replies
+type benchConn struct {
+	net.Conn
+	in io.Reader
+}
+
+func (c *benchConn) Read(b []byte) (int, error)         { return c.in.Read(b) }
+func (c *benchConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (c *benchConn) Close() error                       { return nil }
+func (c *benchConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *benchConn) SetWriteDeadline(t time.Time) error { return nil }
+func (c *benchConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+}
+
+type nopFinalizer struct{}
+
+func (nopFinalizer) Finalize(request *Request, conn net.Conn, ctx context.Context) error {
+	return nil
+}
+
+// recordingFinalizer keeps the last finalized request
+type recordingFinalizer struct {
+	request *Request
+}
+
+func (f *recordingFinalizer) Finalize(request *Request, conn net.Conn, ctx context.Context) error {
+	f.request = request
+	return nil
+}
+
+func TestSOCKS5_FinalizeFailures(t *testing.T) {
+	cases := []struct {
+		name    string
+		request []byte
+		outcome AuthOutcome
+		replied bool
+		reply   uint8
+	}{
+		{"wrong password", []byte{5, 1, UserPassAuth, 1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'z'}, AuthOutcomeInvalidCredentials, false, 0},
+		{"no acceptable method", []byte{5, 1, NoAuth}, AuthOutcomeNoAcceptableMethod, false, 0},
+		{"unsupported address type", []byte{5, 1, UserPassAuth, 1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r', 5, 1, 0, 9, 0, 80}, AuthOutcomeSuccess, true, addrTypeNotSupported},
+		{"truncated request", []byte{5, 1, UserPassAuth, 1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r', 5, 1}, AuthOutcomeSuccess, false, 0},
+	}
+	for _, c := range cases {
+		finalizer := &recordingFinalizer{}
+		serv, err := New(&Config{
+			Credentials: StaticCredentials{"foo": "bar"},
+			Logger:      discardLogger(),
+			Finalizer:   finalizer,
+		})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := serv.ServeConn(&benchConn{in: bytes.NewReader(c.request)}); err == nil {
+			t.Fatalf("%s: expected error", c.name)
+		}
+
+		req := finalizer.request
+		if req == nil {
+			t.Fatalf("%s: request not finalized", c.name)
+		}
+		if req.Err == nil || req.AuthOutcome != c.outcome {
+			t.Fatalf("%s: bad outcome %v: %v", c.name, req.AuthOutcome, req.Err)
+		}
+		if req.Replied != c.replied || req.Reply != c.reply {
+			t.Fatalf("%s: bad reply %v %d", c.name, req.Replied, req.Reply)
+		}
+		if req.StartTime.IsZero() || req.FinishTime.Before(req.StartTime) {
+			t.Fatalf("%s: bad times %v %v", c.name, req.StartTime, req.FinishTime)
+		}
+	}
+}
+
+func discardLogger() axe.Logger {
+	l := log.New(io.Discard, "", 0)
+	return axe.NewWithLoggers(l, l, l, l, l, l, l)
+}
+
+func BenchmarkServeConn_Denied(b *testing.B) {
+	serv, err := New(&Config{
+		Rules:     PermitNone(),
+		Logger:    discardLogger(),
+		Finalizer: nopFinalizer{},
+	})
+	if err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	request := []byte{5, 1, NoAuth, 5, 1, 0, 1, 127, 0, 0, 1, 0, 80}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		serv.ServeConn(&benchConn{in: bytes.NewReader(request)})
+	}
+}
+
+func BenchmarkServeConn_Connect(b *testing.B) {
+	serv, err := New(&Config{
+		Logger:    discardLogger(),
+		Finalizer: nopFinalizer{},
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			target, conn := net.Pipe()
+			go func() {
+				target.Write([]byte("pong"))
+				target.Close()
+			}()
+			return conn, nil
+		},
+	})
+	if err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	request := []byte{5, 1, NoAuth, 5, 1, 0, 1, 127, 0, 0, 1, 0, 80}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := serv.ServeConn(&benchConn{in: bytes.NewReader(request)}); err != nil {
+			b.Fatalf("err: %v", err)
+		}
+	}
+}
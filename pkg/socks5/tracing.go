@@ -0,0 +1,170 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the name of the Tracer used by TracingObserver
+const TracerName = "github.com/fholzer/go-socks5/pkg/socks5"
+
+// TracingObserver is an Observer recording an OpenTelemetry span per
+// connection, with child spans for authentication, resolving, rewriting,
+// rules, picking and dialing. The connection span is carried on the
+// context, so spans created by dialers are part of the same trace.
+type TracingObserver struct {
+	NopObserver
+
+	tracer trace.Tracer
+
+	// Attributes optionally returns further attributes of the request,
+	// e.g. the forwarder chosen. They are recorded on the pick span and
+	// on the connection span when it ends.
+	Attributes func(ctx context.Context, req *Request) []attribute.KeyValue
+}
+
+// NewTracingObserver creates a new TracingObserver. If provider is nil,
+// the global TracerProvider is used.
+func NewTracingObserver(provider trace.TracerProvider) *TracingObserver {
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	return &TracingObserver{tracer: provider.Tracer(TracerName)}
+}
+
+func (t *TracingObserver) OnAccept(ctx context.Context, req *Request, conn net.Conn) context.Context {
+	attrs := []attribute.KeyValue{netTransport(conn.RemoteAddr())}
+	if addr := NewAddrSpec(conn.RemoteAddr()); addr != nil {
+		attrs = append(attrs, semconv.NetPeerIPKey.String(addr.IP.String()), semconv.NetPeerPortKey.Int(addr.Port))
+	}
+	ctx, span := t.tracer.Start(ctx, "socks5.conn",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrs...))
+	return context.WithValue(ctx, tracingSpanKey, span)
+}
+
+func (t *TracingObserver) OnAuth(ctx context.Context, req *Request, start time.Time, outcome AuthOutcome, err error) {
+	attrs := []attribute.KeyValue{attribute.String("socks5.auth.outcome", outcome.String())}
+	if req.AuthContext != nil {
+		attrs = append(attrs, attribute.Int("socks5.auth.method", int(req.AuthContext.Method)))
+	}
+	t.child(ctx, "socks5.authenticate", start, err, attrs...)
+}
+
+func (t *TracingObserver) OnRequest(ctx context.Context, req *Request, err error) {
+	if span, ok := ctx.Value(tracingSpanKey).(trace.Span); ok && err == nil {
+		span.SetAttributes(
+			attribute.Int("socks5.command", int(req.Command)),
+			attribute.String("socks5.destination", req.DestAddr.String()))
+	}
+}
+
+func (t *TracingObserver) OnResolve(ctx context.Context, req *Request, start time.Time, err error) {
+	attrs := []attribute.KeyValue{attribute.String("socks5.destination", req.DestAddr.String())}
+	if name, ok := ResolverNameFromContext(ctx); ok {
+		attrs = append(attrs, attribute.String("socks5.resolver", name))
+	}
+	if ips, ok := DestinationIPsFromContext(ctx); ok {
+		addrs := make([]string, len(ips))
+		for i, ip := range ips {
+			addrs[i] = ip.String()
+		}
+		attrs = append(attrs, attribute.String("socks5.addresses", strings.Join(addrs, ",")))
+	}
+	t.child(ctx, "socks5.resolve", start, err, attrs...)
+}
+
+func (t *TracingObserver) OnRewrite(ctx context.Context, req *Request, start time.Time) {
+	var attrs []attribute.KeyValue
+	if real := req.RealDestAddr(); real != nil {
+		attrs = append(attrs, attribute.String("socks5.real_destination", real.String()))
+	}
+	t.child(ctx, "socks5.rewrite", start, nil, attrs...)
+}
+
+func (t *TracingObserver) OnRule(ctx context.Context, req *Request, start time.Time, allowed bool) {
+	t.child(ctx, "socks5.rules", start, nil, attribute.Bool("socks5.allowed", allowed))
+}
+
+func (t *TracingObserver) OnPick(ctx context.Context, req *Request, start time.Time) {
+	var attrs []attribute.KeyValue
+	if t.Attributes != nil {
+		attrs = t.Attributes(ctx, req)
+	}
+	t.child(ctx, "socks5.pick", start, nil, attrs...)
+}
+
+func (t *TracingObserver) OnDial(ctx context.Context, req *Request, start time.Time, addr string, err error) {
+	t.child(ctx, "socks5.dial", start, err, attribute.String("socks5.dial.address", addr))
+}
+
+func (t *TracingObserver) OnReply(ctx context.Context, req *Request, reply uint8, err error) {
+	if span, ok := ctx.Value(tracingSpanKey).(trace.Span); ok {
+		span.AddEvent("reply", trace.WithAttributes(attribute.Int("socks5.reply", int(reply))))
+	}
+}
+
+func (t *TracingObserver) OnClose(ctx context.Context, req *Request, err error) {
+	span, ok := ctx.Value(tracingSpanKey).(trace.Span)
+	if !ok {
+		return
+	}
+	if req.DestAddr != nil {
+		span.SetAttributes(
+			attribute.Int("socks5.reply", int(req.Reply)),
+			attribute.Int64("socks5.request_bytes", req.ReqByte),
+			attribute.Int64("socks5.response_bytes", req.RespByte))
+		if real := req.RealDestAddr(); real != nil {
+			span.SetAttributes(attribute.String("socks5.real_destination", real.String()))
+		}
+		if t.Attributes != nil {
+			span.SetAttributes(t.Attributes(ctx, req)...)
+		}
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// child records a span of a stage that started at start, and has just
+// ended
+func (t *TracingObserver) child(ctx context.Context, name string, start time.Time, err error, attrs ...attribute.KeyValue) {
+	parent, ok := ctx.Value(tracingSpanKey).(trace.Span)
+	if !ok {
+		return
+	}
+	_, span := t.tracer.Start(trace.ContextWithSpan(ctx, parent), name,
+		trace.WithTimestamp(start),
+		trace.WithAttributes(attrs...))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// netTransport returns the net.transport attribute of a client address
+func netTransport(addr net.Addr) attribute.KeyValue {
+	if addr == nil {
+		return semconv.NetTransportOther
+	}
+	switch addr.Network() {
+	case "tcp", "tcp4", "tcp6":
+		return semconv.NetTransportTCP
+	case "unix", "unixpacket":
+		return semconv.NetTransportUnix
+	case "pipe":
+		return semconv.NetTransportPipe
+	}
+	return semconv.NetTransportOther
+}
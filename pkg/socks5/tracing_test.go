@@ -0,0 +1,94 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type failingPicker struct{}
+
+func (failingPicker) Pick(req *Request, ctx context.Context) (context.Context, func(ctx context.Context, network, addr string) (net.Conn, error)) {
+	return context.WithValue(ctx, "forwarder", "failing"), func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, fmt.Errorf("dial failed")
+	}
+}
+
+func TestTracingObserver(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	tracing := NewTracingObserver(provider)
+	tracing.Attributes = func(ctx context.Context, req *Request) []attribute.KeyValue {
+		forwarder, _ := ctx.Value("forwarder").(string)
+		return []attribute.KeyValue{attribute.String("forwarder", forwarder)}
+	}
+	closed := &recordingObserver{name: "closed", events: make(chan string, 32)}
+
+	rewriter, err := NewRuleRewriter([]RewriteRule{{Domains: []string{"example.com"}, Host: "backend.example.org"}})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	addr, stop := startServer(t, &Config{
+		Resolver:    staticResolver{net.ParseIP("192.0.2.1")},
+		LazyResolve: true,
+		Rewriter:    rewriter,
+		Picker:      failingPicker{},
+		Observers:   []Observer{tracing, closed},
+	})
+	defer stop()
+
+	c := &Client{Address: addr}
+	if _, err := c.DialContext(context.Background(), "tcp", "foo.example.com:80"); err == nil {
+		t.Fatalf("expected error")
+	}
+	closed.collect(t)
+
+	spans := exporter.GetSpans()
+	names := map[string]tracetest.SpanStub{}
+	for _, span := range spans {
+		names[span.Name] = span
+	}
+	root, ok := names["socks5.conn"]
+	if !ok {
+		t.Fatalf("missing connection span: %v", spans)
+	}
+	if root.SpanKind != trace.SpanKindServer {
+		t.Fatalf("bad span kind: %v", root.SpanKind)
+	}
+	for _, name := range []string{"socks5.authenticate", "socks5.rewrite", "socks5.resolve", "socks5.rules", "socks5.pick", "socks5.dial"} {
+		span, ok := names[name]
+		if !ok {
+			t.Fatalf("missing span %s: %v", name, spans)
+		}
+		if span.Parent.SpanID() != root.SpanContext.SpanID() {
+			t.Fatalf("span %s not a child of the connection span", name)
+		}
+	}
+	if names["socks5.dial"].Status.Description != "dial failed" {
+		t.Fatalf("bad dial status: %v", names["socks5.dial"].Status)
+	}
+
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range root.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	expected := map[attribute.Key]string{
+		"socks5.destination":      "foo.example.com:80",
+		"socks5.real_destination": "backend.example.org (192.0.2.1):80",
+		"forwarder":               "failing",
+	}
+	for key, value := range expected {
+		if attrs[key].Emit() != value {
+			t.Fatalf("bad %s: %v", key, attrs[key].Emit())
+		}
+	}
+	if attrs["socks5.reply"].AsInt64() != int64(serverFailure) {
+		t.Fatalf("bad reply: %v", attrs["socks5.reply"].Emit())
+	}
+}